@@ -6,6 +6,7 @@ import (
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
+	"github.com/morningli/packet_monitor/pkg/clusterbus"
 	"github.com/morningli/packet_monitor/pkg/common"
 	"github.com/morningli/packet_monitor/pkg/raw"
 	"github.com/morningli/packet_monitor/pkg/redis"
@@ -15,35 +16,89 @@ import (
 	"golang.org/x/sync/errgroup"
 	"net"
 	"os"
-	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
 	localHost = flag.String("h", "", "monitor listened ip")
 	localPort = flag.Int("p", 8003, "monitor listened port")
-	protocol  = flag.String("P", "redis", "protocol, eg:redis/raw")
-	output    = flag.String("o", "default", `output target, The format is <type>:<params>.
+	protocol  = flag.String("P", "redis", `protocol, eg:redis/raw/cluster-bus
+	- cluster-bus: decode the cluster bus of the monitored port (redis port + 10000), report messages per type and peer,
+		gossip sizes, epoch changes and node flag transitions every interval seconds, set by -o default:<interval>`)
+	output = flag.String("o", "default", `output target, The format is <type>:<params>.
 	type: default/file/single/cluster...
 	- default: output to stdout
-	- file: output to file, params is file name, eg: file:out.txt
+	- file: output to file in the format of redis MONITOR, params is file name, eg: file:out.txt
+	- json: output one JSON object per command, with its reply type, size and latency, to a file or stdout
+		without params, eg: json:out.jsonl
+	- aof: append the write commands which succeeded to an append only file loadable by redis-server, params is file
+		name, eg: aof:appendonly.aof
 	- single: output to single redis, params is redis address, eg: single:127.0.0.1:8003
 	- cluster： output to redis cluster, params is cluster address, eg: cluster:127.0.0.1:8003,127.0.0.2:8003
-	- count: count key frequency which more than threshold every seconds, eg: count:1
+	- hotkey: report the top k read and write keys of every window, params is k and window seconds, eg: hotkey:10,1
+	- count: same as hotkey:10,<window seconds>, eg: count:1
 	- histogram: statistical histogram based on specified attributes, eg: 
 		- histogram:req.size: request data size 
 		- histogram:rsp.size: respond data size 
 		- histogram:req.len: request parameter number
-		- histogram:rsp.len: respond parameter number`)
-	workerNum = flag.Int("worker-num", 10, "worker number")
-	interf    = flag.String("i", "any", "network interface")
-	buffSize  = flag.Int("B", 256<<20, "buffer size")
-	logLevel  = flag.String("log-level", "info", "log level,trace/debug/info/warn/error/fatal/panic")
+		- histogram:rsp.len: respond parameter number
+	- pubsub: report channels, subscribers, publish rates and message sizes every interval seconds, eg: pubsub:10
+	- slots: report traffic per cluster slot and slot range, and MOVED/ASK redirections, params is interval seconds and range size, eg: slots:10,1024
+	- errors: count error replies per error prefix, command and client every interval seconds, eg: errors:10
+	- bigkey: flag requests and replies over a byte or element threshold and report the largest keys,
+		params is bytes, elements and interval seconds, eg: bigkey:10240,1000,10
+	- compare: send the requests to a candidate server and compare its replies with the captured ones, sets and maps in any
+		order, report mismatches per command with examples and both latencies, params is interval seconds and the candidate
+		address, eg: compare:10,127.0.0.1:6380
+	- latency: report service latency, and the wait time of blocking commands separately, every interval seconds, eg: latency:10
+	- scripts: report calls, keys, latency and NOSCRIPT errors per lua script and function every interval seconds,
+		add source to print each script source at its first call, eg: scripts:10,source
+	- patterns: report qps, read/write ratio, bytes and latency per key pattern every interval seconds, eg: patterns:10
+	- replication: decode the connections of replicas to the monitored master, report resyncs, propagated commands,
+		offsets and replica ack lag every interval seconds, eg: replication:10
+	- cache: report the hit ratio of read commands per command, key pattern and client, and the keys missed most,
+		every interval seconds, eg: cache:10
+	- ttl: report the ttls set per key pattern and client, keys written without ttl, keys whose ttl is refreshed
+		on every read and overwrites dropping a ttl, every interval seconds, eg: ttl:10
+	- profile: print a table of request bytes, argument count, reply bytes and reply elements per command every interval
+		seconds, params is the interval followed by percentiles, eg: profile:10,50,99,99.9`)
+	workerNum   = flag.Int("worker-num", 10, "worker number")
+	interf      = flag.String("i", "any", "network interface")
+	buffSize    = flag.Int("B", 256<<20, "buffer size")
+	logLevel    = flag.String("log-level", "info", "log level,trace/debug/info/warn/error/fatal/panic")
+	client      = flag.String("client", "", "only output the commands of clients whose name matches the glob pattern, eg: app-*")
+	groupBy     = flag.String("group-by", "addr", "how outputs group clients, addr: ip:port, name: client name, or ip for clients without name")
+	withServer  = flag.Bool("with-server", false, "write the monitored server endpoint after the client in the file output, eg: [0 <client> <server>]")
+	aofTS       = flag.Bool("aof-timestamp", false, "add #TS:<unix time> annotations to the aof output, like aof-timestamp-enabled")
+	keyPatterns = flag.String("key-patterns", "", `key patterns tried before the automatic normalization, globs separated by ',', eg: "order:*,user:*:cart"`)
+	redact      = flag.String("redact", "", `redact rules applied to the outputs printing commands: default/file/json/hotkey/pubsub/errors/scripts/cache/ttl,
+	credentials are always masked in them, the other outputs get the original commands.
+	Rules are separated by ';', each one is an action followed by selectors:
+		mask|hash|truncate=<n> [cmd=<name>] [key=<glob>] [pos=<n>]
+	without pos the rule applies to every argument that is not a key, eg: "hash cmd=set pos=2;truncate=8 key=session:*"`)
+	rules = flag.String("rules", "", `rules of the single/cluster outputs and of replay, FLUSHALL, FLUSHDB, CONFIG, SHUTDOWN, DEBUG
+	and KEYS are dropped unless allowed. Rules are separated by ';', each one is an action followed by selectors:
+		keep|drop|allow|add-prefix=<p>|remove-prefix=<p>|hashtag|db=<from>:<to>
+			[cmd=<name>,<name>] [class=read|write] [key=<regexp>] [client=<cidr>] [name=<glob>]
+	when there are keep rules only the commands they match are sent, filters match the first key and
+	transformations change every key matching, eg: "keep class=write;drop key=^tmp:;add-prefix=staging: key=^user:;db=0:1"`)
 )
 
+func replayRules() []redis.ReplayRule {
+	parsed, err := redis.ParseReplayRules(*rules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return parsed
+}
+
 func main() {
-	debug.SetGCPercent(400)
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replayMain(os.Args[2:])
+		return
+	}
 
 	flag.Parse()
 
@@ -88,38 +143,52 @@ func main() {
 	defer handle.Close()
 
 	onlyIn := false
-	onlyOut := false
+
+	redis.SetClientFilter(*client)
+	redis.SetGroupByName(*groupBy == "name")
+	redis.SetKeyPatterns(strings.Split(*keyPatterns, ","))
+
+	var outputType string
+	var outputParams string
+	pos := strings.Index(*output, ":")
+	if pos == -1 {
+		outputType = *output
+	} else {
+		outputType = (*output)[:pos]
+		if pos != len(*output)-1 {
+			outputParams = (*output)[pos+1:]
+		}
+	}
+
+	server := ""
+	if *withServer {
+		server = fmt.Sprintf("%s:%d", *localHost, *localPort)
+	}
 
 	var wr common.Writer
 	switch *protocol {
-	case "redis":
-		var outputType string
-		var outputParams string
-		pos := strings.Index(*output, ":")
-		if pos == -1 {
-			outputType = *output
-		} else {
-			outputType = (*output)[:pos]
-			if pos != len(*output)-1 {
-				outputParams = (*output)[pos+1:]
-			}
+	case "cluster-bus":
+		interval := 10
+		if len(outputParams) > 0 {
+			interval, _ = strconv.Atoi(outputParams)
 		}
+		wr = clusterbus.NewWriter(time.Duration(interval) * time.Second)
+	case "redis":
 		switch outputType {
 		case "single":
 			if len(outputParams) == 0 {
 				log.Fatalf("No address specified")
 			}
-			wr = redis.NewNetworkWriter(outputParams, false)
+			wr = redis.NewNetworkWriter(outputParams, false, replayRules())
 			onlyIn = true
 		case "cluster":
 			if len(outputParams) == 0 {
 				log.Fatalf("No address specified")
 			}
-			wr = redis.NewNetworkWriter(outputParams, true)
+			wr = redis.NewNetworkWriter(outputParams, true, replayRules())
 			onlyIn = true
 		case "default":
-			wr = redis.NewFileWriter(os.Stdout)
-			onlyIn = true
+			wr = redis.NewFileWriter(os.Stdout, server)
 		case "file":
 			if len(outputParams) == 0 {
 				log.Fatalf("No file name specified")
@@ -129,42 +198,171 @@ func main() {
 				log.Fatal(err)
 			}
 			defer f.Close()
-			wr = redis.NewFileWriter(f)
+			wr = redis.NewFileWriter(f, server)
+		case "json":
+			f := os.Stdout
+			if len(outputParams) > 0 {
+				f, err = os.OpenFile(outputParams, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0544)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer f.Close()
+			}
+			wr = redis.NewJSONWriter(f, fmt.Sprintf("%s:%d", *localHost, *localPort))
+		case "aof":
+			if len(outputParams) == 0 {
+				log.Fatalf("No file name specified")
+			}
+			f, err := os.OpenFile(outputParams, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0544)
+			if err != nil {
+				log.Fatal(err)
+			}
+			defer f.Close()
+			wr = redis.NewAOFWriter(f, *aofTS)
+		case "hotkey", "count":
+			params := []int{10, 1}
+			if outputType == "count" {
+				// the former count output only had the window, eg: count:1
+				outputParams = "," + outputParams
+			}
+			for i, v := range strings.Split(outputParams, ",") {
+				if i < len(params) && len(v) > 0 {
+					params[i], _ = strconv.Atoi(v)
+				}
+			}
+			wr = redis.NewHotKeyWriter(params[0], time.Duration(params[1])*time.Second)
 			onlyIn = true
-		case "count":
-			threshold := 1
+		case "pubsub":
+			interval := 10
+			if len(outputParams) > 0 {
+				interval, _ = strconv.Atoi(outputParams)
+			}
+			wr = redis.NewPubSubWriter(time.Duration(interval) * time.Second)
+		case "slots":
+			interval, rangeSize := 10, 1024
+			params := strings.Split(outputParams, ",")
+			if len(params[0]) > 0 {
+				interval, _ = strconv.Atoi(params[0])
+			}
+			if len(params) > 1 {
+				rangeSize, _ = strconv.Atoi(params[1])
+			}
+			wr = redis.NewSlotWriter(time.Duration(interval)*time.Second, rangeSize)
+		case "errors":
+			interval := 10
 			if len(outputParams) > 0 {
-				threshold, _ = strconv.Atoi(outputParams)
+				interval, _ = strconv.Atoi(outputParams)
 			}
-			wr = redis.NewCountWriter(threshold)
+			wr = redis.NewErrorWriter(time.Duration(interval) * time.Second)
+		case "bigkey":
+			params := []int{10240, 1000, 10}
+			for i, v := range strings.Split(outputParams, ",") {
+				if i < len(params) && len(v) > 0 {
+					params[i], _ = strconv.Atoi(v)
+				}
+			}
+			wr = redis.NewBigKeyWriter(params[0], params[1], time.Duration(params[2])*time.Second)
+		case "compare":
+			params := strings.SplitN(outputParams, ",", 2)
+			if len(params) != 2 || len(params[1]) == 0 {
+				log.Fatalf("No candidate address specified")
+			}
+			interval := 10
+			if len(params[0]) > 0 {
+				interval, _ = strconv.Atoi(params[0])
+			}
+			wr = redis.NewCompareWriter(params[1], time.Duration(interval)*time.Second)
+		case "latency":
+			interval := 10
+			if len(outputParams) > 0 {
+				interval, _ = strconv.Atoi(outputParams)
+			}
+			wr = redis.NewLatencyWriter(time.Duration(interval) * time.Second)
+		case "scripts":
+			interval, source := 10, false
+			params := strings.Split(outputParams, ",")
+			if len(params[0]) > 0 {
+				interval, _ = strconv.Atoi(params[0])
+			}
+			if len(params) > 1 {
+				source = params[1] == "source"
+			}
+			wr = redis.NewScriptWriter(time.Duration(interval)*time.Second, source)
+		case "patterns":
+			interval := 10
+			if len(outputParams) > 0 {
+				interval, _ = strconv.Atoi(outputParams)
+			}
+			wr = redis.NewPatternWriter(time.Duration(interval) * time.Second)
+		case "replication":
+			interval := 10
+			if len(outputParams) > 0 {
+				interval, _ = strconv.Atoi(outputParams)
+			}
+			wr = redis.NewReplicationWriter(time.Duration(interval) * time.Second)
+		case "cache":
+			interval := 10
+			if len(outputParams) > 0 {
+				interval, _ = strconv.Atoi(outputParams)
+			}
+			wr = redis.NewCacheWriter(time.Duration(interval) * time.Second)
+		case "ttl":
+			interval := 10
+			if len(outputParams) > 0 {
+				interval, _ = strconv.Atoi(outputParams)
+			}
+			wr = redis.NewTTLWriter(time.Duration(interval) * time.Second)
 			onlyIn = true
+		case "profile":
+			interval := 10
+			var percentiles []float64
+			for i, v := range strings.Split(outputParams, ",") {
+				if len(v) == 0 {
+					continue
+				}
+				if i == 0 {
+					interval, _ = strconv.Atoi(v)
+					continue
+				}
+				p, err := strconv.ParseFloat(v, 64)
+				if err != nil {
+					log.Fatalf("invalid percentile:%s", v)
+				}
+				percentiles = append(percentiles, p)
+			}
+			wr = redis.NewProfileWriter(time.Duration(interval)*time.Second, percentiles)
 		case "histogram":
 			wr = redis.NewHistogramWriter(1, 1<<30, outputParams)
-			if outputParams[:3] == "req" {
+			if strings.HasPrefix(outputParams, "req") {
 				onlyIn = true
-			} else if outputParams[:3] == "rsp" {
-				onlyOut = true
 			}
+		default:
+			log.Fatalf("unknown output: %s", outputType)
 		}
 	}
 
-	if onlyIn {
-		filter := fmt.Sprintf("tcp and dst host %s and dst port %d", *localHost, *localPort)
-		err = handle.SetBPFFilter(filter)
-		if err != nil {
-			log.Fatal(err)
-		}
-		err = handle.SetDirection(pcap.DirectionIn)
+	// outputs replaying or storing the commands need the real values, and outputs
+	// measuring sizes the original requests, only those printing commands are redacted
+	redacted := false
+	switch outputType {
+	case "default", "file", "json", "hotkey", "count", "pubsub", "errors", "scripts", "cache", "ttl":
+		redacted = true
+	}
+	if wr != nil && *protocol == "redis" && redacted {
+		rules, err := redis.ParseRedactRules(*redact)
 		if err != nil {
 			log.Fatal(err)
 		}
-	} else if onlyOut {
-		filter := fmt.Sprintf("tcp and src host %s and src port %d", *localHost, *localPort)
+		wr = redis.NewRedactWriter(wr, rules)
+	}
+
+	if onlyIn {
+		filter := fmt.Sprintf("tcp and dst host %s and dst port %d", *localHost, *localPort)
 		err = handle.SetBPFFilter(filter)
 		if err != nil {
 			log.Fatal(err)
 		}
-		err = handle.SetDirection(pcap.DirectionInOut)
+		err = handle.SetDirection(pcap.DirectionIn)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -182,7 +380,7 @@ func main() {
 
 	var monitor common.Monitor
 	switch *protocol {
-	case "redis":
+	case "redis", "cluster-bus":
 		monitor = reorder.NewMonitor(net.ParseIP(*localHost), layers.TCPPort(*localPort), onlyIn)
 		monitor.SetWriter(wr)
 	case "raw":
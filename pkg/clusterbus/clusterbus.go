@@ -0,0 +1,244 @@
+package clusterbus
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxEvents   = 100
+	linkTimeout = time.Minute * 30
+)
+
+type link struct {
+	in       Decoder
+	out      Decoder
+	lastTime time.Time
+}
+
+type typeStat struct {
+	in    int64
+	out   int64
+	bytes int64
+}
+
+type peerStat struct {
+	messages int64
+	bytes    int64
+	addr     string
+}
+
+// Writer decodes the links of the monitored cluster bus port. Messages received by the
+// node are FlowIn, messages it sends back on the same links are FlowOut.
+type Writer struct {
+	period    *common.Period
+	mux       sync.Mutex
+	links     map[string]*link
+	types     map[uint16]*typeStat
+	peers     map[string]*peerStat // by sender node name
+	sections  int64                // messages with gossip
+	gossip    int64                // gossip entries
+	maxGossip int
+	errors    int64
+	events    []string // config epoch changes and flag transitions
+	dropped   int64
+
+	epochs map[string]uint64 // config epoch per node
+	flags  map[string]uint16 // flags per observer and node, from headers and gossip
+	epoch  uint64            // highest current epoch
+}
+
+func NewWriter(interval time.Duration) *Writer {
+	return &Writer{
+		period: common.NewPeriod(interval),
+		links:  map[string]*link{},
+		types:  map[uint16]*typeStat{},
+		peers:  map[string]*peerStat{},
+		epochs: map[string]uint64{},
+		flags:  map[string]uint16{},
+	}
+}
+
+func (w *Writer) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	return w.flow(common.RemoteKey(srcHost, srcPort), data, true)
+}
+
+func (w *Writer) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	return w.flow(common.RemoteKey(dstHost, dstPort), data, false)
+}
+
+func (w *Writer) flow(address string, data []byte, in bool) error {
+	w.mux.Lock()
+	l, ok := w.links[address]
+	if !ok {
+		l = &link{}
+		w.links[address] = l
+	}
+	l.lastTime = time.Now()
+	d := &l.in
+	if !in {
+		d = &l.out
+	}
+	msgs, err := d.Append(data)
+	if err != nil {
+		w.errors++
+		log.Warnf("[%s]cluster bus decode fail:%s", address, err)
+	}
+	for _, m := range msgs {
+		w.add(m, in, address)
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+func (w *Writer) event(format string, args ...interface{}) {
+	if len(w.events) >= maxEvents {
+		w.dropped++
+		return
+	}
+	w.events = append(w.events, fmt.Sprintf(format, args...))
+}
+
+func short(node string) string {
+	if len(node) > 8 {
+		return node[:8]
+	}
+	return node
+}
+
+// transition records a change of the flags of a node, as seen by the sender. Each node
+// has its own view, fail? in particular is only an opinion of the sender.
+func (w *Writer) transition(sender, node string, flags uint16) {
+	// myself is relative to the sender
+	flags &^= FlagMyself
+	key := sender + " " + node
+	old, ok := w.flags[key]
+	w.flags[key] = flags
+	if ok && old != flags {
+		w.event("node:%s flags %s -> %s (from %s)", short(node), FlagsString(old), FlagsString(flags), short(sender))
+	}
+}
+
+func (w *Writer) add(m *Message, in bool, address string) {
+	stat, ok := w.types[m.Type]
+	if !ok {
+		stat = &typeStat{}
+		w.types[m.Type] = stat
+	}
+	if in {
+		stat.in++
+	} else {
+		stat.out++
+	}
+	stat.bytes += int64(m.Len)
+
+	peer, ok := w.peers[m.Sender]
+	if !ok {
+		peer = &peerStat{}
+		w.peers[m.Sender] = peer
+	}
+	peer.messages++
+	peer.bytes += int64(m.Len)
+	peer.addr = address
+	if m.IP != "" {
+		// the announced address, links use ephemeral ports
+		peer.addr = fmt.Sprintf("%s:%d", m.IP, m.Port)
+	}
+
+	if m.CurrentEpoch > w.epoch {
+		if w.epoch > 0 {
+			w.event("current epoch %d -> %d (from %s)", w.epoch, m.CurrentEpoch, short(m.Sender))
+		}
+		w.epoch = m.CurrentEpoch
+	}
+	if old, ok := w.epochs[m.Sender]; ok && old != m.ConfigEpoch {
+		w.event("node:%s config epoch %d -> %d", short(m.Sender), old, m.ConfigEpoch)
+	}
+	w.epochs[m.Sender] = m.ConfigEpoch
+	w.transition(m.Sender, m.Sender, m.Flags)
+
+	if len(m.Gossip) > 0 {
+		w.sections++
+		w.gossip += int64(len(m.Gossip))
+		if len(m.Gossip) > w.maxGossip {
+			w.maxGossip = len(m.Gossip)
+		}
+	}
+	for _, g := range m.Gossip {
+		w.transition(m.Sender, g.Node, g.Flags)
+	}
+	switch m.Type {
+	case TypeFail:
+		w.event("node:%s marked as failing by %s", short(m.Fail), short(m.Sender))
+	case TypeUpdate:
+		w.event("node:%s slots updated with config epoch %d by %s", short(m.Update), m.UpdateEpoch, short(m.Sender))
+	}
+}
+
+func (w *Writer) report() {
+	oldTime, ok := w.period.Elapsed()
+	if !ok {
+		return
+	}
+
+	w.mux.Lock()
+	types, peers, events := w.types, w.peers, w.events
+	sections, gossip, maxGossip, errors, dropped, epoch := w.sections, w.gossip, w.maxGossip, w.errors, w.dropped, w.epoch
+	w.types = map[uint16]*typeStat{}
+	w.peers = map[string]*peerStat{}
+	w.events = nil
+	w.sections, w.gossip, w.maxGossip, w.errors, w.dropped = 0, 0, 0, 0, 0
+	for address, l := range w.links {
+		if time.Since(l.lastTime) > linkTimeout {
+			delete(w.links, address)
+		}
+	}
+	w.mux.Unlock()
+
+	seconds := w.period.Seconds()
+	avgGossip := 0.0
+	if sections > 0 {
+		avgGossip = float64(gossip) / float64(sections)
+	}
+	fmt.Printf("[%d]cluster bus current epoch:%d, gossip sections:%d, entries avg:%.1f, max:%d, decode error:%d\n",
+		oldTime, epoch, sections, avgGossip, maxGossip, errors)
+
+	typeIds := make([]int, 0, len(types))
+	for t := range types {
+		typeIds = append(typeIds, int(t))
+	}
+	sort.Ints(typeIds)
+	for _, t := range typeIds {
+		stat := types[uint16(t)]
+		fmt.Printf("[%d]cluster bus type:%s, in:%d, out:%d, rate:%.1f/s, bytes:%d\n",
+			oldTime, TypeName(uint16(t)), stat.in, stat.out, float64(stat.in+stat.out)/seconds, stat.bytes)
+	}
+
+	names := make([]string, 0, len(peers))
+	for name := range peers {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return peers[names[i]].messages > peers[names[j]].messages
+	})
+	for _, name := range names {
+		peer := peers[name]
+		fmt.Printf("[%d]cluster bus peer:%s(%s), messages:%d, rate:%.1f/s, bytes:%d\n",
+			oldTime, short(name), peer.addr, peer.messages, float64(peer.messages)/seconds, peer.bytes)
+	}
+
+	for _, e := range events {
+		fmt.Printf("[%d]cluster bus %s\n", oldTime, e)
+	}
+	if dropped > 0 {
+		fmt.Printf("[%d]cluster bus %d more events\n", oldTime, dropped)
+	}
+}
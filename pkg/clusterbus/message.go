@@ -0,0 +1,235 @@
+package clusterbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+)
+
+// Message types of the cluster bus.
+const (
+	TypePing = iota
+	TypePong
+	TypeMeet
+	TypeFail
+	TypePublish
+	TypeFailoverAuthRequest
+	TypeFailoverAuthAck
+	TypeUpdate
+	TypeMFStart
+	TypeModule
+	TypePublishShard
+)
+
+var typeNames = []string{"ping", "pong", "meet", "fail", "publish", "failover_auth_request",
+	"failover_auth_ack", "update", "mfstart", "module", "publishshard"}
+
+func TypeName(t uint16) string {
+	if int(t) < len(typeNames) {
+		return typeNames[t]
+	}
+	return "unknown"
+}
+
+// Node flags, as in CLUSTER NODES.
+const (
+	FlagMaster     = 1 << 0
+	FlagSlave      = 1 << 1
+	FlagPFail      = 1 << 2
+	FlagFail       = 1 << 3
+	FlagMyself     = 1 << 4
+	FlagHandshake  = 1 << 5
+	FlagNoAddr     = 1 << 6
+	FlagMeet       = 1 << 7
+	FlagMigrateTo  = 1 << 8
+	FlagNoFailover = 1 << 9
+)
+
+var flagNames = []string{"master", "slave", "fail?", "fail", "myself", "handshake", "noaddr", "meet",
+	"migrate_to", "nofailover"}
+
+func FlagsString(flags uint16) string {
+	var names []string
+	for i, name := range flagNames {
+		if flags&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "noflags"
+	}
+	return strings.Join(names, ",")
+}
+
+const (
+	nameLen    = 40
+	ipLen      = 46
+	slotsLen   = 16384 / 8
+	headerLen  = 2256 // clusterMsg without its data
+	gossipLen  = 104  // clusterMsgDataGossip
+	minMsgLen  = 8    // signature and total length
+	maxMsgLen  = 1 << 24
+	signature  = "RCmb"
+	failLen    = nameLen
+	updateLen  = 8 + nameLen + slotsLen
+	publishLen = 8
+)
+
+var (
+	ErrSignature = errors.New("bad signature")
+	ErrLength    = errors.New("bad length")
+)
+
+// Gossip is a section of PING, PONG and MEET describing another node.
+type Gossip struct {
+	Node  string
+	IP    string
+	Port  uint16
+	CPort uint16
+	Flags uint16
+}
+
+// Message is the header of a cluster bus message and the parts of its data used by the reports.
+type Message struct {
+	Type         uint16
+	Len          int
+	Port         uint16
+	Count        uint16
+	CurrentEpoch uint64
+	ConfigEpoch  uint64
+	Offset       uint64
+	Sender       string
+	SlaveOf      string
+	IP           string
+	Flags        uint16
+	State        byte // 0 ok, 1 fail
+	Gossip       []Gossip
+	Fail         string // node reported as failing by FAIL
+	Update       string // node whose slots are updated by UPDATE
+	UpdateEpoch  uint64
+	Channel      string // PUBLISH and PUBLISHSHARD
+	PayloadLen   int
+}
+
+func cstring(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// Parse decodes one message, b holds exactly Len bytes.
+func Parse(b []byte) (*Message, error) {
+	if len(b) < headerLen {
+		return nil, ErrLength
+	}
+	if string(b[:4]) != signature {
+		return nil, ErrSignature
+	}
+	m := &Message{
+		Len:          int(binary.BigEndian.Uint32(b[4:])),
+		Port:         binary.BigEndian.Uint16(b[10:]),
+		Type:         binary.BigEndian.Uint16(b[12:]),
+		Count:        binary.BigEndian.Uint16(b[14:]),
+		CurrentEpoch: binary.BigEndian.Uint64(b[16:]),
+		ConfigEpoch:  binary.BigEndian.Uint64(b[24:]),
+		Offset:       binary.BigEndian.Uint64(b[32:]),
+		Sender:       cstring(b[40 : 40+nameLen]),
+		SlaveOf:      cstring(b[2128 : 2128+nameLen]),
+		IP:           cstring(b[2168 : 2168+ipLen]),
+		Flags:        binary.BigEndian.Uint16(b[2250:]),
+		State:        b[2252],
+	}
+	if m.Len != len(b) {
+		return nil, ErrLength
+	}
+	data := b[headerLen:]
+
+	switch m.Type {
+	case TypePing, TypePong, TypeMeet:
+		if len(data) < int(m.Count)*gossipLen {
+			return nil, ErrLength
+		}
+		m.Gossip = make([]Gossip, m.Count)
+		for i := range m.Gossip {
+			g := data[i*gossipLen:]
+			m.Gossip[i] = Gossip{
+				Node:  cstring(g[:nameLen]),
+				IP:    cstring(g[48 : 48+ipLen]),
+				Port:  binary.BigEndian.Uint16(g[94:]),
+				CPort: binary.BigEndian.Uint16(g[96:]),
+				Flags: binary.BigEndian.Uint16(g[98:]),
+			}
+		}
+	case TypeFail:
+		if len(data) < failLen {
+			return nil, ErrLength
+		}
+		m.Fail = cstring(data[:nameLen])
+	case TypeUpdate:
+		if len(data) < updateLen {
+			return nil, ErrLength
+		}
+		m.UpdateEpoch = binary.BigEndian.Uint64(data)
+		m.Update = cstring(data[8 : 8+nameLen])
+	case TypePublish, TypePublishShard:
+		if len(data) < publishLen {
+			return nil, ErrLength
+		}
+		channelLen := int(binary.BigEndian.Uint32(data))
+		m.PayloadLen = int(binary.BigEndian.Uint32(data[4:]))
+		if len(data) < publishLen+channelLen {
+			return nil, ErrLength
+		}
+		m.Channel = string(data[publishLen : publishLen+channelLen])
+	}
+	return m, nil
+}
+
+// Decoder reassembles the messages of one direction of a bus link.
+type Decoder struct {
+	buf []byte
+}
+
+// Append adds stream data and returns the complete messages. A message with a bad
+// signature or length drops the buffered data, the stream resumes at the next "RCmb".
+func (d *Decoder) Append(data []byte) (msgs []*Message, err error) {
+	d.buf = append(d.buf, data...)
+	for len(d.buf) >= minMsgLen {
+		if string(d.buf[:4]) != signature {
+			err = ErrSignature
+			d.resync()
+			continue
+		}
+		n := int(binary.BigEndian.Uint32(d.buf[4:]))
+		if n < headerLen || n > maxMsgLen {
+			err = ErrLength
+			d.resync()
+			continue
+		}
+		if len(d.buf) < n {
+			break
+		}
+		m, e := Parse(d.buf[:n])
+		if e != nil {
+			err = e
+		} else {
+			msgs = append(msgs, m)
+		}
+		d.buf = d.buf[n:]
+	}
+	if len(d.buf) == 0 {
+		d.buf = nil
+	}
+	return
+}
+
+func (d *Decoder) resync() {
+	i := bytes.Index(d.buf[1:], []byte(signature))
+	if i < 0 {
+		d.buf = nil
+		return
+	}
+	d.buf = d.buf[i+1:]
+}
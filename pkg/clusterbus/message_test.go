@@ -0,0 +1,57 @@
+package clusterbus
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"strings"
+	"testing"
+)
+
+func message(t uint16, sender string, flags uint16, configEpoch uint64, gossip []Gossip) []byte {
+	b := make([]byte, headerLen+len(gossip)*gossipLen)
+	copy(b, signature)
+	binary.BigEndian.PutUint32(b[4:], uint32(len(b)))
+	binary.BigEndian.PutUint16(b[8:], 1)
+	binary.BigEndian.PutUint16(b[10:], 6379)
+	binary.BigEndian.PutUint16(b[12:], t)
+	binary.BigEndian.PutUint16(b[14:], uint16(len(gossip)))
+	binary.BigEndian.PutUint64(b[16:], 5)
+	binary.BigEndian.PutUint64(b[24:], configEpoch)
+	copy(b[40:], sender)
+	copy(b[2168:], "10.0.0.1")
+	binary.BigEndian.PutUint16(b[2250:], flags)
+	for i, g := range gossip {
+		e := b[headerLen+i*gossipLen:]
+		copy(e, g.Node)
+		copy(e[48:], g.IP)
+		binary.BigEndian.PutUint16(e[94:], g.Port)
+		binary.BigEndian.PutUint16(e[98:], g.Flags)
+	}
+	return b
+}
+
+func TestDecoder(t *testing.T) {
+	a, b := strings.Repeat("a", nameLen), strings.Repeat("b", nameLen)
+	ping := message(TypePing, a, FlagMaster|FlagMyself, 3, []Gossip{{Node: b, IP: "10.0.0.2", Port: 6380, Flags: FlagMaster | FlagPFail}})
+
+	var d Decoder
+	msgs, err := d.Append(append([]byte("junk"), ping[:100]...))
+	require.Equal(t, ErrSignature, err)
+	require.Len(t, msgs, 0)
+	msgs, err = d.Append(ping[100:])
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+
+	m := msgs[0]
+	require.Equal(t, "ping", TypeName(m.Type))
+	require.Equal(t, a, m.Sender)
+	require.Equal(t, "10.0.0.1", m.IP)
+	require.Equal(t, uint64(5), m.CurrentEpoch)
+	require.Equal(t, uint64(3), m.ConfigEpoch)
+	require.Equal(t, "master,myself", FlagsString(m.Flags))
+	require.Len(t, m.Gossip, 1)
+	require.Equal(t, b, m.Gossip[0].Node)
+	require.Equal(t, "10.0.0.2", m.Gossip[0].IP)
+	require.Equal(t, uint16(6380), m.Gossip[0].Port)
+	require.Equal(t, "master,fail?", FlagsString(m.Gossip[0].Flags))
+}
@@ -0,0 +1,533 @@
+package common
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FlagWrite = 1 << iota
+	FlagRead
+	FlagAdmin
+	FlagPubSub
+	FlagScript
+	FlagConn
+	FlagTx
+	FlagBlocking
+)
+
+// CommandInfo describes a command like COMMAND INFO does: its class and where its keys are.
+type CommandInfo struct {
+	Name     string
+	Flags    int
+	FirstKey int
+	LastKey  int // negative counts from the end, -1 is the last argument
+	Step     int
+	keys     func(args []interface{}) []int // movable keys, overrides FirstKey/LastKey/Step
+	timeout  func(args []interface{}) (time.Duration, bool)
+}
+
+func (c *CommandInfo) Is(flag int) bool {
+	return c.Flags&flag != 0
+}
+
+var commands = map[string]*CommandInfo{}
+
+func init() {
+	const (
+		w = FlagWrite
+		r = FlagRead
+		a = FlagAdmin
+		p = FlagPubSub
+		s = FlagScript
+		c = FlagConn
+		t = FlagTx
+		b = FlagBlocking
+	)
+	for _, info := range []CommandInfo{
+		//Kv
+		{Name: "get", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "set", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "setnx", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "setex", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "psetex", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "getset", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "getdel", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "getex", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "mget", Flags: r, FirstKey: 1, LastKey: -1, Step: 1},
+		{Name: "mset", Flags: w, FirstKey: 1, LastKey: -1, Step: 2},
+		{Name: "msetnx", Flags: w, FirstKey: 1, LastKey: -1, Step: 2},
+		{Name: "append", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "strlen", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "incr", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "incrby", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "incrbyfloat", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "decr", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "decrby", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "getrange", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "substr", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "setrange", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "lcs", Flags: r, FirstKey: 1, LastKey: 2, Step: 1},
+
+		//BitMap
+		{Name: "setbit", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "getbit", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "bitcount", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "bitpos", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "bitfield", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "bitfield_ro", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "bitop", Flags: w, FirstKey: 2, LastKey: -1, Step: 1},
+
+		//Keys
+		{Name: "del", Flags: w, FirstKey: 1, LastKey: -1, Step: 1},
+		{Name: "unlink", Flags: w, FirstKey: 1, LastKey: -1, Step: 1},
+		{Name: "exists", Flags: r, FirstKey: 1, LastKey: -1, Step: 1},
+		{Name: "touch", Flags: r, FirstKey: 1, LastKey: -1, Step: 1},
+		{Name: "type", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "ttl", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "pttl", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "expiretime", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "pexpiretime", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "expire", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "pexpire", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "expireat", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "pexpireat", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "persist", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "rename", Flags: w, FirstKey: 1, LastKey: 2, Step: 1},
+		{Name: "renamenx", Flags: w, FirstKey: 1, LastKey: 2, Step: 1},
+		{Name: "copy", Flags: w, FirstKey: 1, LastKey: 2, Step: 1},
+		{Name: "move", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "dump", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "restore", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "sort", Flags: w, keys: sortKeys},
+		{Name: "sort_ro", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "object", Flags: r, keys: subcommandKey},
+		{Name: "randomkey", Flags: r},
+		{Name: "keys", Flags: r},
+		{Name: "scan", Flags: r},
+		{Name: "migrate", Flags: w, keys: migrateKeys},
+
+		//Hash
+		{Name: "hset", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hsetnx", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hmset", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hdel", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hincrby", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hincrbyfloat", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hexpire", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hpexpire", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hexpireat", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hpexpireat", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hpersist", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hget", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hmget", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hgetall", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hkeys", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hvals", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hlen", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hexists", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hstrlen", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hrandfield", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hscan", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "httl", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "hpttl", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+
+		//List
+		{Name: "lpush", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "rpush", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "lpushx", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "rpushx", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "linsert", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "lset", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "lrem", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "ltrim", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "lpop", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "rpop", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "rpoplpush", Flags: w, FirstKey: 1, LastKey: 2, Step: 1},
+		{Name: "lmove", Flags: w, FirstKey: 1, LastKey: 2, Step: 1},
+		{Name: "lmpop", Flags: w, keys: numKeys(1)},
+		{Name: "blpop", Flags: w | b, timeout: lastSeconds, FirstKey: 1, LastKey: -2, Step: 1},
+		{Name: "brpop", Flags: w | b, timeout: lastSeconds, FirstKey: 1, LastKey: -2, Step: 1},
+		{Name: "brpoplpush", Flags: w | b, timeout: lastSeconds, FirstKey: 1, LastKey: 2, Step: 1},
+		{Name: "blmove", Flags: w | b, timeout: lastSeconds, FirstKey: 1, LastKey: 2, Step: 1},
+		{Name: "blmpop", Flags: w | b, timeout: firstSeconds, keys: numKeys(2)},
+		{Name: "lrange", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "lindex", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "llen", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "lpos", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+
+		//Set
+		{Name: "sadd", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "srem", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "spop", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "smove", Flags: w, FirstKey: 1, LastKey: 2, Step: 1},
+		{Name: "sunionstore", Flags: w, FirstKey: 1, LastKey: -1, Step: 1},
+		{Name: "sinterstore", Flags: w, FirstKey: 1, LastKey: -1, Step: 1},
+		{Name: "sdiffstore", Flags: w, FirstKey: 1, LastKey: -1, Step: 1},
+		{Name: "smembers", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "sismember", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "smismember", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "scard", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "srandmember", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "sscan", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "sinter", Flags: r, FirstKey: 1, LastKey: -1, Step: 1},
+		{Name: "sunion", Flags: r, FirstKey: 1, LastKey: -1, Step: 1},
+		{Name: "sdiff", Flags: r, FirstKey: 1, LastKey: -1, Step: 1},
+		{Name: "sintercard", Flags: r, keys: numKeys(1)},
+
+		//Zset
+		{Name: "zadd", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zincrby", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zrem", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zremrangebyrank", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zremrangebylex", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zremrangebyscore", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zpopmax", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zpopmin", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "bzpopmax", Flags: w | b, timeout: lastSeconds, FirstKey: 1, LastKey: -2, Step: 1},
+		{Name: "bzpopmin", Flags: w | b, timeout: lastSeconds, FirstKey: 1, LastKey: -2, Step: 1},
+		{Name: "zmpop", Flags: w, keys: numKeys(1)},
+		{Name: "bzmpop", Flags: w | b, timeout: firstSeconds, keys: numKeys(2)},
+		{Name: "zrangestore", Flags: w, FirstKey: 1, LastKey: 2, Step: 1},
+		{Name: "zunionstore", Flags: w, keys: storeNumKeys},
+		{Name: "zinterstore", Flags: w, keys: storeNumKeys},
+		{Name: "zdiffstore", Flags: w, keys: storeNumKeys},
+		{Name: "zrange", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zrangebyscore", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zrangebylex", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zrevrange", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zrevrangebyscore", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zrevrangebylex", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zrank", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zrevrank", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zscore", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zmscore", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zcard", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zcount", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zlexcount", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zrandmember", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zscan", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "zunion", Flags: r, keys: numKeys(1)},
+		{Name: "zinter", Flags: r, keys: numKeys(1)},
+		{Name: "zdiff", Flags: r, keys: numKeys(1)},
+		{Name: "zintercard", Flags: r, keys: numKeys(1)},
+
+		//HyperLogLog
+		{Name: "pfadd", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "pfcount", Flags: r, FirstKey: 1, LastKey: -1, Step: 1},
+		{Name: "pfmerge", Flags: w, FirstKey: 1, LastKey: -1, Step: 1},
+
+		//Geo
+		{Name: "geoadd", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "georadius", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "georadiusbymember", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "geosearchstore", Flags: w, FirstKey: 1, LastKey: 2, Step: 1},
+		{Name: "geodist", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "geohash", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "geopos", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "georadius_ro", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "georadiusbymember_ro", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "geosearch", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+
+		//Stream
+		{Name: "xadd", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "xdel", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "xtrim", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "xsetid", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "xack", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "xclaim", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "xautoclaim", Flags: w, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "xgroup", Flags: w, keys: subcommandKey},
+		{Name: "xreadgroup", Flags: w | b, timeout: blockOption, keys: streamKeys},
+		{Name: "xread", Flags: r | b, timeout: blockOption, keys: streamKeys},
+		{Name: "xlen", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "xrange", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "xrevrange", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "xpending", Flags: r, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "xinfo", Flags: r, keys: subcommandKey},
+
+		//Scripting
+		{Name: "eval", Flags: s, keys: numKeys(2)},
+		{Name: "evalsha", Flags: s, keys: numKeys(2)},
+		{Name: "eval_ro", Flags: s | r, keys: numKeys(2)},
+		{Name: "evalsha_ro", Flags: s | r, keys: numKeys(2)},
+		{Name: "fcall", Flags: s, keys: numKeys(2)},
+		{Name: "fcall_ro", Flags: s | r, keys: numKeys(2)},
+		{Name: "script", Flags: s},
+		{Name: "function", Flags: s},
+
+		//PubSub
+		{Name: "publish", Flags: p},
+		{Name: "subscribe", Flags: p},
+		{Name: "psubscribe", Flags: p},
+		{Name: "unsubscribe", Flags: p},
+		{Name: "punsubscribe", Flags: p},
+		{Name: "pubsub", Flags: p},
+		{Name: "spublish", Flags: p, FirstKey: 1, LastKey: 1, Step: 1},
+		{Name: "ssubscribe", Flags: p, FirstKey: 1, LastKey: -1, Step: 1},
+		{Name: "sunsubscribe", Flags: p, FirstKey: 1, LastKey: -1, Step: 1},
+
+		//Transaction
+		{Name: "multi", Flags: t},
+		{Name: "exec", Flags: t},
+		{Name: "discard", Flags: t},
+		{Name: "watch", Flags: t, FirstKey: 1, LastKey: -1, Step: 1},
+		{Name: "unwatch", Flags: t},
+
+		//Connection
+		{Name: "auth", Flags: c},
+		{Name: "hello", Flags: c},
+		{Name: "client", Flags: c},
+		{Name: "select", Flags: c},
+		{Name: "ping", Flags: c},
+		{Name: "echo", Flags: c},
+		{Name: "quit", Flags: c},
+		{Name: "reset", Flags: c},
+		{Name: "readonly", Flags: c},
+		{Name: "readwrite", Flags: c},
+		{Name: "asking", Flags: c},
+
+		//Server
+		{Name: "config", Flags: a},
+		{Name: "info", Flags: a},
+		{Name: "dbsize", Flags: r},
+		{Name: "flushdb", Flags: w | a},
+		{Name: "flushall", Flags: w | a},
+		{Name: "swapdb", Flags: w | a},
+		{Name: "shutdown", Flags: a},
+		{Name: "debug", Flags: a},
+		{Name: "save", Flags: a},
+		{Name: "bgsave", Flags: a},
+		{Name: "bgrewriteaof", Flags: a},
+		{Name: "lastsave", Flags: a},
+		{Name: "slaveof", Flags: a},
+		{Name: "replicaof", Flags: a},
+		{Name: "sync", Flags: a},
+		{Name: "psync", Flags: a},
+		{Name: "replconf", Flags: a},
+		{Name: "slowlog", Flags: a},
+		{Name: "latency", Flags: a},
+		{Name: "memory", Flags: a, keys: subcommandKey},
+		{Name: "monitor", Flags: a},
+		{Name: "command", Flags: a},
+		{Name: "cluster", Flags: a},
+		{Name: "acl", Flags: a},
+		{Name: "module", Flags: a},
+		{Name: "failover", Flags: a},
+		{Name: "role", Flags: a},
+		{Name: "time", Flags: a},
+		{Name: "wait", Flags: a | b, timeout: lastMillis},
+		{Name: "waitaof", Flags: a | b, timeout: lastMillis},
+	} {
+		info := info
+		commands[info.Name] = &info
+	}
+}
+
+// LookupCommand returns the command table entry of a lower case command name, nil if unknown.
+func LookupCommand(cmd string) *CommandInfo {
+	return commands[cmd]
+}
+
+func IsWrite(cmd string) bool {
+	info := LookupCommand(cmd)
+	return info != nil && info.Is(FlagWrite)
+}
+
+// BlockingTimeout reports whether a command blocks, and the timeout it requested,
+// 0 means it blocks forever. XREAD and XREADGROUP only block with the BLOCK option.
+func BlockingTimeout(cmd string, args []interface{}) (timeout time.Duration, blocking bool) {
+	info := LookupCommand(cmd)
+	if info == nil || !info.Is(FlagBlocking) {
+		return 0, false
+	}
+	return info.timeout(args)
+}
+
+func IsRead(cmd string) bool {
+	info := LookupCommand(cmd)
+	return info != nil && info.Is(FlagRead)
+}
+
+// KeyPositions returns the positions of the keys of a command, args[0] is the command name.
+func KeyPositions(cmd string, args []interface{}) []int {
+	info := LookupCommand(cmd)
+	if info == nil {
+		return nil
+	}
+	var idx []int
+	if info.keys != nil {
+		idx = info.keys(args)
+	} else if info.FirstKey > 0 && info.FirstKey < len(args) {
+		last := info.LastKey
+		if last < 0 {
+			last += len(args)
+		}
+		if last >= len(args) {
+			last = len(args) - 1
+		}
+		for i := info.FirstKey; i <= last; i += info.Step {
+			idx = append(idx, i)
+		}
+	}
+	ret := idx[:0]
+	for _, i := range idx {
+		if i > 0 && i < len(args) {
+			ret = append(ret, i)
+		}
+	}
+	return ret
+}
+
+// GetKeys returns the keys of a command, args[0] is the command name.
+func GetKeys(cmd string, args []interface{}) []string {
+	idx := KeyPositions(cmd, args)
+	keys := make([]string, 0, len(idx))
+	for _, i := range idx {
+		keys = append(keys, args[i].(string))
+	}
+	return keys
+}
+
+func GetFirstKey(cmd string, args []interface{}) string {
+	keys := GetKeys(cmd, args)
+	if len(keys) == 0 {
+		return ""
+	}
+	return keys[0]
+}
+
+// numKeys handles commands with a numkeys argument at pos followed by the keys.
+func numKeys(pos int) func(args []interface{}) []int {
+	return func(args []interface{}) []int {
+		if pos >= len(args) {
+			return nil
+		}
+		n, err := Btoi(StringsToBytes(args[pos].(string)))
+		if err != nil || n < 0 {
+			return nil
+		}
+		// numkeys comes from the client, only the arguments present can be keys
+		if n > len(args)-pos-1 {
+			n = len(args) - pos - 1
+		}
+		idx := make([]int, 0, n)
+		for i := pos + 1; i <= pos+n; i++ {
+			idx = append(idx, i)
+		}
+		return idx
+	}
+}
+
+// storeNumKeys handles ZUNIONSTORE like commands: destination numkeys key [key ...].
+func storeNumKeys(args []interface{}) []int {
+	if len(args) < 2 {
+		return nil
+	}
+	return append([]int{1}, numKeys(2)(args)...)
+}
+
+// streamKeys handles XREAD/XREADGROUP: the keys are the first half after STREAMS.
+func streamKeys(args []interface{}) []int {
+	for i := 1; i < len(args); i++ {
+		if !strings.EqualFold(args[i].(string), "streams") {
+			continue
+		}
+		n := (len(args) - i - 1) / 2
+		idx := make([]int, 0, n)
+		for j := i + 1; j <= i+n; j++ {
+			idx = append(idx, j)
+		}
+		return idx
+	}
+	return nil
+}
+
+// subcommandKey handles container commands like OBJECT ENCODING key.
+func subcommandKey(args []interface{}) []int {
+	if len(args) < 3 || strings.EqualFold(args[1].(string), "help") {
+		return nil
+	}
+	return []int{2}
+}
+
+// sortKeys handles SORT key [... STORE destination].
+func sortKeys(args []interface{}) []int {
+	if len(args) < 2 {
+		return nil
+	}
+	idx := []int{1}
+	for i := 2; i < len(args)-1; i++ {
+		if strings.EqualFold(args[i].(string), "store") {
+			idx = append(idx, i+1)
+		}
+	}
+	return idx
+}
+
+// migrateKeys handles MIGRATE host port key|"" db timeout [... KEYS key [key ...]].
+func migrateKeys(args []interface{}) []int {
+	if len(args) < 6 {
+		return nil
+	}
+	if args[3].(string) != "" {
+		return []int{3}
+	}
+	for i := 6; i < len(args); i++ {
+		if strings.EqualFold(args[i].(string), "keys") {
+			idx := make([]int, 0, len(args)-i-1)
+			for j := i + 1; j < len(args); j++ {
+				idx = append(idx, j)
+			}
+			return idx
+		}
+	}
+	return nil
+}
+
+func parseTimeout(arg interface{}, unit time.Duration) (time.Duration, bool) {
+	f, err := strconv.ParseFloat(arg.(string), 64)
+	if err != nil || f < 0 {
+		return 0, false
+	}
+	return time.Duration(f * float64(unit)), true
+}
+
+// lastSeconds handles BLPOP like commands, the timeout in seconds is the last argument.
+func lastSeconds(args []interface{}) (time.Duration, bool) {
+	if len(args) < 2 {
+		return 0, false
+	}
+	return parseTimeout(args[len(args)-1], time.Second)
+}
+
+// firstSeconds handles BLMPOP like commands, the timeout in seconds is the first argument.
+func firstSeconds(args []interface{}) (time.Duration, bool) {
+	if len(args) < 2 {
+		return 0, false
+	}
+	return parseTimeout(args[1], time.Second)
+}
+
+// lastMillis handles WAIT and WAITAOF, the timeout in milliseconds is the last argument.
+func lastMillis(args []interface{}) (time.Duration, bool) {
+	if len(args) < 2 {
+		return 0, false
+	}
+	return parseTimeout(args[len(args)-1], time.Millisecond)
+}
+
+// blockOption handles XREAD [BLOCK milliseconds] ... STREAMS.
+func blockOption(args []interface{}) (time.Duration, bool) {
+	for i := 1; i < len(args)-1; i++ {
+		arg := args[i].(string)
+		if strings.EqualFold(arg, "streams") {
+			break
+		}
+		if strings.EqualFold(arg, "block") {
+			return parseTimeout(args[i+1], time.Millisecond)
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,20 @@
+package common
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestBlockingTimeout(t *testing.T) {
+	timeout, ok := BlockingTimeout("blpop", []interface{}{"blpop", "a", "b", "1.5"})
+	require.True(t, ok)
+	require.Equal(t, 1500*time.Millisecond, timeout)
+	timeout, ok = BlockingTimeout("xread", []interface{}{"xread", "block", "0", "streams", "s", "$"})
+	require.True(t, ok)
+	require.Equal(t, time.Duration(0), timeout)
+	_, ok = BlockingTimeout("xread", []interface{}{"xread", "streams", "s", "0"})
+	require.False(t, ok)
+	_, ok = BlockingTimeout("get", []interface{}{"get", "a"})
+	require.False(t, ok)
+}
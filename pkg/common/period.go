@@ -0,0 +1,34 @@
+package common
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Period splits time into statistics windows, only one caller wins the end of each window.
+type Period struct {
+	span  int64 // microseconds
+	mtime int64
+}
+
+func NewPeriod(span time.Duration) *Period {
+	return &Period{span: span.Microseconds(), mtime: time.Now().UnixMicro()}
+}
+
+// Elapsed reports whether the current window is over, and returns its start in microseconds.
+func (p *Period) Elapsed() (start int64, ok bool) {
+	oldTime := atomic.LoadInt64(&p.mtime)
+	now := time.Now().UnixMicro()
+	if now-oldTime < p.span {
+		return 0, false
+	}
+	if !atomic.CompareAndSwapInt64(&p.mtime, oldTime, now) {
+		return 0, false
+	}
+	return oldTime, true
+}
+
+// Seconds is the length of the window.
+func (p *Period) Seconds() float64 {
+	return float64(p.span) / 1e6
+}
@@ -0,0 +1,141 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrUnbalancedQuotes = errors.New("unbalanced quotes")
+
+const hexDigits = "0123456789abcdef"
+
+// AppendRepr appends s quoted and escaped like redis MONITOR does (sdscatrepr):
+// \" \\ \n \r \t \a \b, and \xHH for other bytes which are not printable ascii.
+func AppendRepr(dst []byte, s string) []byte {
+	dst = append(dst, '"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '"':
+			dst = append(dst, '\\', c)
+		case '\n':
+			dst = append(dst, '\\', 'n')
+		case '\r':
+			dst = append(dst, '\\', 'r')
+		case '\t':
+			dst = append(dst, '\\', 't')
+		case '\a':
+			dst = append(dst, '\\', 'a')
+		case '\b':
+			dst = append(dst, '\\', 'b')
+		default:
+			if c >= 0x20 && c < 0x7f {
+				dst = append(dst, c)
+			} else {
+				dst = append(dst, '\\', 'x', hexDigits[c>>4], hexDigits[c&0xf])
+			}
+		}
+	}
+	return append(dst, '"')
+}
+
+func fromHex(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// SplitArgs splits a line into arguments like redis-cli does (sdssplitargs): bare words,
+// "double quoted" strings with the escapes of AppendRepr, and 'single quoted' strings.
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && (line[i] == ' ' || line[i] == '\t' || line[i] == '\n' || line[i] == '\r') {
+			i++
+		}
+		if i >= len(line) {
+			return args, nil
+		}
+
+		var arg []byte
+		switch line[i] {
+		case '"':
+			i++
+			for ; ; i++ {
+				if i >= len(line) {
+					return nil, ErrUnbalancedQuotes
+				}
+				c := line[i]
+				if c == '"' {
+					i++
+					break
+				}
+				if c != '\\' || i+1 >= len(line) {
+					arg = append(arg, c)
+					continue
+				}
+				i++
+				switch line[i] {
+				case 'n':
+					arg = append(arg, '\n')
+				case 'r':
+					arg = append(arg, '\r')
+				case 't':
+					arg = append(arg, '\t')
+				case 'a':
+					arg = append(arg, '\a')
+				case 'b':
+					arg = append(arg, '\b')
+				case 'x':
+					if i+2 < len(line) {
+						hi, ok1 := fromHex(line[i+1])
+						lo, ok2 := fromHex(line[i+2])
+						if ok1 && ok2 {
+							arg = append(arg, hi<<4|lo)
+							i += 2
+							continue
+						}
+					}
+					arg = append(arg, 'x')
+				default:
+					arg = append(arg, line[i])
+				}
+			}
+		case '\'':
+			i++
+			for ; ; i++ {
+				if i >= len(line) {
+					return nil, ErrUnbalancedQuotes
+				}
+				c := line[i]
+				if c == '\'' {
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					i++
+					c = '\''
+				}
+				arg = append(arg, c)
+			}
+		default:
+			for i < len(line) && line[i] != ' ' && line[i] != '\t' && line[i] != '\n' && line[i] != '\r' {
+				arg = append(arg, line[i])
+				i++
+			}
+			args = append(args, string(arg))
+			continue
+		}
+		// a closing quote must be followed by a space or the end of the line
+		if i < len(line) && line[i] != ' ' && line[i] != '\t' && line[i] != '\n' && line[i] != '\r' {
+			return nil, fmt.Errorf("%w: closing quote followed by %q", ErrUnbalancedQuotes, line[i])
+		}
+		args = append(args, string(arg))
+	}
+}
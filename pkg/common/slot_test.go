@@ -0,0 +1,38 @@
+package common
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSlot(t *testing.T) {
+	require.Equal(t, uint16(0x31C3), CRC16("123456789"))
+	require.Equal(t, 12182, Slot("foo"))
+	require.Equal(t, Slot("user1000"), Slot("{user1000}.following"))
+	require.Equal(t, Slot("{user1000}.followers"), Slot("{user1000}.following"))
+	require.Equal(t, Slot("foo{}{bar}"), int(CRC16("foo{}{bar}")%SlotNum))
+	require.Equal(t, Slot("bar"), Slot("foo{bar}{zap}"))
+}
+
+func TestGetKeys(t *testing.T) {
+	args := func(s ...string) []interface{} {
+		ret := make([]interface{}, 0, len(s))
+		for _, v := range s {
+			ret = append(ret, v)
+		}
+		return ret
+	}
+	require.Equal(t, []string{"a"}, GetKeys("get", args("get", "a")))
+	require.Equal(t, []string{"a", "c"}, GetKeys("mset", args("mset", "a", "b", "c", "d")))
+	require.Equal(t, []string{"a", "b"}, GetKeys("blpop", args("blpop", "a", "b", "0")))
+	require.Equal(t, []string{"k1", "k2"}, GetKeys("eval", args("eval", "return 1", "2", "k1", "k2", "v")))
+	require.Equal(t, []string{"d", "a", "b"}, GetKeys("zunionstore", args("zunionstore", "d", "2", "a", "b", "weights", "1", "2")))
+	require.Equal(t, []string{"s1", "s2"}, GetKeys("xread", args("xread", "count", "1", "streams", "s1", "s2", "0", "0")))
+	require.Equal(t, []string{"a"}, GetKeys("object", args("object", "encoding", "a")))
+	require.Len(t, GetKeys("ping", args("ping")), 0)
+	require.Len(t, GetKeys("eval", args("eval", "return 1", "-1")), 0)
+	require.Equal(t, []string{"k1"}, GetKeys("eval", args("eval", "return 1", "9223372036854775807", "k1")))
+	require.Equal(t, []string{"d", "a"}, GetKeys("zunionstore", args("zunionstore", "d", "1000000000000", "a")))
+	require.True(t, IsWrite("set"))
+	require.False(t, IsWrite("lrange"))
+}
@@ -0,0 +1,103 @@
+package common
+
+import (
+	"container/heap"
+	"sort"
+)
+
+type TopKItem struct {
+	Key   string
+	Count int64 // estimated count, never below the real one
+	Error int64 // overestimation bound, the real count is at least Count-Error
+	index int
+}
+
+type topKHeap []*TopKItem
+
+func (h topKHeap) Len() int           { return len(h) }
+func (h topKHeap) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h topKHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+func (h *topKHeap) Push(x interface{}) {
+	item := x.(*TopKItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+func (h *topKHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// TopK finds the most frequent keys of a stream with the Space-Saving algorithm. It keeps
+// at most capacity counters whatever the number of distinct keys, when it is full the
+// least frequent counter is taken over by the new key and its count becomes the error.
+type TopK struct {
+	capacity int
+	items    map[string]*TopKItem
+	heap     topKHeap
+	total    int64
+}
+
+func NewTopK(capacity int) *TopK {
+	return &TopK{capacity: capacity, items: make(map[string]*TopKItem, capacity)}
+}
+
+func (t *TopK) Add(key string, n int64) {
+	t.total += n
+	if item, ok := t.items[key]; ok {
+		item.Count += n
+		heap.Fix(&t.heap, item.index)
+		return
+	}
+	// keys may point into decoder buffers, keep a copy
+	key = CloneString(key)
+	if len(t.heap) < t.capacity {
+		item := &TopKItem{Key: key, Count: n}
+		t.items[key] = item
+		heap.Push(&t.heap, item)
+		return
+	}
+	min := t.heap[0]
+	delete(t.items, min.Key)
+	min.Key = key
+	min.Error = min.Count
+	min.Count += n
+	t.items[key] = min
+	heap.Fix(&t.heap, 0)
+}
+
+// Top returns the k most frequent keys, the most frequent first.
+func (t *TopK) Top(k int) []TopKItem {
+	ret := make([]TopKItem, 0, len(t.heap))
+	for _, item := range t.heap {
+		ret = append(ret, *item)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if ret[i].Count != ret[j].Count {
+			return ret[i].Count > ret[j].Count
+		}
+		return ret[i].Key < ret[j].Key
+	})
+	if len(ret) > k {
+		ret = ret[:k]
+	}
+	return ret
+}
+
+// Total is the number of keys added, counting repetitions.
+func (t *TopK) Total() int64 {
+	return t.total
+}
+
+// MaxError bounds the overestimation of any count: total/capacity.
+func (t *TopK) MaxError() int64 {
+	if len(t.heap) < t.capacity {
+		return 0
+	}
+	return t.total / int64(t.capacity)
+}
@@ -0,0 +1,30 @@
+package common
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestTopK(t *testing.T) {
+	topK := NewTopK(10)
+	for i := 0; i < 1000; i++ {
+		topK.Add("hot1", 1)
+		if i%2 == 0 {
+			topK.Add("hot2", 1)
+		}
+		topK.Add(fmt.Sprintf("cold%d", i), 1)
+	}
+	require.Equal(t, int64(2500), topK.Total())
+	require.Len(t, topK.items, 10)
+
+	top := topK.Top(2)
+	require.Len(t, top, 2)
+	require.Equal(t, "hot1", top[0].Key)
+	require.Equal(t, "hot2", top[1].Key)
+	for _, item := range top {
+		require.LessOrEqual(t, item.Error, topK.MaxError())
+	}
+	require.GreaterOrEqual(t, top[0].Count, int64(1000))
+	require.LessOrEqual(t, top[0].Count-top[0].Error, int64(1000))
+}
@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"github.com/google/gopacket/layers"
 	"net"
-	"reflect"
 	"strconv"
 	"unsafe"
 )
@@ -14,105 +13,24 @@ func RemoteKey(srcHost net.IP, srcPort layers.TCPPort) string {
 }
 
 func StringsToBytes(s string) []byte {
-	sh := (*reflect.StringHeader)(unsafe.Pointer(&s))
-	bh := reflect.SliceHeader{
-		Data: sh.Data,
-		Len:  sh.Len,
-		Cap:  sh.Len,
-	}
-	return *(*[]byte)(unsafe.Pointer(&bh)) //nolint: govet
+	return *(*[]byte)(unsafe.Pointer(&struct {
+		string
+		Cap int
+	}{s, len(s)}))
 }
 
 func BytesToString(b []byte) string {
 	return *(*string)(unsafe.Pointer(&b))
 }
 
+// CloneString copies s, for keeping a string that is a view into a decoder buffer.
+func CloneString(s string) string {
+	return string(append([]byte(nil), s...))
+}
+
 func Btoi(b []byte) (int, error) {
 	if len(b) == 1 {
 		return int(b[0] - '0'), nil
 	}
 	return strconv.Atoi(BytesToString(b))
 }
-
-var isWrite = map[string]struct{}{
-	//Kv
-	"set":         {},
-	"del":         {},
-	"incr":        {},
-	"incrby":      {},
-	"incrbyfloat": {},
-	"decr":        {},
-	"decrby":      {},
-	"getset":      {},
-	"append":      {},
-	"setnx":       {},
-	"setex":       {},
-	"psetex":      {},
-	"mset":        {},
-	"msetnx":      {},
-	"setrange":    {},
-	"expire":      {},
-	"pexpire":     {},
-	"expireat":    {},
-	"pexpireat":   {},
-	"persist":     {},
-
-	//Hash
-	"hdel":         {},
-	"hset":         {},
-	"hincrby":      {},
-	"hincrbyfloat": {},
-	"hmset":        {},
-	"hsetnx":       {},
-
-	//List
-	"linsert":   {},
-	"lpop":      {},
-	"lpush":     {},
-	"lpushx":    {},
-	"lrange":    {},
-	"lrem":      {},
-	"lset":      {},
-	"ltrim":     {},
-	"rpop":      {},
-	"rpoplpush": {},
-	"rpush":     {},
-	"rpushx":    {},
-
-	//BitMap
-	"setbit": {},
-	"bitop":  {},
-
-	//Zset
-	"zadd":             {},
-	"zincrby":          {},
-	"zrem":             {},
-	"zunionstore":      {},
-	"zinterstore":      {},
-	"zremrangebyrank":  {},
-	"zremrangebylex":   {},
-	"zremrangebyscore": {},
-	"zpopmax":          {},
-	"zpopmin":          {},
-
-	//Set
-	"sadd":        {},
-	"spop":        {},
-	"srem":        {},
-	"sunionstore": {},
-	"sinterstore": {},
-	"sdiffstore":  {},
-	"smove":       {},
-}
-
-func IsWrite(cmd string) bool {
-	_, ok := isWrite[cmd]
-	return ok
-}
-
-func GetFirstKey(cmd string, args []interface{}) string {
-	if len(args) >= 2 {
-		return args[1].(string)
-	}
-	return ""
-}
@@ -9,3 +9,9 @@ type Writer interface {
 	FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error
 	FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error
 }
+
+// CloseWriter is implemented by writers which keep state per client connection,
+// FlowClose is called once the client connection is closed.
+type CloseWriter interface {
+	FlowClose(host net.IP, port layers.TCPPort)
+}
@@ -0,0 +1,105 @@
+package reader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const aofClient = "aof"
+
+// AOFReader reads an append only file, as written by redis-server or the aof output. The db
+// follows SELECT, and the time follows the #TS: annotations when the file has them.
+type AOFReader struct {
+	r    *bufio.Reader
+	db   int
+	time time.Time
+}
+
+func NewAOFReader(r io.Reader) *AOFReader {
+	return &AOFReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+func (r *AOFReader) line() (string, error) {
+	line, err := r.r.ReadString('\n')
+	if err != nil {
+		if err == io.EOF && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return strings.TrimSuffix(line[:len(line)-1], "\r"), nil
+}
+
+func (r *AOFReader) Next() (*Command, error) {
+	for {
+		line, err := r.line()
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(line, "#TS:") {
+			ts, err := strconv.ParseInt(line[4:], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid annotation: %q", line)
+			}
+			r.time = time.Unix(ts, 0)
+			continue
+		}
+		if len(line) == 0 || line[0] == '#' {
+			// other annotations
+			continue
+		}
+		if line[0] != '*' {
+			return nil, fmt.Errorf("expect an array: %q", line)
+		}
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid array length: %q", line)
+		}
+
+		cmd := &Command{Time: r.time, DB: r.db, Client: aofClient, Args: make([]string, n)}
+		for i := range cmd.Args {
+			if cmd.Args[i], err = r.bulk(); err != nil {
+				return nil, err
+			}
+		}
+		if cmd.Name() == "select" && n == 2 {
+			if db, err := strconv.Atoi(cmd.Args[1]); err == nil {
+				r.db = db
+			}
+		}
+		return cmd, nil
+	}
+}
+
+func (r *AOFReader) bulk() (string, error) {
+	line, err := r.line()
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(line) == 0 || line[0] != '$' {
+		return "", fmt.Errorf("expect a bulk string: %q", line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 {
+		return "", fmt.Errorf("invalid bulk length: %q", line)
+	}
+	buf := make([]byte, n+2)
+	if _, err = io.ReadFull(r.r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return "", errors.New("bulk string not terminated by CRLF")
+	}
+	return string(buf[:n]), nil
+}
@@ -0,0 +1,88 @@
+package reader
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"time"
+)
+
+// jsonCommand is the part of the lines of the json output needed to replay them.
+type jsonCommand struct {
+	Time   float64           `json:"ts"`
+	Client string            `json:"client"`
+	Name   string            `json:"name"`
+	Server string            `json:"server"`
+	DB     int               `json:"db"`
+	Args   []json.RawMessage `json:"args"`
+}
+
+// JSONReader reads the JSON Lines output, arguments may be strings or {"base64":"..."}.
+type JSONReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func NewJSONReader(r io.Reader) *JSONReader {
+	return &JSONReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+func (r *JSONReader) Next() (*Command, error) {
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		r.line++
+		cmd, err := parseJSON(line)
+		if err != nil {
+			return nil, &SyntaxError{Line: r.line, Err: err}
+		}
+		if cmd != nil {
+			return cmd, nil
+		}
+	}
+}
+
+func parseJSON(line []byte) (*Command, error) {
+	var c jsonCommand
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal(line, &c); err != nil {
+		return nil, err
+	}
+	if len(c.Args) == 0 {
+		return nil, fmt.Errorf("empty command")
+	}
+	micros := int64(math.Round(c.Time * 1e6))
+	cmd := &Command{
+		Time:       time.Unix(micros/1e6, micros%1e6*1e3),
+		DB:         c.DB,
+		Client:     c.Client,
+		ClientName: c.Name,
+		Server:     c.Server,
+		Args:       make([]string, len(c.Args)),
+	}
+	for i, raw := range c.Args {
+		if err := json.Unmarshal(raw, &cmd.Args[i]); err == nil {
+			continue
+		}
+		var arg struct {
+			Base64 string `json:"base64"`
+		}
+		if err := json.Unmarshal(raw, &arg); err != nil {
+			return nil, fmt.Errorf("invalid argument %d: %s", i, raw)
+		}
+		b, err := base64.StdEncoding.DecodeString(arg.Base64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid argument %d: %w", i, err)
+		}
+		cmd.Args[i] = string(b)
+	}
+	return cmd, nil
+}
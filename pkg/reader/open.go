@@ -0,0 +1,70 @@
+package reader
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	FormatText = "text"
+	FormatAOF  = "aof"
+	FormatJSON = "json"
+	FormatPcap = "pcap"
+)
+
+// Format guesses the format of a capture from the extension of its name.
+func Format(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".aof":
+		return FormatAOF
+	case ".json", ".jsonl":
+		return FormatJSON
+	case ".pcap", ".pcapng", ".cap":
+		return FormatPcap
+	}
+	return FormatText
+}
+
+// File is a capture opened for reading.
+type File struct {
+	Reader
+	f *os.File
+}
+
+// Open opens a capture, the format is guessed from the name when empty. The requests of
+// a pcap are those sent to host (any when nil) and port.
+func Open(name, format string, host net.IP, port layers.TCPPort) (*File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = Format(name)
+	}
+	file := &File{f: f}
+	switch format {
+	case FormatText:
+		file.Reader = NewTextReader(f)
+	case FormatAOF:
+		file.Reader = NewAOFReader(f)
+	case FormatJSON:
+		file.Reader = NewJSONReader(f)
+	case FormatPcap:
+		file.Reader, err = NewPcapReader(f, host, port)
+	default:
+		err = fmt.Errorf("unknown format: %s", format)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (f *File) Close() error {
+	return f.f.Close()
+}
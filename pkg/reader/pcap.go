@@ -0,0 +1,233 @@
+package reader
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"github.com/morningli/packet_monitor/pkg/redis"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sort"
+)
+
+var pcapngMagic = []byte{0x0a, 0x0d, 0x0d, 0x0a}
+
+// maxOutOfOrder is how many segments are kept waiting for a missing one before it is
+// considered lost, like the reorder package does for live traffic.
+const maxOutOfOrder = 200
+
+type packetSource interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// PcapReader decodes the requests sent to a redis server from a pcap or pcapng file. Commands
+// get the time of the packet which completes them, transactions are read at EXEC. The end
+// of a client connection is read as a Closed command. Segments captured out of order are
+// put back in order.
+type PcapReader struct {
+	source   packetSource
+	host     net.IP // any host when nil
+	port     layers.TCPPort
+	server   string
+	sessions *redis.SessionMgr
+	streams  map[string]*stream
+	pending  []*Command
+}
+
+// stream is the client side of a connection.
+type stream struct {
+	next     uint32            // sequence number of the next byte expected
+	segments map[uint32][]byte // segments after a missing one, by sequence number
+	last     gopacket.CaptureInfo
+}
+
+func NewPcapReader(r io.Reader, host net.IP, port layers.TCPPort) (*PcapReader, error) {
+	br := bufio.NewReader(r)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	var source packetSource
+	if bytes.Equal(magic, pcapngMagic) {
+		source, err = pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+	} else {
+		source, err = pcapgo.NewReader(br)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p := &PcapReader{source: source, host: host, port: port, sessions: redis.NewSessionMgr(false), streams: map[string]*stream{}}
+	if host != nil {
+		p.server = common.RemoteKey(host, port)
+	}
+	return p, nil
+}
+
+func (r *PcapReader) Next() (*Command, error) {
+	for len(r.pending) == 0 {
+		data, ci, err := r.source.ReadPacketData()
+		if err == io.EOF && r.flushAll() {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		r.feed(gopacket.NewPacket(data, r.source.LinkType(), gopacket.NoCopy), ci)
+	}
+	cmd := r.pending[0]
+	r.pending[0] = nil
+	r.pending = r.pending[1:]
+	return cmd, nil
+}
+
+func (r *PcapReader) feed(packet gopacket.Packet, ci gopacket.CaptureInfo) {
+	var src, dst net.IP
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		src, dst = ip.SrcIP, ip.DstIP
+	case *layers.IPv6:
+		src, dst = ip.SrcIP, ip.DstIP
+	default:
+		return
+	}
+	tcp, ok := packet.TransportLayer().(*layers.TCP)
+	if !ok || tcp.DstPort != r.port || (r.host != nil && !dst.Equal(r.host)) {
+		return
+	}
+
+	address := common.RemoteKey(src, tcp.SrcPort)
+	if tcp.SYN {
+		r.streams[address] = &stream{next: tcp.Seq + 1, segments: map[uint32][]byte{}, last: ci}
+		r.sessions.Close(address)
+		return
+	}
+	s, ok := r.streams[address]
+	if len(tcp.Payload) > 0 {
+		if !ok {
+			// the capture started after the connection
+			s = &stream{next: tcp.Seq, segments: map[uint32][]byte{}}
+			r.streams[address] = s
+		}
+		s.last = ci
+		r.segment(address, s, tcp.Seq, tcp.Payload)
+	}
+	if (tcp.FIN || tcp.RST) && ok {
+		r.flush(address, s)
+		r.pending = append(r.pending, &Command{Time: ci.Timestamp, Client: address, Server: r.server, Closed: true})
+		delete(r.streams, address)
+		r.sessions.Close(address)
+	}
+}
+
+// segment decodes the payload at seq, or keeps it until the missing bytes before it arrive.
+func (r *PcapReader) segment(address string, s *stream, seq uint32, payload []byte) {
+	if int32(seq-s.next) > 0 {
+		if old, ok := s.segments[seq]; !ok || len(old) < len(payload) {
+			s.segments[seq] = append([]byte(nil), payload...)
+		}
+		if len(s.segments) > maxOutOfOrder {
+			r.skip(address, s)
+		}
+		return
+	}
+	r.decode(address, s, seq, payload)
+	r.drain(address, s)
+}
+
+// decode decodes the bytes of the payload at seq not seen yet.
+func (r *PcapReader) decode(address string, s *stream, seq uint32, payload []byte) {
+	// retransmission, keep what was not seen yet
+	offset := s.next - seq
+	if int(offset) >= len(payload) {
+		return
+	}
+	payload = payload[offset:]
+	s.next += uint32(len(payload))
+
+	for _, c := range r.sessions.FetchRequests(address, payload) {
+		if c.Tx != nil {
+			r.add(c.Tx.Multi, s.last)
+			for _, q := range c.Tx.Commands {
+				r.add(q, s.last)
+			}
+		}
+		r.add(c, s.last)
+	}
+}
+
+// drain decodes the segments kept which are no longer after a missing one.
+func (r *PcapReader) drain(address string, s *stream) {
+	for found := true; found; {
+		found = false
+		for seq, payload := range s.segments {
+			if int32(seq-s.next) <= 0 {
+				delete(s.segments, seq)
+				r.decode(address, s, seq, payload)
+				found = true
+			}
+		}
+	}
+}
+
+// skip gives up on the missing bytes before the first segment kept.
+func (r *PcapReader) skip(address string, s *stream) {
+	first := true
+	var next uint32
+	for seq := range s.segments {
+		if first || int32(seq-next) < 0 {
+			next, first = seq, false
+		}
+	}
+	if first {
+		return
+	}
+	// lost packets, the decoder resyncs on the next command
+	log.Warnf("[%s]missing %d bytes", address, next-s.next)
+	r.sessions.Close(address)
+	s.next = next
+	r.drain(address, s)
+}
+
+// flush decodes all the segments kept, the missing bytes will not come anymore.
+func (r *PcapReader) flush(address string, s *stream) {
+	for len(s.segments) > 0 {
+		r.skip(address, s)
+	}
+}
+
+// flushAll flushes every connection at the end of the capture, and reports whether
+// commands were read.
+func (r *PcapReader) flushAll() bool {
+	addresses := make([]string, 0, len(r.streams))
+	for address, s := range r.streams {
+		if len(s.segments) > 0 {
+			addresses = append(addresses, address)
+		}
+	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		r.flush(address, r.streams[address])
+	}
+	return len(r.pending) > 0
+}
+
+func (r *PcapReader) add(c *redis.Command, ci gopacket.CaptureInfo) {
+	cmd := &Command{
+		Time:       ci.Timestamp,
+		DB:         c.DB,
+		Client:     c.Client.Addr,
+		ClientName: c.Client.Name,
+		Server:     r.server,
+		Args:       make([]string, len(c.Args)),
+	}
+	// the arguments point into the decoder buffer
+	for i, v := range c.Args {
+		cmd.Args[i] = common.CloneString(v.(string))
+	}
+	r.pending = append(r.pending, cmd)
+}
@@ -0,0 +1,153 @@
+package reader
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Command is a request read back from a capture.
+type Command struct {
+	Time       time.Time // zero when the capture does not record it
+	DB         int
+	Client     string // the client address, or how the capture labels clients
+	ClientName string // when the capture records it
+	Server     string // empty when the capture does not record it
+	Args       []string
+	Closed     bool // the client closed its connection, there are no arguments
+}
+
+// Reader reads the commands of a capture in order, Next returns io.EOF at the end.
+type Reader interface {
+	Next() (*Command, error)
+}
+
+// SyntaxError is a line which could not be parsed, the reader can go on with the next one.
+type SyntaxError struct {
+	Line int
+	Err  error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Err)
+}
+
+func (e *SyntaxError) Unwrap() error {
+	return e.Err
+}
+
+// Name returns the lower case command name.
+func (c *Command) Name() string {
+	if len(c.Args) == 0 {
+		return ""
+	}
+	return strings.ToLower(c.Args[0])
+}
+
+// TextReader reads the output of FileWriter, or of redis MONITOR:
+//
+//	1339518083.107412 [0 127.0.0.1:60866] "set" "k\"1" "\xff"
+//	1339518083.107412 [0 127.0.0.1:60866 10.0.0.1:6379] "get" "k"
+type TextReader struct {
+	r    *bufio.Reader
+	line int
+}
+
+func NewTextReader(r io.Reader) *TextReader {
+	return &TextReader{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Next returns the next command, or io.EOF at the end of the input.
+func (r *TextReader) Next() (*Command, error) {
+	for {
+		line, err := r.r.ReadString('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return nil, err
+		}
+		r.line++
+		line = strings.TrimRight(line, "\r\n")
+		// redis-cli prints OK before the commands
+		if len(line) == 0 || line == "OK" {
+			continue
+		}
+		cmd, err := ParseLine(line)
+		if err != nil {
+			return nil, &SyntaxError{Line: r.line, Err: err}
+		}
+		return cmd, nil
+	}
+}
+
+// ParseLine parses one line of MONITOR output.
+func ParseLine(line string) (*Command, error) {
+	// the output of MONITOR read with a raw client starts with +
+	line = strings.TrimPrefix(line, "+")
+
+	pos := strings.Index(line, " [")
+	end := -1
+	if pos != -1 {
+		end = strings.IndexByte(line[pos:], ']')
+	}
+	if end == -1 {
+		return nil, errors.New("missing [db client]")
+	}
+	end += pos
+
+	t, err := parseTime(line[:pos])
+	if err != nil {
+		return nil, err
+	}
+	cmd := &Command{Time: t}
+
+	fields := strings.Fields(line[pos+2 : end])
+	// [db client server name=client-name], the server and the name are optional
+	if n := len(fields); n > 2 && strings.HasPrefix(fields[n-1], "name=") {
+		cmd.ClientName = fields[n-1][len("name="):]
+		fields = fields[:n-1]
+	}
+	if len(fields) < 2 || len(fields) > 3 {
+		return nil, fmt.Errorf("invalid [db client]: %q", line[pos+1:end+1])
+	}
+	cmd.DB, err = strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid db: %q", fields[0])
+	}
+	cmd.Client = fields[1]
+	if len(fields) == 3 {
+		cmd.Server = fields[2]
+	}
+
+	cmd.Args, err = common.SplitArgs(line[end+1:])
+	if err != nil {
+		return nil, err
+	}
+	if len(cmd.Args) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return cmd, nil
+}
+
+// parseTime parses seconds.microseconds without the rounding of a float.
+func parseTime(s string) (time.Time, error) {
+	sec, frac := s, ""
+	if pos := strings.IndexByte(s, '.'); pos != -1 {
+		sec, frac = s[:pos], s[pos+1:]
+	}
+	seconds, err := strconv.ParseInt(sec, 10, 64)
+	if err != nil || len(frac) > 9 {
+		return time.Time{}, fmt.Errorf("invalid time: %q", s)
+	}
+	var nanos int64
+	if len(frac) > 0 {
+		nanos, err = strconv.ParseInt(frac+strings.Repeat("0", 9-len(frac)), 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid time: %q", s)
+		}
+	}
+	return time.Unix(seconds, nanos), nil
+}
@@ -0,0 +1,204 @@
+package reader
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLine(t *testing.T) {
+	cmd, err := ParseLine(`1339518083.107412 [3 127.0.0.1:60866] "set" "k\"1" "a\\b\r\n\t\xff\x00"`)
+	require.Nil(t, err)
+	require.Equal(t, time.Unix(1339518083, 107412000), cmd.Time)
+	require.Equal(t, 3, cmd.DB)
+	require.Equal(t, "127.0.0.1:60866", cmd.Client)
+	require.Equal(t, "", cmd.Server)
+	require.Equal(t, []string{"set", "k\"1", "a\\b\r\n\t\xff\x00"}, cmd.Args)
+
+	cmd, err = ParseLine(`+1339518083.107412 [0 lua 10.0.0.1:6379] "GET" "k"`)
+	require.Nil(t, err)
+	require.Equal(t, "lua", cmd.Client)
+	require.Equal(t, "10.0.0.1:6379", cmd.Server)
+	require.Equal(t, "get", cmd.Name())
+
+	cmd, err = ParseLine(`1339518083.107412 [0 127.0.0.1:60866 name=app] "GET" "k"`)
+	require.Nil(t, err)
+	require.Equal(t, "127.0.0.1:60866", cmd.Client)
+	require.Equal(t, "", cmd.Server)
+	require.Equal(t, "app", cmd.ClientName)
+
+	for _, line := range []string{
+		`1339518083.107412 "get" "k"`,
+		`1339518083.107412 [x 127.0.0.1:1] "get" "k"`,
+		`now [0 127.0.0.1:1] "get" "k"`,
+		`1339518083.107412 [0 127.0.0.1:1] "get" "k`,
+		`1339518083.107412 [0 127.0.0.1:1] "get""k"`,
+		`1339518083.107412 [0 127.0.0.1:1]`,
+	} {
+		_, err = ParseLine(line)
+		require.NotNil(t, err, line)
+	}
+}
+
+func TestRepr(t *testing.T) {
+	var all []byte
+	for i := 0; i < 256; i++ {
+		all = append(all, byte(i))
+	}
+	args := []string{"", "a b", `"quoted"`, string(all)}
+	var line []byte
+	for _, arg := range args {
+		line = append(append(line, ' '), common.AppendRepr(nil, arg)...)
+	}
+	require.NotContains(t, string(line), "\n")
+
+	got, err := common.SplitArgs(string(line))
+	require.Nil(t, err)
+	require.Equal(t, args, got)
+}
+
+func TestTextReader(t *testing.T) {
+	r := NewTextReader(strings.NewReader("OK\n" +
+		"1339518083.107412 [0 127.0.0.1:60866] \"multi\"\r\n" +
+		"\n" +
+		"1339518083.107413 [0 127.0.0.1:60866] \"exec\"\n" +
+		"bad line\n" +
+		"1339518083.2 [1 127.0.0.1:60866] \"ping\""))
+
+	cmd, err := r.Next()
+	require.Nil(t, err)
+	require.Equal(t, "multi", cmd.Name())
+	cmd, err = r.Next()
+	require.Nil(t, err)
+	require.Equal(t, "exec", cmd.Name())
+	_, err = r.Next()
+	require.EqualError(t, err, "line 5: missing [db client]")
+	cmd, err = r.Next()
+	require.Nil(t, err)
+	require.Equal(t, time.Unix(1339518083, 200000000), cmd.Time)
+	require.Equal(t, 1, cmd.DB)
+	_, err = r.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestAOFReader(t *testing.T) {
+	r := NewAOFReader(strings.NewReader("#TS:1339518083\r\n*2\r\n$6\r\nSELECT\r\n$1\r\n2\r\n" +
+		"*3\r\n$3\r\nset\r\n$1\r\na\r\n$4\r\n\r\n\x00\xff\r\n*2\r\n$3\r\ndel\r\n$1"))
+
+	cmd, err := r.Next()
+	require.Nil(t, err)
+	require.Equal(t, []string{"SELECT", "2"}, cmd.Args)
+	require.Equal(t, 0, cmd.DB)
+	cmd, err = r.Next()
+	require.Nil(t, err)
+	require.Equal(t, []string{"set", "a", "\r\n\x00\xff"}, cmd.Args)
+	require.Equal(t, 2, cmd.DB)
+	require.Equal(t, time.Unix(1339518083, 0), cmd.Time)
+	_, err = r.Next()
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestJSONReader(t *testing.T) {
+	r := NewJSONReader(strings.NewReader(`{"ts":1339518083.107412,"client":"127.0.0.1:1000","name":"app","server":"10.0.0.1:6379",` +
+		`"db":2,"cmd":"set","args":["set","a",{"base64":"/wA="}]}` + "\n\n{\n"))
+
+	cmd, err := r.Next()
+	require.Nil(t, err)
+	require.Equal(t, time.Unix(1339518083, 107412000), cmd.Time)
+	require.Equal(t, "127.0.0.1:1000", cmd.Client)
+	require.Equal(t, "app", cmd.ClientName)
+	require.Equal(t, 2, cmd.DB)
+	require.Equal(t, []string{"set", "a", "\xff\x00"}, cmd.Args)
+	_, err = r.Next()
+	var syntaxErr *SyntaxError
+	require.ErrorAs(t, err, &syntaxErr)
+	require.Equal(t, 3, syntaxErr.Line)
+	_, err = r.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+type pcapFile struct {
+	t   *testing.T
+	out *bytes.Buffer
+	w   *pcapgo.Writer
+}
+
+func newPcapFile(t *testing.T) *pcapFile {
+	out := &bytes.Buffer{}
+	w := pcapgo.NewWriter(out)
+	require.Nil(t, w.WriteFileHeader(65536, layers.LinkTypeEthernet))
+	return &pcapFile{t: t, out: out, w: w}
+}
+
+var pcapStart = time.Unix(1339518083, 0)
+
+// write adds a packet from 127.0.0.1:1000 to 10.0.0.1:6379 captured at pcapStart+i seconds.
+func (f *pcapFile) write(i int, seq uint32, payload string, fin bool) {
+	eth := &layers.Ethernet{SrcMAC: net.HardwareAddr{0, 0, 0, 0, 0, 1}, DstMAC: net.HardwareAddr{0, 0, 0, 0, 0, 2}, EthernetType: layers.EthernetTypeIPv4}
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: net.IPv4(127, 0, 0, 1).To4(), DstIP: net.IPv4(10, 0, 0, 1).To4()}
+	tcp := &layers.TCP{SrcPort: 1000, DstPort: 6379, Seq: seq, ACK: true, FIN: fin}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	require.Nil(f.t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		eth, ip, tcp, gopacket.Payload(payload)))
+	data := buf.Bytes()
+	require.Nil(f.t, f.w.WritePacket(gopacket.CaptureInfo{Timestamp: pcapStart.Add(time.Duration(i) * time.Second),
+		CaptureLength: len(data), Length: len(data)}, data))
+}
+
+// read returns the commands of the file as "args db seconds".
+func (f *pcapFile) read() []string {
+	r, err := NewPcapReader(f.out, net.IPv4(10, 0, 0, 1), 6379)
+	require.Nil(f.t, err)
+	var names []string
+	for {
+		cmd, err := r.Next()
+		if err == io.EOF {
+			return names
+		}
+		require.Nil(f.t, err)
+		require.Equal(f.t, "127.0.0.1:1000", cmd.Client)
+		require.Equal(f.t, "10.0.0.1:6379", cmd.Server)
+		if cmd.Closed {
+			names = append(names, "closed")
+			continue
+		}
+		names = append(names, fmt.Sprintf("%s %d %d", strings.Join(cmd.Args, " "), cmd.DB, cmd.Time.Unix()-pcapStart.Unix()))
+	}
+}
+
+func TestPcapReader(t *testing.T) {
+	f := newPcapFile(t)
+	f.write(0, 100, "*2\r\n$6\r\nselect\r\n$1\r\n1\r\n*2\r\n$3\r\nget", false)
+	f.write(1, 100, "*2\r\n$6\r\nselect\r\n$1\r\n1\r\n*2\r\n$3\r\nget", false) // retransmission
+	f.write(2, 134, "\r\n$1\r\na\r\n*1\r\n$5\r\nmulti\r\n*2\r\n$4\r\nincr\r\n$1\r\nb\r\n", false)
+	f.write(3, 179, "*1\r\n$4\r\nexec\r\n", true)
+	require.Equal(t, []string{"select 1 0 0", "get a 1 2", "multi 1 3", "incr b 1 3", "exec 1 3", "closed"}, f.read())
+
+	t.Run("reordered", func(t *testing.T) {
+		f := newPcapFile(t)
+		f.write(0, 100, "*2\r\n$6\r\nselect\r\n$1\r\n1\r\n", false)
+		f.write(1, 143, "*2\r\n$3\r\nget\r\n$1\r\nb\r\n", false)
+		f.write(2, 123, "*2\r\n$3\r\nget\r\n$1\r\na\r\n", false)
+		f.write(3, 163, "", true)
+		require.Equal(t, []string{"select 1 0 0", "get a 1 2", "get b 1 2", "closed"}, f.read())
+	})
+
+	t.Run("lost", func(t *testing.T) {
+		f := newPcapFile(t)
+		f.write(0, 100, "*2\r\n$6\r\nselect\r\n$1\r\n1\r\n", false)
+		f.write(1, 143, "*2\r\n$3\r\nget\r\n$1\r\nb\r\n", false)
+		f.write(2, 163, "", true)
+		// the session is closed at the gap, the db of the connection is no longer known
+		require.Equal(t, []string{"select 1 0 0", "get b 0 1", "closed"}, f.read())
+	})
+}
@@ -0,0 +1,243 @@
+package redis
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// AOFWriter writes the write commands of the command table, scripts and functions in the RESP
+// format of an append only file, which redis-server can load and redis-check-aof can check.
+// Commands are written once their reply is captured: errors, aborted and discarded
+// transactions are left out, and the commands of other transactions are kept between MULTI
+// and EXEC. Like redis propagates them, relative expirations are rewritten to absolute ones
+// from the time of the request, and EVALSHA to EVAL when the script was seen.
+type AOFWriter struct {
+	f          io.Writer
+	timestamps bool
+	sessions   *SessionMgr
+	mux        sync.Mutex
+	db         int
+	ts         int64
+	scripts    map[string]string // sha1 -> source
+}
+
+// NewAOFWriter creates an AOF writer, timestamps adds a #TS:<unix time> annotation
+// every time the second of the commands changes, like aof-timestamp-enabled.
+func NewAOFWriter(f io.Writer, timestamps bool) *AOFWriter {
+	return &AOFWriter{f: f, timestamps: timestamps, sessions: NewSessionMgr(true), db: -1,
+		scripts: map[string]string{}}
+}
+
+func (w *AOFWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	_ = w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
+	return nil
+}
+
+func (w *AOFWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	replies, _ := w.sessions.FetchReplies(common.RemoteKey(dstHost, dstPort), data)
+	if len(replies) == 0 {
+		return nil
+	}
+
+	// the db and the last timestamp are shared by all the connections
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	var buff []byte
+	for _, r := range replies {
+		if r.Tx == nil {
+			if applied(r) {
+				buff = w.append(buff, r)
+			}
+			continue
+		}
+		if r.Tx.Aborted() || r.Tx.Discarded() || !r.Replied() {
+			continue
+		}
+		var writes []*Command
+		for _, c := range r.Tx.Commands {
+			if applied(c) {
+				writes = append(writes, c)
+			}
+		}
+		if len(writes) == 0 {
+			continue
+		}
+		// the db of the first command is selected before MULTI, later ones were queued in the transaction
+		buff = w.annotate(buff, r.Tx.Multi)
+		buff = w.selectDB(buff, writes[0])
+		buff = AppendRequest(buff, r.Tx.Multi.Args)
+		for _, c := range writes {
+			buff = w.selectDB(buff, c)
+			buff = AppendRequest(buff, w.rewrite(c))
+		}
+		buff = AppendRequest(buff, r.Args)
+	}
+	if len(buff) == 0 {
+		return nil
+	}
+	_, err := w.f.Write(buff)
+	return err
+}
+
+// FlowClose drops the state of the connection, a new connection on its address starts afresh.
+func (w *AOFWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+// applied reports whether a command changed the dataset, or the scripts and functions.
+func applied(c *Command) bool {
+	if !c.Replied() || c.Reply.IsError() {
+		return false
+	}
+	switch c.Name() {
+	case "eval", "evalsha", "fcall":
+		return true
+	case "script":
+		return len(c.Args) > 1 && strings.EqualFold(c.Args[1].(string), "load")
+	case "function":
+		if len(c.Args) < 2 {
+			return false
+		}
+		switch strings.ToLower(c.Args[1].(string)) {
+		case "load", "delete", "flush", "restore":
+			return true
+		}
+		return false
+	case "getex":
+		// GETEX without option only reads
+		return len(c.Args) > 2
+	}
+	return common.IsWrite(c.Name())
+}
+
+// rewrite returns the arguments written for a command.
+func (w *AOFWriter) rewrite(c *Command) []interface{} {
+	args := c.Args
+	arg := func(i int) string {
+		return strings.ToLower(args[i].(string))
+	}
+	// ms returns the unix time in milliseconds of an expiration in unit from base
+	ms := func(v interface{}, base int64, unit int64) string {
+		n, err := strconv.ParseInt(v.(string), 10, 64)
+		if err != nil {
+			return v.(string)
+		}
+		return strconv.FormatInt(base+n*unit, 10)
+	}
+	at := func(v interface{}, unit int64) string {
+		return ms(v, c.Time.UnixMilli(), unit)
+	}
+	switch c.Name() {
+	case "eval":
+		if len(args) > 1 {
+			w.scripts[scriptSHA(args[1].(string))] = args[1].(string)
+		}
+	case "script":
+		if len(args) > 2 {
+			w.scripts[scriptSHA(args[2].(string))] = args[2].(string)
+		}
+	case "evalsha":
+		if len(args) > 1 {
+			if source, ok := w.scripts[strings.ToLower(args[1].(string))]; ok {
+				return append([]interface{}{"EVAL", source}, args[2:]...)
+			}
+		}
+	case "expire", "pexpire":
+		if len(args) > 2 {
+			unit := int64(1000)
+			if c.Name() == "pexpire" {
+				unit = 1
+			}
+			return append([]interface{}{"PEXPIREAT", args[1], at(args[2], unit)}, args[3:]...)
+		}
+	case "setex", "psetex":
+		if len(args) == 4 {
+			unit := int64(1000)
+			if c.Name() == "psetex" {
+				unit = 1
+			}
+			return []interface{}{"SET", args[1], args[3], "PXAT", at(args[2], unit)}
+		}
+	case "set":
+		for i := 3; i+1 < len(args); i++ {
+			if option := arg(i); option == "ex" || option == "px" {
+				unit := int64(1000)
+				if option == "px" {
+					unit = 1
+				}
+				ret := append([]interface{}(nil), args...)
+				ret[i], ret[i+1] = "PXAT", at(args[i+1], unit)
+				return ret
+			}
+		}
+	case "getex":
+		for i := 2; i < len(args); i++ {
+			switch option := arg(i); option {
+			case "ex", "px":
+				if i+1 < len(args) {
+					unit := int64(1000)
+					if option == "px" {
+						unit = 1
+					}
+					return []interface{}{"PEXPIREAT", args[1], at(args[i+1], unit)}
+				}
+			case "exat":
+				if i+1 < len(args) {
+					return []interface{}{"PEXPIREAT", args[1], ms(args[i+1], 0, 1000)}
+				}
+			case "pxat":
+				if i+1 < len(args) {
+					return []interface{}{"PEXPIREAT", args[1], args[i+1]}
+				}
+			case "persist":
+				return []interface{}{"PERSIST", args[1]}
+			}
+		}
+	case "restore":
+		// RESTORE key ttl payload [REPLACE] [ABSTTL] ..., a ttl of 0 means no expiration
+		if len(args) > 3 && args[2].(string) != "0" {
+			for i := 4; i < len(args); i++ {
+				if arg(i) == "absttl" {
+					return args
+				}
+			}
+			ret := append([]interface{}(nil), args...)
+			ret[2] = at(args[2], 1)
+			return append(ret, "ABSTTL")
+		}
+	}
+	return args
+}
+
+func (w *AOFWriter) annotate(buff []byte, c *Command) []byte {
+	if !w.timestamps {
+		return buff
+	}
+	if ts := c.Time.Unix(); ts != w.ts {
+		w.ts = ts
+		buff = append(buff, "#TS:"...)
+		buff = strconv.AppendInt(buff, ts, 10)
+		buff = append(buff, '\r', '\n')
+	}
+	return buff
+}
+
+func (w *AOFWriter) selectDB(buff []byte, c *Command) []byte {
+	if c.DB == w.db {
+		return buff
+	}
+	w.db = c.DB
+	return AppendRequest(buff, []interface{}{"SELECT", strconv.Itoa(c.DB)})
+}
+
+func (w *AOFWriter) append(buff []byte, c *Command) []byte {
+	buff = w.annotate(buff, c)
+	buff = w.selectDB(buff, c)
+	return AppendRequest(buff, w.rewrite(c))
+}
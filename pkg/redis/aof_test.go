@@ -0,0 +1,107 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAOFWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := NewAOFWriter(out, false)
+	host := net.ParseIP("127.0.0.1")
+	requests := "*1\r\n$3\r\nget\r\n*2\r\n$6\r\nselect\r\n$1\r\n2\r\n*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n" +
+		"*2\r\n$4\r\nincr\r\n$1\r\na\r\n" +
+		"*1\r\n$5\r\nmulti\r\n*2\r\n$3\r\ndel\r\n$1\r\na\r\n*2\r\n$3\r\nget\r\n$1\r\na\r\n*1\r\n$4\r\nexec\r\n" +
+		"*1\r\n$5\r\nmulti\r\n*2\r\n$3\r\ndel\r\n$1\r\nb\r\n*1\r\n$4\r\nexec\r\n"
+	require.NoError(t, w.FlowIn(host, 1000, []byte(requests)))
+	require.NoError(t, w.FlowOut(host, 1000, []byte("$-1\r\n+OK\r\n+OK\r\n-ERR not an integer\r\n"+
+		"+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n:1\r\n$-1\r\n"+
+		"+OK\r\n+QUEUED\r\n*-1\r\n")))
+
+	require.Equal(t, "*2\r\n$6\r\nSELECT\r\n$1\r\n2\r\n*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n"+
+		"*1\r\n$5\r\nmulti\r\n*2\r\n$3\r\ndel\r\n$1\r\na\r\n*1\r\n$4\r\nexec\r\n", out.String())
+
+	// another connection in db 0, with timestamps
+	out.Reset()
+	w.timestamps = true
+	require.NoError(t, w.FlowIn(host, 1001, []byte("*2\r\n$3\r\ndel\r\n$1\r\nc\r\n")))
+	require.NoError(t, w.FlowOut(host, 1001, []byte(":0\r\n")))
+	require.Regexp(t, "^#TS:[0-9]+\r\n\\*2\r\n\\$6\r\nSELECT\r\n\\$1\r\n0\r\n\\*2\r\n\\$3\r\ndel\r\n", out.String())
+}
+
+func TestAOFWriter_Close(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := NewAOFWriter(out, false)
+	host := net.ParseIP("127.0.0.1")
+	require.NoError(t, w.FlowIn(host, 1000, []byte("*2\r\n$6\r\nselect\r\n$1\r\n2\r\n*1\r\n$5\r\nmulti\r\n")))
+	require.NoError(t, w.FlowOut(host, 1000, []byte("+OK\r\n+OK\r\n")))
+	w.FlowClose(host, 1000)
+
+	// a new connection on the same address starts in db 0, out of any transaction
+	require.NoError(t, w.FlowIn(host, 1000, []byte("*2\r\n$3\r\ndel\r\n$1\r\na\r\n")))
+	require.NoError(t, w.FlowOut(host, 1000, []byte(":1\r\n")))
+	require.Equal(t, "*2\r\n$6\r\nSELECT\r\n$1\r\n0\r\n*2\r\n$3\r\ndel\r\n$1\r\na\r\n", out.String())
+}
+
+func TestAOFWriter_Rewrite(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := NewAOFWriter(out, false)
+	host := net.ParseIP("127.0.0.1")
+	var requests, replies []byte
+	for _, c := range []struct {
+		args  []interface{}
+		reply string
+	}{
+		{[]interface{}{"eval", "return redis.call('set', KEYS[1], 1)", "1", "a"}, "+OK\r\n"},
+		{[]interface{}{"evalsha", scriptSHA("return redis.call('set', KEYS[1], 1)"), "1", "b"}, "+OK\r\n"},
+		{[]interface{}{"eval_ro", "return 1", "0"}, ":1\r\n"},
+		{[]interface{}{"script", "load", "return 2"}, "$40\r\n" + scriptSHA("return 2") + "\r\n"},
+		{[]interface{}{"fcall", "f", "0"}, "+OK\r\n"},
+		{[]interface{}{"expire", "a", "10", "nx"}, ":1\r\n"},
+		{[]interface{}{"set", "a", "1", "EX", "10", "get"}, "$-1\r\n"},
+		{[]interface{}{"psetex", "a", "10000", "1"}, "+OK\r\n"},
+		{[]interface{}{"getex", "a"}, "$1\r\n1\r\n"},
+		{[]interface{}{"getex", "a", "persist"}, "$1\r\n1\r\n"},
+		{[]interface{}{"getex", "a", "exat", "1700000000"}, "$1\r\n1\r\n"},
+		{[]interface{}{"restore", "a", "10000", "payload", "replace"}, "+OK\r\n"},
+	} {
+		requests = AppendRequest(requests, c.args)
+		replies = append(replies, c.reply...)
+	}
+	start := time.Now().UnixMilli()
+	require.NoError(t, w.FlowIn(host, 1000, requests))
+	require.NoError(t, w.FlowOut(host, 1000, replies))
+	end := time.Now().UnixMilli()
+
+	var written []string
+	d := NewDecoder(true)
+	d.Append(out.Bytes())
+	for r := d.TryDecodeRequest(); r.Valid(); r = d.TryDecodeRequest() {
+		args, _ := r.Value().([]interface{})
+		for i, v := range args {
+			// relative expirations are 10s after the request
+			if n, err := strconv.ParseInt(v.(string), 10, 64); err == nil && n >= start+10000 && n <= end+10000 {
+				args[i] = "<10s>"
+			}
+		}
+		written = append(written, fmt.Sprint(args))
+	}
+	require.Equal(t, []string{
+		"[SELECT 0]",
+		"[eval return redis.call('set', KEYS[1], 1) 1 a]",
+		"[EVAL return redis.call('set', KEYS[1], 1) 1 b]",
+		"[script load return 2]",
+		"[fcall f 0]",
+		"[PEXPIREAT a <10s> nx]",
+		"[set a 1 PXAT <10s> get]",
+		"[SET a 1 PXAT <10s>]",
+		"[PERSIST a]",
+		"[PEXPIREAT a 1700000000000]",
+		"[restore a <10s> payload replace ABSTTL]",
+	}, written)
+}
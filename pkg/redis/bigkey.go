@@ -0,0 +1,185 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	topBigKeys = 20
+	maxBigKeys = 10000 // distinct keys kept per interval
+)
+
+type bigKey struct {
+	key      string
+	cmd      string
+	client   string
+	reply    bool // the size was seen in a reply rather than in a request
+	bytes    int
+	elements int
+	count    int64
+}
+
+// BigKeyWriter flags requests and replies whose payload exceeds a byte or element count
+// threshold, and reports the largest keys of each interval.
+type BigKeyWriter struct {
+	sessions    *SessionMgr
+	period      *common.Period
+	maxBytes    int
+	maxElements int
+	mux         sync.Mutex
+	keys        map[string]*bigKey
+	flagged     int64
+}
+
+func NewBigKeyWriter(maxBytes, maxElements int, interval time.Duration) *BigKeyWriter {
+	return &BigKeyWriter{
+		sessions:    NewSessionMgr(true),
+		period:      common.NewPeriod(interval),
+		maxBytes:    maxBytes,
+		maxElements: maxElements,
+		keys:        map[string]*bigKey{},
+	}
+}
+
+func (w *BigKeyWriter) record(b bigKey) {
+	if b.bytes < w.maxBytes && b.elements < w.maxElements {
+		return
+	}
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	w.flagged++
+	old, ok := w.keys[b.key]
+	if !ok {
+		if len(w.keys) >= maxBigKeys {
+			return
+		}
+		b.count = 1
+		w.keys[b.key] = &b
+		return
+	}
+	old.count++
+	if b.bytes > old.bytes {
+		b.count = old.count
+		*old = b
+	}
+}
+
+// requestPayload returns for each key position the bytes and number of the arguments which
+// are neither the command name nor keys: those following the key up to the next one, and
+// for the first key those before it too, such as the values of MSET.
+func requestPayload(args []interface{}, positions []int) (bytes, elements []int) {
+	bytes, elements = make([]int, len(positions)), make([]int, len(positions))
+	k := 0
+	for i := 1; i < len(args); i++ {
+		if k < len(positions) && i == positions[k] {
+			k++
+			continue
+		}
+		owner := k - 1
+		if owner < 0 {
+			owner = 0
+		}
+		bytes[owner] += len(args[i].(string))
+		elements[owner]++
+	}
+	return
+}
+
+// replyElements returns the number of elements of an aggregate reply, pairs for maps.
+func replyElements(reply Resp) int {
+	if !reply.IsArray() {
+		return 1
+	}
+	if reply.Type() == '%' {
+		return reply.Len() / 2
+	}
+	return reply.Len()
+}
+
+func (w *BigKeyWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	requests := w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
+
+	for _, r := range expand(requests) {
+		cmd := r.Name()
+		if !common.IsWrite(cmd) {
+			continue
+		}
+		// keys are found by position, a value may equal a key
+		positions := common.KeyPositions(cmd, r.Args)
+		bytes, elements := requestPayload(r.Args, positions)
+		for k, i := range positions {
+			w.record(bigKey{key: r.Args[i].(string), cmd: cmd, client: r.Client.Label(), bytes: bytes[k], elements: elements[k]})
+		}
+	}
+
+	w.report()
+	return nil
+}
+
+func (w *BigKeyWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	replies, _ := w.sessions.FetchReplies(common.RemoteKey(dstHost, dstPort), data)
+
+	for _, r := range expand(replies) {
+		cmd := r.Name()
+		if !common.IsRead(cmd) || !r.Replied() || r.Reply.IsError() || r.Reply.Null() {
+			continue
+		}
+		keys := r.Keys()
+		if len(keys) == 0 {
+			continue
+		}
+		w.record(bigKey{key: keys[0], cmd: cmd, client: r.Client.Label(), reply: true, bytes: r.Reply.Size(), elements: replyElements(r.Reply)})
+	}
+
+	w.report()
+	return nil
+}
+
+// FlowClose drops the state of the connection, a new connection on its address starts afresh.
+func (w *BigKeyWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+func (w *BigKeyWriter) report() {
+	oldTime, ok := w.period.Elapsed()
+	if !ok {
+		return
+	}
+
+	w.mux.Lock()
+	keys := w.keys
+	flagged := w.flagged
+	w.keys = map[string]*bigKey{}
+	w.flagged = 0
+	w.mux.Unlock()
+
+	top := make([]*bigKey, 0, len(keys))
+	for _, k := range keys {
+		top = append(top, k)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].bytes != top[j].bytes {
+			return top[i].bytes > top[j].bytes
+		}
+		return top[i].elements > top[j].elements
+	})
+	if len(top) > topBigKeys {
+		top = top[:topBigKeys]
+	}
+
+	fmt.Printf("[%d]big key flagged:%d, keys:%d\n", oldTime, flagged, len(keys))
+	for i, k := range top {
+		direction := "req"
+		if k.reply {
+			direction = "rsp"
+		}
+		fmt.Printf("[%d]big key top%d key:%s, cmd:%s, client:%s, %s.size:%d, %s.len:%d, count:%d\n",
+			oldTime, i+1, k.key, k.cmd, k.client, direction, k.bytes, direction, k.elements, k.count)
+	}
+}
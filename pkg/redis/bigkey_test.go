@@ -0,0 +1,19 @@
+package redis
+
+import (
+	"github.com/morningli/packet_monitor/pkg/common"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRequestPayload(t *testing.T) {
+	args := []interface{}{"mset", "a", "b", "b", "cc"}
+	bytes, elements := requestPayload(args, common.KeyPositions("mset", args))
+	require.Equal(t, []int{1, 2}, bytes)
+	require.Equal(t, []int{1, 1}, elements)
+
+	args = []interface{}{"hset", "h", "f1", "v1", "f2", "v2"}
+	bytes, elements = requestPayload(args, common.KeyPositions("hset", args))
+	require.Equal(t, []int{8}, bytes)
+	require.Equal(t, []int{4}, elements)
+}
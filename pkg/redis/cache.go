@@ -0,0 +1,259 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const missKeys = 10
+
+type lookupKind int
+
+const (
+	lookupNil      lookupKind = iota + 1 // a nil or empty aggregate reply is a miss
+	lookupElements                       // one element per key, nil elements are misses
+	lookupFields                         // one element per field of the key, nil or 0 elements are misses
+	lookupCount                          // the reply counts the keys found
+	lookupZero                           // 0, -2 (ttl of a missing key) or none is a miss
+)
+
+var lookupCommands = map[string]lookupKind{
+	"get":              lookupNil,
+	"getex":            lookupNil,
+	"getdel":           lookupNil,
+	"hget":             lookupNil,
+	"hgetall":          lookupNil,
+	"hkeys":            lookupNil,
+	"hvals":            lookupNil,
+	"hrandfield":       lookupNil,
+	"lindex":           lookupNil,
+	"lrange":           lookupNil,
+	"lpos":             lookupNil,
+	"smembers":         lookupNil,
+	"srandmember":      lookupNil,
+	"zscore":           lookupNil,
+	"zrank":            lookupNil,
+	"zrevrank":         lookupNil,
+	"zrange":           lookupNil,
+	"zrangebyscore":    lookupNil,
+	"zrevrange":        lookupNil,
+	"zrevrangebyscore": lookupNil,
+	"zrangebylex":      lookupNil,
+	"zrandmember":      lookupNil,
+	"xrange":           lookupNil,
+	"xrevrange":        lookupNil,
+	"dump":             lookupNil,
+	"mget":             lookupElements,
+	"hmget":            lookupFields,
+	"zmscore":          lookupFields,
+	"smismember":       lookupFields,
+	"exists":           lookupCount,
+	"hexists":          lookupZero,
+	"sismember":        lookupZero,
+	"strlen":           lookupZero,
+	"hstrlen":          lookupZero,
+	"hlen":             lookupZero,
+	"llen":             lookupZero,
+	"scard":            lookupZero,
+	"zcard":            lookupZero,
+	"xlen":             lookupZero,
+	"type":             lookupZero,
+	"ttl":              lookupZero,
+	"pttl":             lookupZero,
+}
+
+// missing reports whether a reply means that the key or field was not found.
+func missing(r *Resp, zero bool) bool {
+	if r.Null() || (r.IsArray() && r.Len() == 0) {
+		return true
+	}
+	if !zero {
+		return false
+	}
+	switch v := common.BytesToString(r.Bytes()); {
+	case r.Type() == ':':
+		return v == "0" || v == "-2"
+	case r.Type() == '+':
+		return v == "none"
+	}
+	return false
+}
+
+// lookups classifies the reply of a read command. It returns the number of hits and
+// misses, and the keys missed when they are known. ok is false for other commands.
+func lookups(cmd string, keys []string, reply *Resp) (hits, misses int, missed []string, ok bool) {
+	kind := lookupCommands[cmd]
+	if kind == 0 || len(keys) == 0 || !reply.Valid() || reply.IsError() {
+		return 0, 0, nil, false
+	}
+	switch kind {
+	case lookupNil, lookupZero:
+		if missing(reply, kind == lookupZero) {
+			return 0, 1, keys[:1], true
+		}
+		return 1, 0, nil, true
+	case lookupElements, lookupFields:
+		if !reply.IsArray() {
+			return 0, 0, nil, false
+		}
+		for i := 0; i < reply.Len(); i++ {
+			item := reply.Item(i)
+			if !missing(&item, kind == lookupFields) {
+				hits++
+				continue
+			}
+			misses++
+			if kind == lookupFields {
+				missed = append(missed, keys[0])
+			} else if i < len(keys) {
+				missed = append(missed, keys[i])
+			}
+		}
+		return hits, misses, missed, true
+	case lookupCount:
+		n, err := common.Btoi(reply.Bytes())
+		if err != nil || reply.Type() != ':' {
+			return 0, 0, nil, false
+		}
+		if n < len(keys) && len(keys) == 1 {
+			missed = keys
+		}
+		return n, len(keys) - n, missed, true
+	}
+	return 0, 0, nil, false
+}
+
+type hitStat struct {
+	hits   int64
+	misses int64
+}
+
+func (s *hitStat) ratio() float64 {
+	if s.hits+s.misses == 0 {
+		return 0
+	}
+	return float64(s.hits) * 100 / float64(s.hits+s.misses)
+}
+
+// CacheWriter measures cache effectiveness from the replies of read commands: hits and
+// misses per command, key pattern and client, and the keys missed most.
+type CacheWriter struct {
+	sessions *SessionMgr
+	period   *common.Period
+	mux      sync.Mutex
+	commands map[string]*hitStat
+	patterns map[string]*hitStat
+	clients  map[string]*hitStat
+	missed   *common.TopK
+}
+
+func NewCacheWriter(interval time.Duration) *CacheWriter {
+	w := &CacheWriter{sessions: NewSessionMgr(true), period: common.NewPeriod(interval)}
+	w.reset()
+	return w
+}
+
+func (w *CacheWriter) reset() {
+	w.commands = map[string]*hitStat{}
+	w.patterns = map[string]*hitStat{}
+	w.clients = map[string]*hitStat{}
+	w.missed = common.NewTopK(missKeys * 10)
+}
+
+func hitStatOf(stats map[string]*hitStat, name string, limit int) *hitStat {
+	s, ok := stats[name]
+	if !ok {
+		if limit > 0 && len(stats) >= limit {
+			return hitStatOf(stats, otherPattern, 0)
+		}
+		s = &hitStat{}
+		stats[name] = s
+	}
+	return s
+}
+
+func (w *CacheWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	_ = w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
+	w.report()
+	return nil
+}
+
+func (w *CacheWriter) add(c *Command) {
+	cmd := c.Name()
+	keys := c.Keys()
+	hits, misses, missed, ok := lookups(cmd, keys, &c.Reply)
+	if !ok {
+		return
+	}
+	for _, s := range []*hitStat{
+		hitStatOf(w.commands, cmd, 0),
+		hitStatOf(w.patterns, KeyPattern(keys[0]), maxPatterns),
+		hitStatOf(w.clients, c.Client.Label(), 0),
+	} {
+		s.hits += int64(hits)
+		s.misses += int64(misses)
+	}
+	for _, key := range missed {
+		w.missed.Add(key, 1)
+	}
+}
+
+func (w *CacheWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	replies, _ := w.sessions.FetchReplies(common.RemoteKey(dstHost, dstPort), data)
+
+	w.mux.Lock()
+	for _, r := range replies {
+		if r.Tx != nil && !r.Tx.Aborted() && !r.Tx.Discarded() {
+			for _, c := range r.Tx.Commands {
+				w.add(c)
+			}
+		}
+		w.add(r)
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+// FlowClose drops the state of the connection, a new connection on its address starts afresh.
+func (w *CacheWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+func printHitStats(oldTime int64, kind string, stats map[string]*hitStat) {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	total := func(s *hitStat) int64 { return s.hits + s.misses }
+	sort.Slice(names, func(i, j int) bool { return total(stats[names[i]]) > total(stats[names[j]]) })
+	for _, name := range names {
+		s := stats[name]
+		fmt.Printf("[%d]cache %s:%s, hit:%d, miss:%d, hit ratio:%.2f%%\n", oldTime, kind, name, s.hits, s.misses, s.ratio())
+	}
+}
+
+func (w *CacheWriter) report() {
+	oldTime, ok := w.period.Elapsed()
+	if !ok {
+		return
+	}
+
+	w.mux.Lock()
+	commands, patterns, clients, missed := w.commands, w.patterns, w.clients, w.missed
+	w.reset()
+	w.mux.Unlock()
+
+	printHitStats(oldTime, "cmd", commands)
+	printHitStats(oldTime, "pattern", patterns)
+	printHitStats(oldTime, "client", clients)
+	for _, item := range missed.Top(missKeys) {
+		fmt.Printf("[%d]cache miss key:%s, count:%d, error:%d\n", oldTime, item.Key, item.Count, item.Error)
+	}
+}
@@ -0,0 +1,32 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestLookups(t *testing.T) {
+	s := NewSession("127.0.0.1:1000", true)
+	s.FetchRequests([]byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n*3\r\n$4\r\nmget\r\n$1\r\na\r\n$1\r\nb\r\n" +
+		"*3\r\n$6\r\nexists\r\n$1\r\na\r\n$1\r\nb\r\n*2\r\n$4\r\nllen\r\n$1\r\nl\r\n*2\r\n$3\r\nset\r\n$1\r\na\r\n"))
+	replies, _ := s.FetchReplies([]byte("$-1\r\n*2\r\n$1\r\n1\r\n$-1\r\n:1\r\n:0\r\n+OK\r\n"))
+	require.Len(t, replies, 5)
+
+	type result struct {
+		hits, misses int
+		missed       []string
+		ok           bool
+	}
+	var results []result
+	for _, r := range replies {
+		hits, misses, missed, ok := lookups(r.Name(), r.Keys(), &r.Reply)
+		results = append(results, result{hits, misses, missed, ok})
+	}
+	require.Equal(t, []result{
+		{0, 1, []string{"a"}, true},
+		{1, 1, []string{"b"}, true},
+		{1, 1, nil, true},
+		{0, 1, []string{"l"}, true},
+		{0, 0, nil, false},
+	}, results)
+}
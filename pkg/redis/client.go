@@ -0,0 +1,87 @@
+package redis
+
+import (
+	"net"
+	"regexp"
+	"strings"
+)
+
+var (
+	clientFilter *regexp.Regexp
+	groupByName  bool
+)
+
+// SetClientFilter keeps only the commands of clients whose name matches the glob pattern,
+// in every writer. An empty pattern keeps all clients.
+func SetClientFilter(glob string) {
+	if glob == "" {
+		clientFilter = nil
+		return
+	}
+	clientFilter = GlobToRegexp(glob)
+}
+
+// SetGroupByName makes writers report clients by name instead of by ip:port.
+func SetGroupByName(byName bool) {
+	groupByName = byName
+}
+
+// ClientInfo is the identity of a connection, from CLIENT SETNAME, HELLO SETNAME and CLIENT SETINFO.
+type ClientInfo struct {
+	Addr   string
+	Name   string
+	Lib    string
+	LibVer string
+}
+
+// Label is how writers group a client: ip:port, or with grouping by name the client name,
+// falling back to the ip when the client has no name so that ephemeral ports are merged.
+func (c *ClientInfo) Label() string {
+	if !groupByName {
+		return c.Addr
+	}
+	if c.Name != "" {
+		return c.Name
+	}
+	if host, _, err := net.SplitHostPort(c.Addr); err == nil {
+		return host
+	}
+	return c.Addr
+}
+
+func (c *ClientInfo) match() bool {
+	return clientFilter == nil || clientFilter.MatchString(c.Name)
+}
+
+// identify updates the identity of the connection from the commands that set it.
+func (c *ClientInfo) identify(cmd string, args []interface{}) {
+	arg := func(i int) string {
+		return string(append([]byte(nil), args[i].(string)...))
+	}
+	switch cmd {
+	case "client":
+		if len(args) < 3 {
+			return
+		}
+		switch strings.ToLower(args[1].(string)) {
+		case "setname":
+			c.Name = arg(2)
+		case "setinfo":
+			if len(args) < 4 {
+				return
+			}
+			switch strings.ToLower(args[2].(string)) {
+			case "lib-name":
+				c.Lib = arg(3)
+			case "lib-ver":
+				c.LibVer = arg(3)
+			}
+		}
+	case "hello":
+		for i := 2; i < len(args)-1; i++ {
+			if strings.EqualFold(args[i].(string), "setname") {
+				c.Name = arg(i + 1)
+			}
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package redis
+
+import (
+	"github.com/morningli/packet_monitor/pkg/common"
+	"strings"
+	"time"
+)
+
+// Command is a decoded request, paired with its reply once the reply has been seen.
+type Command struct {
+	Args      []interface{}
+	Size      int
+	Time      time.Time
+	Reply     Resp
+	ReplyTime time.Time
+	Tx        *Transaction // set on the EXEC/DISCARD command that closes a transaction
+	Client    ClientInfo   // identity of the connection when the command was sent
+	DB        int          // database selected when the command was sent
+
+	queued     bool // MULTI or a command queued inside MULTI, reported through its transaction
+	expect     int  // confirmations still expected by the subscribe family
+	skipped    bool // stands for a request which could not be decoded, to pair the replies
+	argsOwned  bool
+	replyOwned bool
+}
+
+// newCommand builds a command from a decoded request. The arguments are views into the
+// decoder buffer unless retain is set, then they share one copy.
+func newCommand(r *Resp, t time.Time, retain bool) *Command {
+	cmd := &Command{Args: make([]interface{}, r.Len()), Size: r.Size(), Time: t, argsOwned: retain}
+	var buf []byte
+	if retain {
+		buf = make([]byte, 0, r.payloadSize())
+	}
+	for i := range r.items {
+		arg := r.items[i].data
+		if retain {
+			start := len(buf)
+			buf = append(buf, arg...)
+			arg = buf[start:]
+		}
+		cmd.Args[i] = common.BytesToString(arg)
+	}
+	return cmd
+}
+
+func (c *Command) setReply(r Resp, t time.Time) {
+	c.Reply = r
+	c.ReplyTime = t
+	c.replyOwned = false
+}
+
+// Retain copies the arguments and the reply out of the decoder buffers, including the
+// commands of its transaction. Commands returned by a session are only valid until the
+// next data of the same connection, writers must call Retain before keeping them longer.
+func (c *Command) Retain() {
+	if !c.argsOwned {
+		size := 0
+		for _, v := range c.Args {
+			size += len(v.(string))
+		}
+		buf := make([]byte, 0, size)
+		for i, v := range c.Args {
+			start := len(buf)
+			buf = append(buf, v.(string)...)
+			c.Args[i] = common.BytesToString(buf[start:])
+		}
+		c.argsOwned = true
+	}
+	if c.Reply.Valid() && !c.replyOwned {
+		c.Reply = c.Reply.Clone()
+		c.replyOwned = true
+	}
+	if c.Tx != nil {
+		c.Tx.Multi.Retain()
+		for _, cmd := range c.Tx.Commands {
+			cmd.Retain()
+		}
+	}
+}
+
+func (c *Command) Name() string {
+	if len(c.Args) == 0 {
+		return ""
+	}
+	return strings.ToLower(c.Args[0].(string))
+}
+
+func (c *Command) Replied() bool {
+	return c.Reply.Valid()
+}
+
+// Keys returns the keys of the command according to the command table.
+func (c *Command) Keys() []string {
+	return common.GetKeys(c.Name(), c.Args)
+}
+
+// expand replaces each transaction by MULTI, the queued commands and EXEC/DISCARD.
+func expand(cmds []*Command) []*Command {
+	n := 0
+	for _, c := range cmds {
+		if c.Tx != nil {
+			n += len(c.Tx.Commands) + 1
+		}
+		n++
+	}
+	if n == len(cmds) {
+		return cmds
+	}
+	ret := make([]*Command, 0, n)
+	for _, c := range cmds {
+		if c.Tx != nil {
+			ret = append(ret, c.Tx.Multi)
+			ret = append(ret, c.Tx.Commands...)
+		}
+		ret = append(ret, c)
+	}
+	return ret
+}
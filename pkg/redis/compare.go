@@ -0,0 +1,485 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	compareExamples = 3
+	compareTimeout  = 5 * time.Second
+	maxExampleLen   = 120
+)
+
+// unordered are the commands whose array reply is a set in any order.
+var unordered = map[string]bool{
+	"smembers": true, "sinter": true, "sunion": true, "sdiff": true, "keys": true, "hkeys": true, "hvals": true,
+}
+
+// pairs are the commands whose array reply is a map in any order.
+var pairs = map[string]bool{"hgetall": true}
+
+// uncompared are the commands whose reply depends on the server or on randomness, they
+// are sent to keep the candidate in sync but their replies are not compared.
+var uncompared = map[string]bool{
+	"time": true, "randomkey": true, "info": true, "hello": true, "client": true, "lastsave": true,
+	"srandmember": true, "spop": true, "hrandfield": true, "zrandmember": true, "memory": true, "object": true,
+	"slowlog": true, "latency": true, "config": true, "role": true, "command": true, "cluster": true,
+	"scan": true, "sscan": true, "hscan": true, "zscan": true, "lolwut": true,
+}
+
+type compareStat struct {
+	count     int64
+	mismatch  int64
+	examples  []string
+	captured  *hdrhistogram.Histogram // microseconds
+	candidate *hdrhistogram.Histogram
+}
+
+func newCompareStat() *compareStat {
+	return &compareStat{captured: hdrhistogram.New(1, maxLatency, 2), candidate: hdrhistogram.New(1, maxLatency, 2)}
+}
+
+// CompareWriter sends the captured requests to a candidate server and compares its replies
+// with the replies captured on the same connection. Every client connection is replayed in
+// order on its own connection of the candidate. Replies are normalized before the
+// comparison: sets, maps and the arrays of commands like SMEMBERS and HGETALL are sorted.
+// The captured latency is seen from the monitored host, the candidate latency is the round
+// trip from this process.
+type CompareWriter struct {
+	sessions *SessionMgr
+	address  string
+	period   *common.Period
+	connMux  sync.Mutex
+	conns    map[string]*compareConn
+
+	mux        sync.Mutex
+	stats      map[string]*compareStat
+	total      *compareStat
+	uncompared int64
+	errors     int64
+	dropped    int64
+}
+
+// compareConn is the queue of one client connection.
+type compareConn struct {
+	client   string
+	mux      sync.Mutex
+	pending  []*Command
+	closed   bool
+	signal   chan struct{}
+	lastTime time.Time
+
+	conn    net.Conn
+	decoder *Decoder
+	buf     []byte
+	rbuf    []byte
+}
+
+func NewCompareWriter(address string, interval time.Duration) *CompareWriter {
+	w := &CompareWriter{
+		sessions: NewSessionMgr(true),
+		address:  address,
+		period:   common.NewPeriod(interval),
+		conns:    map[string]*compareConn{},
+		stats:    map[string]*compareStat{},
+		total:    newCompareStat(),
+	}
+	go w.expire()
+	return w
+}
+
+// expire closes the connections of clients which sent nothing for a while, in case their close was not seen.
+func (w *CompareWriter) expire() {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for range tick.C {
+		w.expireIdle(sessionTimeout)
+	}
+}
+
+func (w *CompareWriter) expireIdle(timeout time.Duration) {
+	w.connMux.Lock()
+	defer w.connMux.Unlock()
+	for client, c := range w.conns {
+		c.mux.Lock()
+		idle := time.Since(c.lastTime) > timeout
+		c.mux.Unlock()
+		if idle {
+			w.closeLocked(client, c)
+		}
+	}
+}
+
+func (w *CompareWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	_ = w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
+	w.report()
+	return nil
+}
+
+func (w *CompareWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	address := common.RemoteKey(dstHost, dstPort)
+	replies, _ := w.sessions.FetchReplies(address, data)
+	if len(replies) > 0 {
+		w.connMux.Lock()
+		c, ok := w.conns[address]
+		if !ok {
+			c = &compareConn{client: address, signal: make(chan struct{}, 1)}
+			w.conns[address] = c
+			go w.run(c)
+		}
+		c.mux.Lock()
+		c.lastTime = time.Now()
+		dropped := 0
+		for _, r := range replies {
+			if len(c.pending) >= maxQueued {
+				dropped++
+				continue
+			}
+			// the arguments and the reply point into the session buffers until retained
+			r.Retain()
+			c.pending = append(c.pending, r)
+		}
+		c.mux.Unlock()
+		w.connMux.Unlock()
+
+		if dropped > 0 {
+			w.mux.Lock()
+			w.dropped += int64(dropped)
+			w.mux.Unlock()
+		}
+		select {
+		case c.signal <- struct{}{}:
+		default:
+		}
+	}
+	w.report()
+	return nil
+}
+
+// FlowClose closes the connection of the client on the candidate once its commands are compared.
+func (w *CompareWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	address := common.RemoteKey(host, port)
+	w.sessions.Close(address)
+	w.connMux.Lock()
+	if c, ok := w.conns[address]; ok {
+		w.closeLocked(address, c)
+	}
+	w.connMux.Unlock()
+}
+
+func (w *CompareWriter) closeLocked(client string, c *compareConn) {
+	delete(w.conns, client)
+	c.mux.Lock()
+	c.closed = true
+	c.mux.Unlock()
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+func (w *CompareWriter) run(c *compareConn) {
+	for range c.signal {
+		c.mux.Lock()
+		pending, closed := c.pending, c.closed
+		c.pending = nil
+		c.mux.Unlock()
+
+		for _, cmd := range pending {
+			w.replay(c, cmd)
+		}
+		if closed {
+			if c.conn != nil {
+				_ = c.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func (w *CompareWriter) replay(c *compareConn, cmd *Command) {
+	name := command(cmd.Args)
+	timeout, blocking := common.BlockingTimeout(cmd.Name(), cmd.Args)
+	if skipped(name) || (blocking && timeout == 0) {
+		w.mux.Lock()
+		w.uncompared++
+		w.mux.Unlock()
+		return
+	}
+	if cmd.Tx == nil {
+		reply, latency, err := w.exchange(c, cmd.Args, compareTimeout+timeout)
+		if err == nil {
+			w.compare(cmd, reply, latency)
+		}
+		return
+	}
+
+	// MULTI and the queued commands are answered OK and QUEUED, the results of the
+	// queued commands are compared with the items of the reply to EXEC
+	tx := cmd.Tx
+	reply, latency, err := w.exchange(c, tx.Multi.Args, compareTimeout)
+	if err != nil {
+		return
+	}
+	w.compare(tx.Multi, reply, latency)
+	for _, queued := range tx.Commands {
+		if _, _, err = w.exchange(c, queued.Args, compareTimeout); err != nil {
+			return
+		}
+	}
+	reply, latency, err = w.exchange(c, cmd.Args, compareTimeout)
+	if err != nil {
+		return
+	}
+	if tx.Discarded() || tx.Aborted() || !reply.IsArray() || reply.Len() != len(tx.Commands) {
+		w.compare(cmd, reply, latency)
+		return
+	}
+	w.record(cmd, latency, nil)
+	for i, queued := range tx.Commands {
+		w.compare(queued, reply.Item(i), -1)
+	}
+}
+
+// exchange sends a command on the connection of the client and reads its reply, which is
+// valid until the next exchange.
+func (w *CompareWriter) exchange(c *compareConn, args []interface{}, timeout time.Duration) (Resp, time.Duration, error) {
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", w.address, compareTimeout)
+		if err != nil {
+			w.fail(c, err)
+			return Resp{}, 0, err
+		}
+		c.conn, c.decoder = conn, NewDecoder(false)
+		if c.rbuf == nil {
+			c.rbuf = make([]byte, 4096)
+		}
+	}
+	c.buf = AppendRequest(c.buf[:0], args)
+	start := time.Now()
+	_ = c.conn.SetDeadline(start.Add(timeout))
+	if _, err := c.conn.Write(c.buf); err != nil {
+		w.fail(c, err)
+		return Resp{}, 0, err
+	}
+	for {
+		r := c.decoder.TryDecodeRespond()
+		if r.Valid() {
+			if r.Type() == '>' {
+				// client side caching invalidations
+				continue
+			}
+			return r, time.Since(start), nil
+		}
+		if err := c.decoder.Err(); err != nil {
+			w.fail(c, err)
+			return Resp{}, 0, err
+		}
+		n, err := c.conn.Read(c.rbuf)
+		if err != nil {
+			w.fail(c, err)
+			return Resp{}, 0, err
+		}
+		c.decoder.Append(c.rbuf[:n])
+	}
+}
+
+// fail closes a broken connection, the next command opens a new one without the state of the previous one.
+func (w *CompareWriter) fail(c *compareConn, err error) {
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+	w.mux.Lock()
+	w.errors++
+	n := w.errors
+	w.mux.Unlock()
+	if n%1000 == 1 {
+		log.Warnf("[%s]candidate connection fail:%s", c.client, err)
+	}
+}
+
+// compare records a candidate reply against the captured reply, latency is -1 for the
+// commands of a transaction, which are answered together.
+func (w *CompareWriter) compare(cmd *Command, reply Resp, latency time.Duration) {
+	name := cmd.Name()
+	if uncompared[name] || !cmd.Replied() {
+		w.mux.Lock()
+		w.uncompared++
+		w.mux.Unlock()
+		return
+	}
+	expected := appendNormalized(nil, &cmd.Reply, name, true)
+	got := appendNormalized(nil, &reply, name, true)
+	if bytes.Equal(expected, got) {
+		w.record(cmd, latency, nil)
+		return
+	}
+	example := []byte(truncate(formatArgs(cmd.Args), maxExampleLen))
+	example = append(example, " expected:"...)
+	example = append(example, truncate(string(expected), maxExampleLen)...)
+	example = append(example, " got:"...)
+	example = append(example, truncate(string(got), maxExampleLen)...)
+	w.record(cmd, latency, example)
+}
+
+func (w *CompareWriter) record(cmd *Command, latency time.Duration, mismatch []byte) {
+	name := cmd.Name()
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	stat, ok := w.stats[name]
+	if !ok {
+		stat = newCompareStat()
+		w.stats[name] = stat
+	}
+	for _, s := range []*compareStat{stat, w.total} {
+		s.count++
+		if mismatch != nil {
+			s.mismatch++
+		}
+		if latency >= 0 {
+			captured := cmd.ReplyTime.Sub(cmd.Time).Microseconds()
+			if captured < 1 {
+				captured = 1
+			}
+			candidate := latency.Microseconds()
+			if candidate < 1 {
+				candidate = 1
+			}
+			_ = s.captured.RecordValue(captured)
+			_ = s.candidate.RecordValue(candidate)
+		}
+	}
+	if mismatch != nil && len(stat.examples) < compareExamples {
+		stat.examples = append(stat.examples, string(mismatch))
+	}
+}
+
+func formatArgs(args []interface{}) string {
+	var buf []byte
+	for i, arg := range args {
+		if i > 0 {
+			buf = append(buf, ' ')
+		}
+		buf = common.AppendRepr(buf, arg.(string))
+	}
+	return string(buf)
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// appendNormalized renders a reply so that equal replies render the same whatever their
+// order or protocol version: sets and maps are sorted, and at the top level the arrays of
+// the commands in unordered and pairs as well.
+func appendNormalized(dst []byte, r *Resp, cmd string, top bool) []byte {
+	if r.Null() || r.Type() == '_' {
+		return append(dst, "(nil)"...)
+	}
+	switch r.Type() {
+	case '-', '!':
+		dst = append(dst, "(error) "...)
+		return append(dst, r.Bytes()...)
+	case ':':
+		dst = append(dst, "(integer) "...)
+		return append(dst, r.Bytes()...)
+	case '#':
+		if string(r.Bytes()) == "t" {
+			return append(dst, "(integer) 1"...)
+		}
+		return append(dst, "(integer) 0"...)
+	case '=':
+		// verbatim string, after its format
+		data := r.Bytes()
+		if len(data) > 4 && data[3] == ':' {
+			data = data[4:]
+		}
+		return common.AppendRepr(dst, string(data))
+	}
+	if !r.IsArray() {
+		return common.AppendRepr(dst, string(r.Bytes()))
+	}
+
+	items := make([]string, r.Len())
+	for i := range items {
+		item := r.Item(i)
+		items[i] = string(appendNormalized(nil, &item, cmd, false))
+	}
+	switch {
+	case r.Type() == '%' || (top && pairs[cmd] && len(items)%2 == 0):
+		kv := make([]string, 0, len(items)/2)
+		for i := 0; i+1 < len(items); i += 2 {
+			kv = append(kv, items[i]+" => "+items[i+1])
+		}
+		items = kv
+		sort.Strings(items)
+	case r.Type() == '~' || (top && unordered[cmd]):
+		sort.Strings(items)
+	}
+	dst = append(dst, '[')
+	for i, item := range items {
+		if i > 0 {
+			dst = append(dst, ", "...)
+		}
+		dst = append(dst, item...)
+	}
+	return append(dst, ']')
+}
+
+func (w *CompareWriter) report() {
+	oldTime, ok := w.period.Elapsed()
+	if !ok {
+		return
+	}
+
+	w.mux.Lock()
+	stats, total := w.stats, w.total
+	uncomparedCount, errorCount, droppedCount := w.uncompared, w.errors, w.dropped
+	w.stats, w.total = map[string]*compareStat{}, newCompareStat()
+	w.uncompared, w.errors, w.dropped = 0, 0, 0
+	w.mux.Unlock()
+
+	fmt.Printf("[%d]compare count:%d, match:%d, mismatch:%d, uncompared:%d, error:%d, dropped:%d\n",
+		oldTime, total.count, total.count-total.mismatch, total.mismatch, uncomparedCount, errorCount, droppedCount)
+	fmt.Printf("[%d]compare latency captured:%s\n", oldTime, formatPercentiles(total.captured))
+	fmt.Printf("[%d]compare latency candidate:%s\n", oldTime, formatPercentiles(total.candidate))
+
+	cmds := make([]string, 0, len(stats))
+	for cmd := range stats {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool {
+		if stats[cmds[i]].mismatch != stats[cmds[j]].mismatch {
+			return stats[cmds[i]].mismatch > stats[cmds[j]].mismatch
+		}
+		return cmds[i] < cmds[j]
+	})
+	for _, cmd := range cmds {
+		stat := stats[cmd]
+		p99 := func(h *hdrhistogram.Histogram) string {
+			if h.TotalCount() == 0 {
+				return "-"
+			}
+			return strconv.FormatInt(h.ValueAtQuantile(99), 10) + "us"
+		}
+		fmt.Printf("[%d]compare cmd:%s, count:%d, mismatch:%d, captured p99:%s, candidate p99:%s\n",
+			oldTime, cmd, stat.count, stat.mismatch, p99(stat.captured), p99(stat.candidate))
+		for _, example := range stat.examples {
+			fmt.Printf("[%d]    %s\n", oldTime, example)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package redis
+
+import (
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeReply(t *testing.T) {
+	normalize := func(reply, cmd string) string {
+		d := NewDecoder(false)
+		d.Append([]byte(reply))
+		r := d.TryDecodeRespond()
+		require.True(t, r.Valid(), reply)
+		return string(appendNormalized(nil, &r, cmd, true))
+	}
+	require.Equal(t, normalize("*2\r\n$1\r\na\r\n$1\r\nb\r\n", "smembers"), normalize("*2\r\n$1\r\nb\r\n$1\r\na\r\n", "smembers"))
+	require.Equal(t, normalize("~2\r\n+a\r\n+b\r\n", "sunion"), normalize("*2\r\n$1\r\nb\r\n$1\r\na\r\n", "sunion"))
+	require.NotEqual(t, normalize("*2\r\n$1\r\na\r\n$1\r\nb\r\n", "lrange"), normalize("*2\r\n$1\r\nb\r\n$1\r\na\r\n", "lrange"))
+	require.Equal(t,
+		normalize("*4\r\n$1\r\nf\r\n$1\r\n1\r\n$1\r\ng\r\n$1\r\n2\r\n", "hgetall"),
+		normalize("%2\r\n$1\r\ng\r\n$1\r\n2\r\n$1\r\nf\r\n$1\r\n1\r\n", "hgetall"))
+	require.NotEqual(t,
+		normalize("*4\r\n$1\r\nf\r\n$1\r\n1\r\n$1\r\ng\r\n$1\r\n2\r\n", "hgetall"),
+		normalize("*4\r\n$1\r\nf\r\n$1\r\n2\r\n$1\r\ng\r\n$1\r\n1\r\n", "hgetall"))
+	require.Equal(t, normalize("$-1\r\n", "get"), normalize("_\r\n", "get"))
+	require.Equal(t, normalize(":1\r\n", "sismember"), normalize("#t\r\n", "sismember"))
+}
+
+// candidateServer answers GET with "b" and everything else like redis would on an empty instance.
+func candidateServer(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				d := NewDecoder(true)
+				buf := make([]byte, 4096)
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						return
+					}
+					d.Append(buf[:n])
+					for r := d.TryDecodeRequest(); r.Valid(); r = d.TryDecodeRequest() {
+						args, _ := r.Value().([]interface{})
+						reply := "+OK\r\n"
+						switch strings.ToLower(args[0].(string)) {
+						case "get":
+							reply = "$1\r\nb\r\n"
+						case "smembers":
+							reply = "*2\r\n$1\r\ny\r\n$1\r\nx\r\n"
+						case "incr":
+							reply = "+QUEUED\r\n"
+						case "exec":
+							reply = "*1\r\n:2\r\n"
+						}
+						_, _ = conn.Write([]byte(reply))
+					}
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestCompareWriter(t *testing.T) {
+	ln := candidateServer(t)
+	defer ln.Close()
+
+	w := NewCompareWriter(ln.Addr().String(), time.Hour)
+	host, port := net.ParseIP("10.0.0.1"), layers.TCPPort(5000)
+	exchange := func(request, reply string) {
+		require.Nil(t, w.FlowIn(host, port, []byte(request)))
+		require.Nil(t, w.FlowOut(host, port, []byte(reply)))
+	}
+	exchange("*2\r\n$3\r\nget\r\n$1\r\na\r\n", "$1\r\na\r\n")
+	exchange("*2\r\n$8\r\nsmembers\r\n$1\r\ns\r\n", "*2\r\n$1\r\nx\r\n$1\r\ny\r\n")
+	exchange("*1\r\n$5\r\nmulti\r\n*2\r\n$4\r\nincr\r\n$1\r\nn\r\n*1\r\n$4\r\nexec\r\n",
+		"+OK\r\n+QUEUED\r\n*1\r\n:1\r\n")
+	exchange("*1\r\n$4\r\ntime\r\n", "*2\r\n$1\r\n1\r\n$1\r\n2\r\n")
+	w.FlowClose(host, port)
+
+	// a client whose close was not seen
+	other := layers.TCPPort(5001)
+	require.Nil(t, w.FlowIn(host, other, []byte("*1\r\n$4\r\nping\r\n")))
+	require.Nil(t, w.FlowOut(host, other, []byte("+OK\r\n")))
+	w.expireIdle(0)
+	w.connMux.Lock()
+	require.Len(t, w.conns, 0)
+	w.connMux.Unlock()
+
+	require.Eventually(t, func() bool {
+		w.mux.Lock()
+		defer w.mux.Unlock()
+		return w.total.count+w.uncompared == 7
+	}, time.Second, time.Millisecond*10)
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	require.Equal(t, int64(2), w.total.mismatch)
+	require.Equal(t, int64(1), w.uncompared)
+	require.Equal(t, int64(0), w.stats["smembers"].mismatch)
+	require.Equal(t, []string{`"get" "a" expected:"a" got:"b"`}, w.stats["get"].examples)
+	require.Equal(t, []string{`"incr" "n" expected:(integer) 1 got:(integer) 2`}, w.stats["incr"].examples)
+	require.Equal(t, int64(1), w.stats["exec"].count)
+}
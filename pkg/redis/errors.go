@@ -0,0 +1,161 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	errorSamples   = 3
+	sampleArgLen   = 64
+	sampleArgCount = 8
+)
+
+type errorClass struct {
+	count   int64
+	samples []string
+}
+
+// ErrorWriter counts error replies per error prefix, per command and per client,
+// and keeps a few failing commands of each error prefix as samples.
+type ErrorWriter struct {
+	sessions *SessionMgr
+	period   *common.Period
+	mux      sync.Mutex
+	classes  map[string]*errorClass
+	commands map[string]int64 // command + error prefix
+	clients  map[string]int64 // client + error prefix
+}
+
+func NewErrorWriter(interval time.Duration) *ErrorWriter {
+	return &ErrorWriter{
+		sessions: NewSessionMgr(true),
+		period:   common.NewPeriod(interval),
+		classes:  map[string]*errorClass{},
+		commands: map[string]int64{},
+		clients:  map[string]int64{},
+	}
+}
+
+func (w *ErrorWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	_ = w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
+	w.report()
+	return nil
+}
+
+// errorPrefix returns the error code of an error reply, like ERR, WRONGTYPE or MOVED.
+func errorPrefix(reply Resp) string {
+	msg := reply.Bytes()
+	if i := strings.IndexByte(common.BytesToString(msg), ' '); i >= 0 {
+		msg = msg[:i]
+	}
+	return string(msg)
+}
+
+// formatSample prints a command for a sample, with long arguments cut short.
+func formatSample(args []interface{}) string {
+	buff := strings.Builder{}
+	for i, v := range args {
+		if i == sampleArgCount {
+			buff.WriteString(" ...")
+			break
+		}
+		arg := v.(string)
+		if i > 0 {
+			buff.WriteString(" ")
+		}
+		if len(arg) > sampleArgLen {
+			arg = arg[:sampleArgLen] + "..."
+		}
+		buff.WriteString(strconv.Quote(arg))
+	}
+	return buff.String()
+}
+
+func (w *ErrorWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	replies, _ := w.sessions.FetchReplies(common.RemoteKey(dstHost, dstPort), data)
+
+	w.mux.Lock()
+	for _, r := range expand(replies) {
+		if !r.Reply.IsError() {
+			continue
+		}
+		client := r.Client.Label()
+		prefix := errorPrefix(r.Reply)
+		class, ok := w.classes[prefix]
+		if !ok {
+			class = &errorClass{}
+			w.classes[prefix] = class
+		}
+		class.count++
+		if len(class.samples) < errorSamples {
+			msg := r.Reply.Bytes()
+			class.samples = append(class.samples, fmt.Sprintf("%s %s -> %s", client, formatSample(r.Args), msg))
+		}
+		w.commands[r.Name()+" "+prefix]++
+		w.clients[client+" "+prefix]++
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+// FlowClose drops the state of the connection, a new connection on its address starts afresh.
+func (w *ErrorWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+func sortedCounts(counts map[string]int64) []string {
+	keys := make([]string, 0, len(counts))
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func (w *ErrorWriter) report() {
+	oldTime, ok := w.period.Elapsed()
+	if !ok {
+		return
+	}
+
+	w.mux.Lock()
+	classes, commands, clients := w.classes, w.commands, w.clients
+	w.classes = map[string]*errorClass{}
+	w.commands = map[string]int64{}
+	w.clients = map[string]int64{}
+	w.mux.Unlock()
+
+	counts := make(map[string]int64, len(classes))
+	for prefix, class := range classes {
+		counts[prefix] = class.count
+	}
+	for _, prefix := range sortedCounts(counts) {
+		fmt.Printf("[%d]error:%s, count:%d\n", oldTime, prefix, counts[prefix])
+		for _, sample := range classes[prefix].samples {
+			fmt.Printf("[%d]error:%s, sample:%s\n", oldTime, prefix, sample)
+		}
+	}
+	for _, k := range sortedCounts(commands) {
+		fields := strings.SplitN(k, " ", 2)
+		fmt.Printf("[%d]error command:%s, error:%s, count:%d\n", oldTime, fields[0], fields[1], commands[k])
+	}
+	for _, k := range sortedCounts(clients) {
+		fields := strings.SplitN(k, " ", 2)
+		fmt.Printf("[%d]error client:%s, error:%s, count:%d\n", oldTime, fields[0], fields[1], clients[k])
+	}
+}
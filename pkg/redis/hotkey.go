@@ -0,0 +1,120 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// hotKeyCapacity is the number of counters kept per top-k, as a multiple of k.
+const hotKeyCapacity = 50
+
+type hotKeys struct {
+	reads  *common.TopK
+	writes *common.TopK
+}
+
+// HotKeyWriter reports the most frequent read and write keys of each window. Counting uses
+// the Space-Saving algorithm, so memory is bounded whatever the number of distinct keys.
+type HotKeyWriter struct {
+	sessions *SessionMgr
+	period   *common.Period
+	k        int
+	mux      sync.Mutex
+	groups   map[string]*hotKeys // by client name when grouping by name, else a single group
+}
+
+func NewHotKeyWriter(k int, window time.Duration) *HotKeyWriter {
+	if k <= 0 {
+		k = 10
+	}
+	return &HotKeyWriter{sessions: NewSessionMgr(false), period: common.NewPeriod(window), k: k, groups: map[string]*hotKeys{}}
+}
+
+func (w *HotKeyWriter) group(r *Command) *hotKeys {
+	label := ""
+	if groupByName {
+		label = r.Client.Label()
+	}
+	g, ok := w.groups[label]
+	if !ok {
+		capacity := w.k * hotKeyCapacity
+		if capacity < 1000 {
+			capacity = 1000
+		}
+		g = &hotKeys{reads: common.NewTopK(capacity), writes: common.NewTopK(capacity)}
+		w.groups[label] = g
+	}
+	return g
+}
+
+func (w *HotKeyWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	// ignore
+	return nil
+}
+
+// FlowClose drops the state of the connection, a new connection on its address starts afresh.
+func (w *HotKeyWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+func (w *HotKeyWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	requests := w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
+
+	w.mux.Lock()
+	for _, r := range expand(requests) {
+		keys := r.Keys()
+		if len(keys) == 0 {
+			continue
+		}
+		g := w.group(r)
+		counts := g.reads
+		if common.IsWrite(r.Name()) {
+			counts = g.writes
+		}
+		for _, key := range keys {
+			counts.Add(key, 1)
+		}
+	}
+	w.mux.Unlock()
+
+	oldTime, ok := w.period.Elapsed()
+	if !ok {
+		return nil
+	}
+
+	w.mux.Lock()
+	groups := w.groups
+	w.groups = map[string]*hotKeys{}
+	w.mux.Unlock()
+
+	labels := make([]string, 0, len(groups))
+	for label := range groups {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		w.print(oldTime, label, "read", groups[label].reads)
+		w.print(oldTime, label, "write", groups[label].writes)
+	}
+	return nil
+}
+
+func (w *HotKeyWriter) print(oldTime int64, label string, kind string, counts *common.TopK) {
+	if counts.Total() == 0 {
+		return
+	}
+	if label != "" {
+		label = "client:" + label + ", "
+	}
+	seconds := w.period.Seconds()
+	fmt.Printf("[%d]%s%s keys total:%d, max error:%d\n", oldTime, label, kind, counts.Total(), counts.MaxError())
+	for i, item := range counts.Top(w.k) {
+		fmt.Printf("[%d]%s%s top%d key:%s, freq:%d(%.2f/s), error:%d\n",
+			oldTime, label, kind, i+1, item.Key, item.Count, float64(item.Count)/seconds, item.Error)
+	}
+}
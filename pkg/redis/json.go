@@ -0,0 +1,139 @@
+package redis
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"net"
+	"sync"
+	"unicode/utf8"
+)
+
+var replyTypes = map[byte]string{
+	'+': "simple", '-': "error", ':': "integer", '$': "bulk", '*': "array",
+	'_': "null", '#': "boolean", ',': "double", '(': "bignum", '=': "verbatim", '!': "blob_error",
+	'%': "map", '~': "set", '>': "push",
+}
+
+func replyType(r *Resp) string {
+	if r.Null() {
+		return "null"
+	}
+	return replyTypes[r.Type()]
+}
+
+// jsonReply is present once the reply of a command has been captured.
+type jsonReply struct {
+	Type string `json:"type"`
+	Size int    `json:"size"`
+}
+
+// jsonCommand is one line of the JSON Lines output. Arguments which are not valid UTF-8
+// are written as {"base64":"..."}.
+type jsonCommand struct {
+	Time      float64       `json:"ts"`
+	Client    string        `json:"client"`
+	Name      string        `json:"name,omitempty"`
+	Server    string        `json:"server"`
+	DB        int           `json:"db"`
+	Cmd       string        `json:"cmd"`
+	Args      []interface{} `json:"args"`
+	Keys      []interface{} `json:"keys,omitempty"`
+	Size      int           `json:"size"`
+	Reply     *jsonReply    `json:"reply,omitempty"`
+	LatencyUs *int64        `json:"latency_us,omitempty"`
+}
+
+type base64Arg struct {
+	Base64 string `json:"base64"`
+}
+
+func jsonArg(s string) interface{} {
+	if utf8.ValidString(s) {
+		return s
+	}
+	return base64Arg{Base64: base64.StdEncoding.EncodeToString(common.StringsToBytes(s))}
+}
+
+// JSONWriter writes one JSON object per command, once its reply has been captured, or
+// without reply once it cannot be captured anymore, when the connection closes for example.
+// Transactions are written as MULTI, the queued commands and EXEC/DISCARD.
+type JSONWriter struct {
+	f        io.Writer
+	server   string
+	sessions *SessionMgr
+	mux      sync.Mutex
+}
+
+// NewJSONWriter creates a JSON Lines writer, server is the monitored endpoint written in every line.
+func NewJSONWriter(f io.Writer, server string) *JSONWriter {
+	w := &JSONWriter{f: f, server: server, sessions: NewSessionMgr(true)}
+	w.sessions.OnUnreplied(func(cmds []*Command) {
+		if err := w.write(cmds); err != nil {
+			log.Errorf("write commands without reply fail:%s", err)
+		}
+	})
+	return w
+}
+
+func (w *JSONWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	_ = w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
+	return nil
+}
+
+func (w *JSONWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	replies, _ := w.sessions.FetchReplies(common.RemoteKey(dstHost, dstPort), data)
+	return w.write(replies)
+}
+
+// FlowClose writes the commands of the connection still waiting for their reply.
+func (w *JSONWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+func (w *JSONWriter) write(cmds []*Command) error {
+	if len(cmds) == 0 {
+		return nil
+	}
+	var buff []byte
+	for _, r := range expand(cmds) {
+		line, err := json.Marshal(w.command(r))
+		if err != nil {
+			return err
+		}
+		buff = append(append(buff, line...), '\n')
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	_, err := w.f.Write(buff)
+	return err
+}
+
+func (w *JSONWriter) command(r *Command) *jsonCommand {
+	c := &jsonCommand{
+		Time:   float64(r.Time.UnixMicro()) / 1e6,
+		Client: r.Client.Addr,
+		Name:   r.Client.Name,
+		Server: w.server,
+		DB:     r.DB,
+		Cmd:    r.Name(),
+		Args:   make([]interface{}, len(r.Args)),
+		Size:   r.Size,
+	}
+	for i, v := range r.Args {
+		c.Args[i] = jsonArg(v.(string))
+	}
+	for _, key := range r.Keys() {
+		c.Keys = append(c.Keys, jsonArg(key))
+	}
+	if r.Replied() {
+		c.Reply = &jsonReply{Type: replyType(&r.Reply), Size: r.Reply.Size()}
+		latency := r.ReplyTime.Sub(r.Time).Microseconds()
+		c.LatencyUs = &latency
+	}
+	return c
+}
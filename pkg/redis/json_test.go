@@ -0,0 +1,45 @@
+package redis
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+)
+
+func TestJSONWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := NewJSONWriter(out, "10.0.0.1:6379")
+	host := net.ParseIP("127.0.0.1")
+	require.NoError(t, w.FlowIn(host, 1000, []byte("*2\r\n$6\r\nselect\r\n$1\r\n2\r\n*3\r\n$3\r\nset\r\n$1\r\na\r\n$2\r\n\xff\x00\r\n")))
+	require.Equal(t, 0, out.Len())
+	require.NoError(t, w.FlowOut(host, 1000, []byte("+OK\r\n+OK\r\n")))
+
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	require.Len(t, lines, 2)
+	require.Contains(t, string(lines[0]), `"db":0,"cmd":"select","args":["select","2"]`)
+	require.Contains(t, string(lines[1]), `"client":"127.0.0.1:1000","server":"10.0.0.1:6379","db":2,"cmd":"set",`+
+		`"args":["set","a",{"base64":"/wA="}],"keys":["a"],"size":28,"reply":{"type":"simple","size":5},"latency_us":`)
+}
+
+func TestJSONWriter_Unreplied(t *testing.T) {
+	out := &bytes.Buffer{}
+	w := NewJSONWriter(out, "10.0.0.1:6379")
+	host := net.ParseIP("127.0.0.1")
+	require.NoError(t, w.FlowIn(host, 1000, []byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n*1\r\n$5\r\nmulti\r\n*2\r\n$4\r\nincr\r\n$1\r\nb\r\n")))
+	require.NoError(t, w.FlowOut(host, 1000, []byte("$-1\r\n")))
+	require.Len(t, bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n")), 1)
+
+	// the connection closes before the replies of the open transaction
+	w.FlowClose(host, 1000)
+	lines := bytes.Split(bytes.TrimSpace(out.Bytes()), []byte("\n"))
+	require.Len(t, lines, 3)
+	require.Contains(t, string(lines[0]), `"reply":{"type":"null"`)
+	require.Contains(t, string(lines[1]), `"cmd":"multi","args":["multi"],"size":15}`)
+	require.Contains(t, string(lines[2]), `"cmd":"incr","args":["incr","b"],"keys":["b"],"size":21}`)
+
+	// a new connection on the same address starts empty
+	out.Reset()
+	w.FlowClose(host, 1000)
+	require.Equal(t, 0, out.Len())
+}
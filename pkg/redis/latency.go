@@ -0,0 +1,158 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const maxLatency = int64(time.Hour / time.Microsecond)
+
+var latencyPercentiles = []float64{50, 99, 99.9}
+
+type blockingStat struct {
+	wait       *hdrhistogram.Histogram // microseconds
+	data       int64
+	timedOut   int64
+	errors     int64
+	forever    int64 // requested timeout 0
+	maxTimeout time.Duration
+}
+
+// LatencyWriter reports the service latency of normal commands, and the wait time of
+// blocking commands separately, so that long polls do not hide in the percentiles.
+type LatencyWriter struct {
+	sessions *SessionMgr
+	period   *common.Period
+	mux      sync.Mutex
+	service  *hdrhistogram.Histogram // microseconds
+	blocking map[string]*blockingStat
+}
+
+func NewLatencyWriter(interval time.Duration) *LatencyWriter {
+	return &LatencyWriter{
+		sessions: NewSessionMgr(true),
+		period:   common.NewPeriod(interval),
+		service:  hdrhistogram.New(1, maxLatency, 2),
+		blocking: map[string]*blockingStat{},
+	}
+}
+
+func (w *LatencyWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	_ = w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
+	w.report()
+	return nil
+}
+
+// timedOut reports whether a blocking command returned without data.
+func timedOut(cmd string, args []interface{}, reply Resp) bool {
+	if reply.Null() {
+		return true
+	}
+	atLeast := func(v Resp, arg interface{}) bool {
+		if v.Type() != ':' {
+			return true
+		}
+		got, err1 := common.Btoi(v.Bytes())
+		want, err2 := common.Btoi(common.StringsToBytes(arg.(string)))
+		return err1 != nil || err2 != nil || got >= want
+	}
+	switch cmd {
+	case "wait":
+		// WAIT numreplicas timeout, replies the number of replicas reached
+		return len(args) == 3 && !atLeast(reply, args[1])
+	case "waitaof":
+		// WAITAOF numlocal numreplicas timeout, replies [numlocal, numreplicas]
+		if !reply.IsArray() || len(args) != 4 || reply.Len() != 2 {
+			return false
+		}
+		return !atLeast(reply.Item(0), args[1]) || !atLeast(reply.Item(1), args[2])
+	}
+	return false
+}
+
+func (w *LatencyWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	replies, _ := w.sessions.FetchReplies(common.RemoteKey(dstHost, dstPort), data)
+
+	w.mux.Lock()
+	for _, r := range replies {
+		latency := r.ReplyTime.Sub(r.Time).Microseconds()
+		if latency < 1 {
+			latency = 1
+		}
+		cmd := r.Name()
+		timeout, blocking := common.BlockingTimeout(cmd, r.Args)
+		if !blocking {
+			_ = w.service.RecordValue(latency)
+			continue
+		}
+
+		stat, ok := w.blocking[cmd]
+		if !ok {
+			stat = &blockingStat{wait: hdrhistogram.New(1, maxLatency, 2)}
+			w.blocking[cmd] = stat
+		}
+		_ = stat.wait.RecordValue(latency)
+		if timeout == 0 {
+			stat.forever++
+		} else if timeout > stat.maxTimeout {
+			stat.maxTimeout = timeout
+		}
+		switch {
+		case r.Reply.IsError():
+			stat.errors++
+		case timedOut(cmd, r.Args, r.Reply):
+			stat.timedOut++
+		default:
+			stat.data++
+		}
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+// FlowClose drops the state of the connection, a new connection on its address starts afresh.
+func (w *LatencyWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+func formatPercentiles(h *hdrhistogram.Histogram) string {
+	s := ""
+	for _, p := range latencyPercentiles {
+		s += fmt.Sprintf(" p%g:%dus,", p, h.ValueAtQuantile(p))
+	}
+	return s + fmt.Sprintf(" max:%dus", h.Max())
+}
+
+func (w *LatencyWriter) report() {
+	oldTime, ok := w.period.Elapsed()
+	if !ok {
+		return
+	}
+
+	w.mux.Lock()
+	service, blocking := w.service, w.blocking
+	w.service = hdrhistogram.New(1, maxLatency, 2)
+	w.blocking = map[string]*blockingStat{}
+	w.mux.Unlock()
+
+	fmt.Printf("[%d]service latency count:%d,%s\n", oldTime, service.TotalCount(), formatPercentiles(service))
+
+	cmds := make([]string, 0, len(blocking))
+	for cmd := range blocking {
+		cmds = append(cmds, cmd)
+	}
+	sort.Strings(cmds)
+	for _, cmd := range cmds {
+		stat := blocking[cmd]
+		fmt.Printf("[%d]blocking cmd:%s, count:%d, data:%d, timeout:%d, error:%d, forever:%d, max timeout:%s, wait%s\n",
+			oldTime, cmd, stat.wait.TotalCount(), stat.data, stat.timedOut, stat.errors, stat.forever, stat.maxTimeout, formatPercentiles(stat.wait))
+	}
+}
@@ -0,0 +1,249 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxPatterns  = 10000
+	otherPattern = "{other}"
+)
+
+var (
+	uuidRegexp    = regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`)
+	patternGlobs  []string
+	patternRules  []*regexp.Regexp
+	keyDelimiters = ":./_-|#,@= "
+)
+
+// SetKeyPatterns sets user patterns, globs like user:*:profile, tried in order before the
+// automatic normalization. A key matching a glob is reported under the glob.
+func SetKeyPatterns(globs []string) {
+	patternGlobs, patternRules = nil, nil
+	for _, glob := range globs {
+		if glob == "" {
+			continue
+		}
+		patternGlobs = append(patternGlobs, glob)
+		patternRules = append(patternRules, GlobToRegexp(glob))
+	}
+}
+
+// KeyPattern turns a key into its family: numeric ids, uuids, hex hashes and timestamps
+// become placeholders, eg: user:1001:session:5f2b... becomes user:{id}:session:{hash}.
+func KeyPattern(key string) string {
+	for i, rule := range patternRules {
+		if rule.MatchString(key) {
+			return patternGlobs[i]
+		}
+	}
+
+	key = uuidRegexp.ReplaceAllLiteralString(key, "{uuid}")
+	buff := strings.Builder{}
+	start := 0
+	for i := 0; i <= len(key); i++ {
+		if i < len(key) && strings.IndexByte(keyDelimiters, key[i]) < 0 {
+			continue
+		}
+		buff.WriteString(normalizeSegment(key[start:i]))
+		if i < len(key) {
+			buff.WriteByte(key[i])
+		}
+		start = i + 1
+	}
+	return buff.String()
+}
+
+func normalizeSegment(s string) string {
+	if s == "" {
+		return s
+	}
+	digits, hex := true, true
+	hasDigit := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= '0' && c <= '9':
+			hasDigit = true
+		case c >= 'a' && c <= 'f', c >= 'A' && c <= 'F':
+			digits = false
+		default:
+			digits, hex = false, false
+		}
+	}
+	switch {
+	case digits && isTimestamp(s):
+		return "{ts}"
+	case digits:
+		return "{id}"
+	case hex && hasDigit && len(s) >= 16:
+		return "{hash}"
+	}
+	return s
+}
+
+// isTimestamp reports whether digits look like a unix time in seconds or milliseconds since 2001.
+func isTimestamp(s string) bool {
+	if len(s) != 10 && len(s) != 13 {
+		return false
+	}
+	v, err := common.Btoi(common.StringsToBytes(s))
+	if err != nil {
+		return false
+	}
+	if len(s) == 13 {
+		v /= 1000
+	}
+	return v >= 1e9 && v < 1e10
+}
+
+// patterns returns the distinct patterns of the keys of a command.
+func patterns(r *Command) []string {
+	keys := r.Keys()
+	ret := make([]string, 0, 1)
+	for _, key := range keys {
+		p := KeyPattern(key)
+		dup := false
+		for _, v := range ret {
+			if v == p {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			ret = append(ret, p)
+		}
+	}
+	return ret
+}
+
+type patternStat struct {
+	reads    int64
+	writes   int64
+	others   int64
+	bytesIn  int64
+	bytesOut int64
+	latency  *hdrhistogram.Histogram // microseconds
+}
+
+// PatternWriter reports traffic per key family: QPS, read/write ratio, bytes and latency.
+type PatternWriter struct {
+	sessions *SessionMgr
+	period   *common.Period
+	mux      sync.Mutex
+	stats    map[string]*patternStat
+}
+
+func NewPatternWriter(interval time.Duration) *PatternWriter {
+	return &PatternWriter{
+		sessions: NewSessionMgr(true),
+		period:   common.NewPeriod(interval),
+		stats:    map[string]*patternStat{},
+	}
+}
+
+func (w *PatternWriter) stat(pattern string) *patternStat {
+	stat, ok := w.stats[pattern]
+	if !ok {
+		// the other bucket is created even when the map is full
+		if len(w.stats) >= maxPatterns && pattern != otherPattern {
+			return w.stat(otherPattern)
+		}
+		stat = &patternStat{latency: hdrhistogram.New(1, maxLatency, 2)}
+		w.stats[pattern] = stat
+	}
+	return stat
+}
+
+func (w *PatternWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	requests := w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
+
+	w.mux.Lock()
+	for _, r := range expand(requests) {
+		cmd := r.Name()
+		for _, p := range patterns(r) {
+			stat := w.stat(p)
+			switch {
+			case common.IsWrite(cmd):
+				stat.writes++
+			case common.IsRead(cmd):
+				stat.reads++
+			default:
+				stat.others++
+			}
+			stat.bytesIn += int64(r.Size)
+		}
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+func (w *PatternWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	replies, _ := w.sessions.FetchReplies(common.RemoteKey(dstHost, dstPort), data)
+
+	w.mux.Lock()
+	for _, r := range expand(replies) {
+		latency := r.ReplyTime.Sub(r.Time).Microseconds()
+		if latency < 1 {
+			latency = 1
+		}
+		for _, p := range patterns(r) {
+			stat := w.stat(p)
+			stat.bytesOut += int64(r.Reply.Size())
+			if !r.queued {
+				_ = stat.latency.RecordValue(latency)
+			}
+		}
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+// FlowClose drops the state of the connection, a new connection on its address starts afresh.
+func (w *PatternWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+func (w *PatternWriter) report() {
+	oldTime, ok := w.period.Elapsed()
+	if !ok {
+		return
+	}
+
+	w.mux.Lock()
+	stats := w.stats
+	w.stats = map[string]*patternStat{}
+	w.mux.Unlock()
+
+	ops := func(s *patternStat) int64 { return s.reads + s.writes + s.others }
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return ops(stats[names[i]]) > ops(stats[names[j]]) })
+
+	seconds := w.period.Seconds()
+	for _, name := range names {
+		s := stats[name]
+		ratio := 0.0
+		if s.reads+s.writes > 0 {
+			ratio = float64(s.reads) / float64(s.reads+s.writes)
+		}
+		fmt.Printf("[%d]pattern:%s, qps:%.2f, read:%d, write:%d, read ratio:%.2f, bytes in:%d, bytes out:%d, latency avg:%dus p99:%dus\n",
+			oldTime, name, float64(ops(s))/seconds, s.reads, s.writes, ratio, s.bytesIn, s.bytesOut,
+			int64(s.latency.Mean()), s.latency.ValueAtQuantile(99))
+	}
+}
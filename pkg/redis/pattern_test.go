@@ -0,0 +1,31 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestKeyPattern(t *testing.T) {
+	require.Equal(t, "user:{id}:profile", KeyPattern("user:1001:profile"))
+	require.Equal(t, "session:{uuid}", KeyPattern("session:3f2504e0-4f89-11d3-9a0c-0305e82c3301"))
+	require.Equal(t, "cache:{hash}", KeyPattern("cache:d41d8cd98f00b204e9800998ecf8427e"))
+	require.Equal(t, "log.{ts}.{ts}", KeyPattern("log.1700000000.1700000000123"))
+	require.Equal(t, "feed_v2", KeyPattern("feed_v2"))
+	require.Equal(t, "deadbeef", KeyPattern("deadbeef"))
+
+	SetKeyPatterns([]string{"order:*"})
+	defer SetKeyPatterns(nil)
+	require.Equal(t, "order:*", KeyPattern("order:1:items"))
+	require.Equal(t, "user:{id}", KeyPattern("user:1"))
+}
+
+func TestPatternWriter_Other(t *testing.T) {
+	w := NewPatternWriter(time.Hour)
+	for i := 0; i < maxPatterns+10; i++ {
+		w.stat(strconv.Itoa(i)).reads++
+	}
+	require.Len(t, w.stats, maxPatterns+1)
+	require.Equal(t, int64(10), w.stats[otherPattern].reads)
+}
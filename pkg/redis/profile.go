@@ -0,0 +1,152 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxProfileValue = 1 << 30
+	maxCommands     = 1000
+	otherCommand    = "{other}"
+)
+
+var defaultProfilePercentiles = []float64{50, 99}
+
+type commandProfile struct {
+	reqSize *hdrhistogram.Histogram
+	reqLen  *hdrhistogram.Histogram
+	rspSize *hdrhistogram.Histogram
+	rspLen  *hdrhistogram.Histogram
+}
+
+func newCommandProfile() *commandProfile {
+	return &commandProfile{
+		reqSize: hdrhistogram.New(1, maxProfileValue, 2),
+		reqLen:  hdrhistogram.New(1, maxProfileValue, 2),
+		rspSize: hdrhistogram.New(1, maxProfileValue, 2),
+		rspLen:  hdrhistogram.New(1, maxProfileValue, 2),
+	}
+}
+
+// ProfileWriter profiles every command name: request bytes, argument count, reply bytes
+// and reply element count, printed as a table of percentiles every interval.
+type ProfileWriter struct {
+	sessions    *SessionMgr
+	period      *common.Period
+	percentiles []float64
+	mux         sync.Mutex
+	profiles    map[string]*commandProfile
+}
+
+func NewProfileWriter(interval time.Duration, percentiles []float64) *ProfileWriter {
+	if len(percentiles) == 0 {
+		percentiles = defaultProfilePercentiles
+	}
+	return &ProfileWriter{
+		sessions:    NewSessionMgr(true),
+		period:      common.NewPeriod(interval),
+		percentiles: percentiles,
+		profiles:    map[string]*commandProfile{},
+	}
+}
+
+func (w *ProfileWriter) profile(cmd string) *commandProfile {
+	p, ok := w.profiles[cmd]
+	if !ok {
+		// the other bucket is created even when the map is full
+		if len(w.profiles) >= maxCommands && cmd != otherCommand {
+			return w.profile(otherCommand)
+		}
+		p = newCommandProfile()
+		w.profiles[cmd] = p
+	}
+	return p
+}
+
+func (w *ProfileWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	requests := w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
+
+	w.mux.Lock()
+	for _, r := range expand(requests) {
+		p := w.profile(r.Name())
+		_ = p.reqSize.RecordValue(int64(r.Size))
+		_ = p.reqLen.RecordValue(int64(len(r.Args)))
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+func (w *ProfileWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	replies, _ := w.sessions.FetchReplies(common.RemoteKey(dstHost, dstPort), data)
+
+	w.mux.Lock()
+	for _, r := range expand(replies) {
+		if !r.Replied() {
+			continue
+		}
+		p := w.profile(r.Name())
+		_ = p.rspSize.RecordValue(int64(r.Reply.Size()))
+		_ = p.rspLen.RecordValue(replyLen(r))
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+// FlowClose drops the state of the connection, a new connection on its address starts afresh.
+func (w *ProfileWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+// cell formats the percentiles and the max of a histogram as p50/p99/max.
+func (w *ProfileWriter) cell(h *hdrhistogram.Histogram) string {
+	values := make([]string, 0, len(w.percentiles)+1)
+	for _, p := range w.percentiles {
+		values = append(values, fmt.Sprint(h.ValueAtQuantile(p)))
+	}
+	return strings.Join(append(values, fmt.Sprint(h.Max())), "/")
+}
+
+func (w *ProfileWriter) report() {
+	oldTime, ok := w.period.Elapsed()
+	if !ok {
+		return
+	}
+
+	w.mux.Lock()
+	profiles := w.profiles
+	w.profiles = map[string]*commandProfile{}
+	w.mux.Unlock()
+
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return profiles[names[i]].reqSize.TotalCount() > profiles[names[j]].reqSize.TotalCount()
+	})
+
+	header := ""
+	for _, p := range w.percentiles {
+		header += fmt.Sprintf("p%g/", p)
+	}
+	header += "max"
+	fmt.Printf("[%d]%-16s %10s %24s %24s %24s %24s\n", oldTime, "cmd", "count",
+		"req.size "+header, "req.len "+header, "rsp.size "+header, "rsp.len "+header)
+	for _, name := range names {
+		p := profiles[name]
+		fmt.Printf("[%d]%-16s %10d %24s %24s %24s %24s\n", oldTime, name, p.reqSize.TotalCount(),
+			w.cell(p.reqSize), w.cell(p.reqLen), w.cell(p.rspSize), w.cell(p.rspLen))
+	}
+}
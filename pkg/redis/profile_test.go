@@ -0,0 +1,17 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestProfileWriter_Other(t *testing.T) {
+	w := NewProfileWriter(time.Hour, nil)
+	for i := 0; i < maxCommands+10; i++ {
+		_ = w.profile("cmd" + strconv.Itoa(i)).reqLen.RecordValue(1)
+	}
+	require.Len(t, w.profiles, maxCommands+1)
+	require.Equal(t, int64(10), w.profiles[otherCommand].reqLen.TotalCount())
+}
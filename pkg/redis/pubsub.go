@@ -0,0 +1,269 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Push is a server message that does not answer a request: pub/sub messages,
+// MONITOR lines and resp3 pushes such as client tracking invalidations.
+type Push struct {
+	Kind string
+	Args []interface{} // elements of the push, []byte views for bulk values
+	Size int
+	Time time.Time
+}
+
+// pushKind returns the lowercase first element of an aggregate, such as message or invalidate.
+func pushKind(r *Resp) string {
+	if !r.IsArray() || r.Len() == 0 {
+		return ""
+	}
+	first := r.Item(0)
+	if first.IsArray() {
+		return ""
+	}
+	return strings.ToLower(common.BytesToString(first.Bytes()))
+}
+
+func pushArgs(r *Resp) []interface{} {
+	args := make([]interface{}, r.Len())
+	for i := range args {
+		item := r.Item(i)
+		args[i] = item.Value()
+	}
+	return args
+}
+
+func isSubscribeKind(kind string) bool {
+	switch kind {
+	case "subscribe", "psubscribe", "ssubscribe", "unsubscribe", "punsubscribe", "sunsubscribe":
+		return true
+	}
+	return false
+}
+
+func isMessageKind(kind string) bool {
+	switch kind {
+	case "message", "pmessage", "smessage":
+		return true
+	}
+	return false
+}
+
+type sizeStat struct {
+	count int64
+	bytes int64
+	max   int64
+}
+
+func (s *sizeStat) add(size int) {
+	s.count++
+	s.bytes += int64(size)
+	if int64(size) > s.max {
+		s.max = int64(size)
+	}
+}
+
+func (s *sizeStat) avg() int64 {
+	if s.count == 0 {
+		return 0
+	}
+	return s.bytes / s.count
+}
+
+type channelStat struct {
+	publish   sizeStat
+	receivers int64 // sum of PUBLISH replies, as counted by the server
+	delivered sizeStat
+}
+
+// PubSubWriter reports channels, subscribers, publish rates and message sizes seen on the wire.
+type PubSubWriter struct {
+	sessions    *SessionMgr
+	period      *common.Period
+	mux         sync.Mutex
+	channels    map[string]*channelStat
+	subscribers map[string]map[string]struct{} // channel or pattern -> client address
+}
+
+func NewPubSubWriter(interval time.Duration) *PubSubWriter {
+	w := &PubSubWriter{
+		sessions:    NewSessionMgr(true),
+		period:      common.NewPeriod(interval),
+		channels:    map[string]*channelStat{},
+		subscribers: map[string]map[string]struct{}{},
+	}
+	w.sessions.OnClose(w.unsubscribe)
+	return w
+}
+
+// unsubscribe removes a connection from every channel and pattern, once it is gone.
+func (w *PubSubWriter) unsubscribe(address string) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	for name, clients := range w.subscribers {
+		delete(clients, address)
+		if len(clients) == 0 {
+			delete(w.subscribers, name)
+		}
+	}
+}
+
+func (w *PubSubWriter) channel(name string) *channelStat {
+	c, ok := w.channels[name]
+	if !ok {
+		c = &channelStat{}
+		w.channels[name] = c
+	}
+	return c
+}
+
+// subscription keys patterns and shard channels apart from channels of the same name.
+func subscription(cmd string, name string) string {
+	switch cmd {
+	case "psubscribe", "punsubscribe":
+		return "pattern:" + name
+	case "ssubscribe", "sunsubscribe":
+		return "shard:" + name
+	}
+	return "channel:" + name
+}
+
+func (w *PubSubWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	address := common.RemoteKey(srcHost, srcPort)
+	requests := w.sessions.FetchRequests(address, data)
+	if len(requests) == 0 {
+		return nil
+	}
+
+	w.mux.Lock()
+	for _, r := range requests {
+		cmd := r.Name()
+		switch cmd {
+		case "publish", "spublish":
+			if len(r.Args) == 3 {
+				w.channel(r.Args[1].(string)).publish.add(len(r.Args[2].(string)))
+			}
+		case "subscribe", "psubscribe", "ssubscribe":
+			for _, v := range r.Args[1:] {
+				name := subscription(cmd, v.(string))
+				if _, ok := w.subscribers[name]; !ok {
+					w.subscribers[name] = map[string]struct{}{}
+				}
+				w.subscribers[name][address] = struct{}{}
+			}
+		case "unsubscribe", "punsubscribe", "sunsubscribe":
+			if len(r.Args) == 1 {
+				prefix := subscription(cmd, "")
+				for name, clients := range w.subscribers {
+					if strings.HasPrefix(name, prefix) {
+						delete(clients, address)
+					}
+				}
+			}
+			for _, v := range r.Args[1:] {
+				delete(w.subscribers[subscription(cmd, v.(string))], address)
+			}
+		}
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+func (w *PubSubWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	replies, pushes := w.sessions.FetchReplies(common.RemoteKey(dstHost, dstPort), data)
+
+	w.mux.Lock()
+	for _, r := range replies {
+		switch r.Name() {
+		case "publish", "spublish":
+			if len(r.Args) != 3 || r.Reply.Type() != ':' {
+				continue
+			}
+			n, err := common.Btoi(r.Reply.Bytes())
+			if err == nil {
+				w.channel(r.Args[1].(string)).receivers += int64(n)
+			}
+		}
+	}
+	for _, p := range pushes {
+		var channel, payload interface{}
+		switch {
+		case (p.Kind == "message" || p.Kind == "smessage") && len(p.Args) == 3:
+			channel, payload = p.Args[1], p.Args[2]
+		case p.Kind == "pmessage" && len(p.Args) == 4:
+			channel, payload = p.Args[2], p.Args[3]
+		default:
+			continue
+		}
+		name, ok := channel.([]byte)
+		if !ok {
+			continue
+		}
+		body, _ := payload.([]byte)
+		w.channel(string(name)).delivered.add(len(body))
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+// FlowClose drops the state and the subscriptions of the connection.
+func (w *PubSubWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+func (w *PubSubWriter) report() {
+	oldTime, ok := w.period.Elapsed()
+	if !ok {
+		return
+	}
+
+	w.mux.Lock()
+	channels := w.channels
+	w.channels = map[string]*channelStat{}
+	subscribers := map[string]int{}
+	for name, clients := range w.subscribers {
+		if len(clients) == 0 {
+			delete(w.subscribers, name)
+			continue
+		}
+		subscribers[name] = len(clients)
+	}
+	w.mux.Unlock()
+
+	names := make([]string, 0, len(channels))
+	for name := range channels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	seconds := w.period.Seconds()
+	for _, name := range names {
+		c := channels[name]
+		fmt.Printf("[%d]channel:%s, subscribers:%d, publish:%d(%.2f/s), receivers:%d, publish size avg:%d max:%d, delivered:%d, delivered size avg:%d max:%d\n",
+			oldTime, name, subscribers["channel:"+name]+subscribers["shard:"+name],
+			c.publish.count, float64(c.publish.count)/seconds, c.receivers, c.publish.avg(), c.publish.max,
+			c.delivered.count, c.delivered.avg(), c.delivered.max)
+	}
+
+	names = names[:0]
+	for name := range subscribers {
+		if strings.HasPrefix(name, "pattern:") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("[%d]%s, subscribers:%d\n", oldTime, name, subscribers[name])
+	}
+}
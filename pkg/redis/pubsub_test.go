@@ -0,0 +1,28 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPubSubWriter_Close(t *testing.T) {
+	w := NewPubSubWriter(time.Hour)
+	host := net.ParseIP("127.0.0.1")
+	subscribe := []byte("*2\r\n$9\r\nsubscribe\r\n$1\r\na\r\n*2\r\n$10\r\npsubscribe\r\n$2\r\nb*\r\n")
+	require.NoError(t, w.FlowIn(host, 1000, subscribe))
+	require.NoError(t, w.FlowIn(host, 1001, subscribe))
+	require.Len(t, w.subscribers["channel:a"], 2)
+
+	// a closed connection is no longer a subscriber
+	w.FlowClose(host, 1000)
+	require.Len(t, w.subscribers["channel:a"], 1)
+	require.Len(t, w.subscribers["pattern:b*"], 1)
+
+	// nor is a quarantined one
+	for i := 0; i < maxDecodeErrors; i++ {
+		require.NoError(t, w.FlowIn(host, 1001, []byte("*1\r\n$x\r\n")))
+	}
+	require.Len(t, w.subscribers, 0)
+}
@@ -0,0 +1,329 @@
+package redis
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const redacted = "******"
+
+const (
+	RedactMask = iota
+	RedactHash
+	RedactTruncate
+)
+
+// RedactRule rewrites the values of matching commands. Without Pos, a rule applies to
+// every argument that is not a key.
+type RedactRule struct {
+	Action int
+	Len    int            // bytes kept by RedactTruncate
+	Cmd    string         // lower case command name, empty matches all
+	Key    *regexp.Regexp // the first key must match, nil matches all
+	Pos    int            // argument position, 0 means all values
+}
+
+// ParseRedactRules parses rules separated by ';', each one is an action followed by selectors:
+//
+//	mask|hash|truncate=<n> [cmd=<name>] [key=<glob>] [pos=<n>]
+//
+// eg: "hash cmd=set pos=2;truncate=8 key=session:*"
+func ParseRedactRules(s string) ([]RedactRule, error) {
+	var rules []RedactRule
+	for _, text := range strings.Split(s, ";") {
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		var rule RedactRule
+		switch action := fields[0]; {
+		case action == "mask":
+			rule.Action = RedactMask
+		case action == "hash":
+			rule.Action = RedactHash
+		case strings.HasPrefix(action, "truncate="):
+			n, err := strconv.Atoi(action[len("truncate="):])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid redact action:%s", action)
+			}
+			rule.Action = RedactTruncate
+			rule.Len = n
+		default:
+			return nil, fmt.Errorf("invalid redact action:%s", action)
+		}
+		for _, f := range fields[1:] {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid redact selector:%s", f)
+			}
+			switch kv[0] {
+			case "cmd":
+				rule.Cmd = strings.ToLower(kv[1])
+			case "key":
+				rule.Key = GlobToRegexp(kv[1])
+			case "pos":
+				n, err := strconv.Atoi(kv[1])
+				if err != nil || n <= 0 {
+					return nil, fmt.Errorf("invalid redact position:%s", kv[1])
+				}
+				rule.Pos = n
+			default:
+				return nil, fmt.Errorf("invalid redact selector:%s", f)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// GlobToRegexp converts a redis style glob pattern (*, ?, [...] and [^...]) to an anchored regexp.
+func GlobToRegexp(glob string) *regexp.Regexp {
+	buff := strings.Builder{}
+	buff.WriteString("(?s)^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			buff.WriteString(".*")
+		case '?':
+			buff.WriteString(".")
+		case '[':
+			if j := setEnd(glob, i+1); j >= 0 {
+				buff.WriteString(globSet(glob[i+1 : j]))
+				i = j
+				break
+			}
+			buff.WriteString("\\[")
+		case '\\':
+			if i+1 < len(glob) {
+				i++
+				buff.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+			}
+		default:
+			buff.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buff.WriteString("$")
+	return regexp.MustCompile(buff.String())
+}
+
+// setEnd returns the position of the ] closing a set which starts at pos, -1 if there is none.
+func setEnd(glob string, pos int) int {
+	for i := pos; i < len(glob); i++ {
+		switch glob[i] {
+		case '\\':
+			i++
+		case ']':
+			return i
+		}
+	}
+	return -1
+}
+
+// globSet converts the inside of a glob [...] to a regexp class, like stringmatch: a
+// leading ^ negates it, \ escapes a character and reversed ranges are accepted.
+func globSet(set string) string {
+	quote := func(c byte) string {
+		return fmt.Sprintf("\\x{%x}", c)
+	}
+	buff := strings.Builder{}
+	buff.WriteString("[")
+	if strings.HasPrefix(set, "^") {
+		buff.WriteString("^")
+		set = set[1:]
+	}
+	if set == "" {
+		// an empty set matches nothing, its negation anything
+		if buff.Len() == 2 {
+			return "(?s:.)"
+		}
+		return "[^\\x00-\\x{10FFFF}]"
+	}
+	for i := 0; i < len(set); i++ {
+		c := set[i]
+		if c == '\\' && i+1 < len(set) {
+			i++
+			c = set[i]
+		}
+		if i+2 < len(set) && set[i+1] == '-' {
+			end := set[i+2]
+			i += 2
+			if end < c {
+				c, end = end, c
+			}
+			buff.WriteString(quote(c) + "-" + quote(end))
+			continue
+		}
+		buff.WriteString(quote(c))
+	}
+	buff.WriteString("]")
+	return buff.String()
+}
+
+func (r *RedactRule) apply(v string) string {
+	switch r.Action {
+	case RedactHash:
+		sum := sha256.Sum256(common.StringsToBytes(v))
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	case RedactTruncate:
+		if len(v) > r.Len {
+			return v[:r.Len]
+		}
+		return v
+	}
+	return redacted
+}
+
+// credentials returns the positions of passwords in a command.
+func credentials(cmd string, args []interface{}) (idx []int) {
+	arg := func(i int) string {
+		return strings.ToLower(args[i].(string))
+	}
+	switch cmd {
+	case "auth":
+		if len(args) > 1 {
+			idx = append(idx, len(args)-1)
+		}
+	case "hello", "migrate":
+		for i := 1; i < len(args); i++ {
+			switch arg(i) {
+			case "auth":
+				if cmd == "hello" {
+					// HELLO protover AUTH username password
+					i++
+				}
+				if i+1 < len(args) {
+					idx = append(idx, i+1)
+				}
+			case "auth2":
+				if i+2 < len(args) {
+					idx = append(idx, i+2)
+				}
+			}
+		}
+	case "config":
+		if len(args) > 2 && arg(1) == "set" {
+			for i := 2; i+1 < len(args); i += 2 {
+				switch arg(i) {
+				case "requirepass", "masterauth", "tls-key-file-pass", "tls-client-key-file-pass":
+					idx = append(idx, i+1)
+				}
+			}
+		}
+	case "acl":
+		if len(args) > 2 && arg(1) == "setuser" {
+			for i := 3; i < len(args); i++ {
+				if s := args[i].(string); len(s) > 0 && (s[0] == '>' || s[0] == '<' || s[0] == '#' || s[0] == '!') {
+					idx = append(idx, i)
+				}
+			}
+		}
+	}
+	return
+}
+
+// Redact masks credentials and applies the rules to a copy of the arguments.
+// The arguments are returned as is when nothing is changed.
+func Redact(rules []RedactRule, args []interface{}) []interface{} {
+	if len(args) == 0 {
+		return args
+	}
+	cmd := strings.ToLower(args[0].(string))
+	ret := args
+	set := func(i int, v string) {
+		if v == ret[i].(string) {
+			return
+		}
+		if &ret[0] == &args[0] {
+			ret = append([]interface{}(nil), args...)
+		}
+		ret[i] = v
+	}
+	for _, i := range credentials(cmd, args) {
+		set(i, redacted)
+	}
+	if len(rules) == 0 {
+		return ret
+	}
+
+	// keys are told apart from values by their position, a value may equal a key
+	keys := map[int]struct{}{}
+	firstKey := ""
+	for _, i := range common.KeyPositions(cmd, args) {
+		if len(keys) == 0 {
+			firstKey = args[i].(string)
+		}
+		keys[i] = struct{}{}
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if rule.Cmd != "" && rule.Cmd != cmd {
+			continue
+		}
+		if rule.Key != nil && !rule.Key.MatchString(firstKey) {
+			continue
+		}
+		if rule.Pos > 0 {
+			if rule.Pos < len(ret) {
+				set(rule.Pos, rule.apply(ret[rule.Pos].(string)))
+			}
+			continue
+		}
+		for j := 1; j < len(ret); j++ {
+			if _, ok := keys[j]; !ok {
+				set(j, rule.apply(ret[j].(string)))
+			}
+		}
+	}
+	return ret
+}
+
+// RedactWriter sits in front of another writer and hands it requests with credentials
+// masked and the redact rules applied, so that the writers printing commands do not output
+// sensitive values. The requests are encoded again, the sizes the writer sees are those of
+// the redacted requests, not of the bytes on the wire.
+type RedactWriter struct {
+	wr       common.Writer
+	rules    []RedactRule
+	sessions *SessionMgr
+}
+
+func NewRedactWriter(wr common.Writer, rules []RedactRule) *RedactWriter {
+	return &RedactWriter{wr: wr, rules: rules, sessions: NewSessionMgr(false)}
+}
+
+func (w *RedactWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	// decode without grouping transactions, replies are passed on as they come
+	// and must not overtake their requests
+	requests := w.sessions.AppendAndFetch(common.RemoteKey(srcHost, srcPort), data, true)
+	if len(requests) == 0 {
+		return nil
+	}
+
+	var buff []byte
+	for _, r := range requests {
+		args, ok := r.Value().([]interface{})
+		if !ok {
+			continue
+		}
+		buff = AppendRequest(buff, Redact(w.rules, args))
+	}
+	return w.wr.FlowIn(srcHost, srcPort, buff)
+}
+
+func (w *RedactWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	return w.wr.FlowOut(dstHost, dstPort, data)
+}
+
+func (w *RedactWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+	if c, ok := w.wr.(common.CloseWriter); ok {
+		c.FlowClose(host, port)
+	}
+}
@@ -0,0 +1,63 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	args := func(s ...string) []interface{} {
+		ret := make([]interface{}, 0, len(s))
+		for _, v := range s {
+			ret = append(ret, v)
+		}
+		return ret
+	}
+
+	t.Run("credentials", func(t *testing.T) {
+		require.Equal(t, args("AUTH", redacted), Redact(nil, args("AUTH", "secret")))
+		require.Equal(t, args("auth", "user", redacted), Redact(nil, args("auth", "user", "secret")))
+		require.Equal(t, args("hello", "3", "AUTH", "user", redacted, "SETNAME", "app"),
+			Redact(nil, args("hello", "3", "AUTH", "user", "secret", "SETNAME", "app")))
+		require.Equal(t, args("migrate", "h", "6379", "", "0", "100", "AUTH2", "user", redacted, "KEYS", "a"),
+			Redact(nil, args("migrate", "h", "6379", "", "0", "100", "AUTH2", "user", "secret", "KEYS", "a")))
+		require.Equal(t, args("config", "set", "requirepass", redacted, "maxmemory", "1gb"),
+			Redact(nil, args("config", "set", "requirepass", "secret", "maxmemory", "1gb")))
+		require.Equal(t, args("acl", "setuser", "u", "on", redacted, "~*"),
+			Redact(nil, args("acl", "setuser", "u", "on", ">secret", "~*")))
+	})
+
+	t.Run("rules", func(t *testing.T) {
+		rules, err := ParseRedactRules("hash cmd=set pos=2; truncate=2 key=session:*")
+		require.NoError(t, err)
+		src := args("set", "k", "value")
+		require.Equal(t, args("set", "k", "sha256:cd42404d52ad55cc"), Redact(rules, src))
+		require.Equal(t, args("set", "k", "value"), src)
+		require.Equal(t, args("hset", "session:1", "fi", "va"), Redact(rules, args("hset", "session:1", "field", "value")))
+		require.Equal(t, args("hset", "user:1", "field", "value"), Redact(rules, args("hset", "user:1", "field", "value")))
+		// a value equal to a key is still a value
+		require.Equal(t, args("mset", "session:a", "se", "b", "b"), Redact(rules, args("mset", "session:a", "session:a", "b", "b")))
+
+		_, err = ParseRedactRules("drop cmd=set")
+		require.Error(t, err)
+	})
+
+	t.Run("glob", func(t *testing.T) {
+		for glob, cases := range map[string]map[string]bool{
+			"user:*":    {"user:1": true, "user:\n": true, "order:1": false},
+			"h?llo":     {"hello": true, "hllo": false},
+			"h[ae]llo":  {"hallo": true, "hillo": false},
+			"h[^e]llo":  {"hallo": true, "hello": false, "h^llo": true},
+			"h[z-a]llo": {"hello": true, "h-llo": false},
+			"h[\\]]llo": {"h]llo": true, "hallo": false},
+			"h[]llo":    {"hllo": false, "hallo": false},
+			"h\\*":      {"h*": true, "ha": false},
+			"[":         {"[": true},
+		} {
+			re := GlobToRegexp(glob)
+			for s, match := range cases {
+				require.Equal(t, match, re.MatchString(s), "%s %s", glob, s)
+			}
+		}
+	})
+}
@@ -1,13 +1,11 @@
 package redis
 
 import (
-	"context"
 	"fmt"
 	"github.com/HdrHistogram/hdrhistogram-go"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/morningli/packet_monitor/pkg/common"
-	"github.com/redis/go-redis/v9"
 	log "github.com/sirupsen/logrus"
 	"net"
 	"os"
@@ -18,12 +16,6 @@ import (
 	"time"
 )
 
-var (
-	runningWrite int64
-	success      uint64
-	fail         uint64
-)
-
 type Monitor struct {
 	localHost net.IP
 	localPort layers.TCPPort
@@ -60,17 +52,17 @@ func (r *Monitor) Feed(packet gopacket.Packet) {
 		if r.wr != nil {
 			err := r.wr.FlowIn(ip.SrcIP, tcp.SrcPort, tcpLayer.LayerPayload())
 			if err != nil {
-				log.Fatal(err)
+				log.Errorf("[%s:%d]write request fail:%s", ip.SrcIP, tcp.SrcPort, err)
 			}
 			return
 		}
 	}
 }
 
+// NetworkWriter replays the captured requests on another node or cluster, every client
+// connection on its own ordered queue of the target, after the replay rules.
 type NetworkWriter struct {
-	address  string
-	cluster  bool
-	client   redis.UniversalClient
+	target   *RulesTarget
 	sessions *SessionMgr
 }
 
@@ -79,262 +71,156 @@ func (w *NetworkWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []b
 	return nil
 }
 
-func NewNetworkWriter(address string, cluster bool) *NetworkWriter {
-	w := &NetworkWriter{address: address, cluster: cluster, sessions: NewSessionMgr()}
-	if cluster {
-		w.client = redis.NewClusterClient(&redis.ClusterOptions{
-			Addrs:          strings.Split(w.address, ","),
-			PoolSize:       400,
-			MaxActiveConns: 400,
-			MaxRetries:     -1,
-			MinIdleConns:   10,
-			MaxIdleConns:   10,
-		})
-	} else {
-		w.client = redis.NewClient(&redis.Options{
-			Addr:           w.address,
-			PoolSize:       400,
-			MaxActiveConns: 400,
-			MaxRetries:     -1,
-			MinIdleConns:   10,
-			MaxIdleConns:   10,
-		})
-	}
+func NewNetworkWriter(address string, cluster bool, rules []ReplayRule) *NetworkWriter {
+	w := &NetworkWriter{target: NewRulesTarget(NewTarget(address, cluster), rules), sessions: NewSessionMgr(false)}
 	go func() {
 		for {
 			time.Sleep(time.Second * 300)
-			log.Infof("[Stats]running write:%d,success request:%d,fail:%d",
-				atomic.LoadInt64(&runningWrite),
-				atomic.LoadUint64(&success),
-				atomic.LoadUint64(&fail))
+			LogTargetStats()
 		}
 	}()
 	return w
 }
 
 func (w *NetworkWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
-	requests := w.sessions.AppendAndFetch(common.RemoteKey(srcHost, srcPort), data, true)
-	if len(requests) == 0 {
-		return nil
-	}
-
-	go func() {
-		atomic.AddInt64(&runningWrite, 1)
-		for _, r := range requests {
-			args, ok := r.Value().([]interface{})
-			if !ok {
-				continue
-			}
-			err := w.client.Do(context.Background(), args...).Err()
-			if err != nil && err != redis.Nil {
-				log.Errorf("execute command fail.args:%+v,err:%s", args, err)
-				atomic.AddUint64(&fail, 1)
-			} else {
-				atomic.AddUint64(&success, 1)
+	address := common.RemoteKey(srcHost, srcPort)
+	requests := w.sessions.FetchRequests(address, data)
+	for _, r := range requests {
+		// the arguments point into the session buffer until retained
+		r.Retain()
+		if r.Tx != nil {
+			w.target.Send(address, r.Tx.Multi.Args)
+			for _, c := range r.Tx.Commands {
+				w.target.Send(address, c.Args)
 			}
 		}
-		atomic.AddInt64(&runningWrite, -1)
-	}()
-
+		w.target.Send(address, r.Args)
+	}
 	return nil
 }
 
+// FlowClose closes the connection of the client on the target once its commands are sent.
+func (w *NetworkWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	address := common.RemoteKey(host, port)
+	w.sessions.Close(address)
+	w.target.CloseClient(address)
+}
+
 type FileWriter struct {
 	f        *os.File
+	server   string
 	sessions *SessionMgr
 }
 
+// FlowOut pairs replies with requests, so that aborted transactions are counted.
 func (w *FileWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
-	// ignore
+	_, _ = w.sessions.FetchReplies(common.RemoteKey(dstHost, dstPort), data)
 	return nil
 }
 
-func NewFileWriter(f *os.File) *FileWriter {
-	return &FileWriter{f: f, sessions: NewSessionMgr()}
+// FlowClose drops the state of the connection, a new connection on its address starts afresh.
+func (w *FileWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+func NewFileWriter(f *os.File, server string) *FileWriter {
+	go func() {
+		for {
+			time.Sleep(time.Second * 300)
+			log.Infof("[Stats]transaction exec:%d,aborted:%d,discard:%d",
+				atomic.LoadUint64(&txExec),
+				atomic.LoadUint64(&txAborted),
+				atomic.LoadUint64(&txDiscard))
+		}
+	}()
+	return &FileWriter{f: f, server: server, sessions: NewSessionMgr(true)}
 }
 
 func (w *FileWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
-	requests := w.sessions.AppendAndFetch(common.RemoteKey(srcHost, srcPort), data, true)
+	requests := w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
 	if len(requests) == 0 {
 		return nil
 	}
 
 	for _, r := range requests {
-		buff := strings.Builder{}
-		buff.Write(strconv.AppendFloat(nil, float64(time.Now().UnixMicro())/1e6, 'f', 6, 64))
-		buff.WriteString(" [0 ")
-		buff.WriteString(srcHost.String())
-		buff.WriteString(":")
-		buff.WriteString(srcPort.String())
-		buff.WriteString("]")
-
-		args, ok := r.Value().([]interface{})
-		if !ok {
-			continue
-		}
-		for _, v := range args {
-			buff.WriteString(" \"")
-			buff.WriteString(v.(string))
-			buff.WriteString("\"")
+		var buff []byte
+		if r.Tx != nil {
+			// print the whole transaction at once, so it is not interleaved with other clients
+			buff = appendCommand(buff, r.Tx.Multi, w.server)
+			for _, c := range r.Tx.Commands {
+				buff = appendCommand(buff, c, w.server)
+			}
 		}
+		buff = appendCommand(buff, r, w.server)
 
-		_, err := fmt.Fprintln(w.f, buff.String())
+		_, err := w.f.Write(buff)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 	}
 	return nil
 }
 
-type CountWriter struct {
-	sessions *SessionMgr
-	wCounts  [2]sync.Map
-	rCounts  [2]sync.Map
-	min      int64
-	pos      int64
-	mtime    int64
-}
-
-func (w *CountWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
-	// ignore
-	return nil
-}
-
-func NewCountWriter(minCount int) *CountWriter {
-	return &CountWriter{min: int64(minCount), mtime: time.Now().UnixMicro(), sessions: NewSessionMgr()}
-}
-
-func (w *CountWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
-	requests := w.sessions.AppendAndFetch(common.RemoteKey(srcHost, srcPort), data, true)
-	if len(requests) == 0 {
-		return nil
-	}
-
-	const statTime = 1000000
-
-	for _, r := range requests {
-		args, ok := r.Value().([]interface{})
-		if !ok {
-			continue
-		}
-		if len(args) != 2 {
-			continue
-		}
-		cmd := strings.ToLower(args[0].(string))
-		key := common.GetFirstKey(cmd, args)
-		write := common.IsWrite(cmd)
-
-		if len(key) == 0 {
-			continue
-		}
-
-		var c *sync.Map
-		if write {
-			c = &w.wCounts[atomic.LoadInt64(&w.pos)]
-		} else {
-			c = &w.rCounts[atomic.LoadInt64(&w.pos)]
-		}
-		var count int64 = 1
-		ic, ok := c.LoadOrStore(key, &count)
-		if ok {
-			cc := ic.(*int64)
-			atomic.AddInt64(cc, 1)
-		}
-	}
-
-	oldTime := atomic.LoadInt64(&w.mtime)
-	if time.Now().UnixMicro()-oldTime < statTime {
-		return nil
+func appendCommand(buff []byte, cmd *Command, server string) []byte {
+	micro := cmd.Time.UnixMicro()
+	buff = strconv.AppendInt(buff, micro/1e6, 10)
+	buff = append(buff, '.')
+	frac := strconv.AppendInt(nil, micro%1e6+1e6, 10)
+	buff = append(buff, frac[1:]...)
+	buff = append(buff, " ["...)
+	buff = strconv.AppendInt(buff, int64(cmd.DB), 10)
+	buff = append(buff, ' ')
+	// the address as MONITOR writes it, whatever the grouping of the other outputs
+	buff = append(buff, cmd.Client.Addr...)
+	if server != "" {
+		buff = append(buff, ' ')
+		buff = append(buff, server...)
 	}
-
-	ok := atomic.CompareAndSwapInt64(&w.mtime, oldTime, time.Now().UnixMicro())
-	if !ok {
-		return nil
+	if groupByName && cmd.Client.Name != "" && strings.IndexByte(cmd.Client.Name, ']') < 0 {
+		// names have no spaces, those closing the field are left out
+		buff = append(buff, " name="...)
+		buff = append(buff, cmd.Client.Name...)
 	}
+	buff = append(buff, ']')
 
-	p := atomic.LoadInt64(&w.pos)
-	np := (p + 1) & 0x1
-	ok = atomic.CompareAndSwapInt64(&w.pos, p, np)
-	if !ok {
-		return nil
+	for _, v := range cmd.Args {
+		buff = append(buff, ' ')
+		buff = common.AppendRepr(buff, v.(string))
 	}
-
-	w.rCounts[p].Range(func(key, value interface{}) bool {
-		c := value.(*int64)
-		if *c >= w.min {
-			fmt.Printf("[%d]read key:%s, freq:%d\n", oldTime, key, *c)
-		}
-		w.rCounts[p].Delete(key)
-		return ok
-	})
-
-	w.wCounts[p].Range(func(key, value interface{}) bool {
-		c := value.(*int64)
-		if *c >= w.min {
-			fmt.Printf("[%d]write key:%s, freq:%d\n", oldTime, key, *c)
-		}
-		w.wCounts[p].Delete(key)
-		return ok
-	})
-
-	return nil
+	return append(buff, '\n')
 }
 
 type HistogramWriter struct {
-	sessions  *SessionMgr
-	mux       sync.RWMutex
-	histogram *hdrhistogram.WindowedHistogram
-	mtime     int64
-	target    [2]string
-	f         func(rsp Resp) int64
+	sessions   *SessionMgr
+	mux        sync.Mutex
+	histograms map[string]*hdrhistogram.WindowedHistogram // by client name when grouping by name
+	minValue   int64
+	maxValue   int64
+	mtime      int64
+	target     [2]string
+	f          func(cmd *Command) int64
 }
 
 func (w *HistogramWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
-	const statTime = 300000000
-
-	if w.target[0] != "rsp" {
+	// replies are paired with requests in both cases, so that clients are known
+	replies, _ := w.sessions.FetchReplies(common.RemoteKey(dstHost, dstPort), data)
+	if w.target[0] != "rsp" || len(replies) == 0 {
 		return nil
 	}
-
-	requests := w.sessions.AppendAndFetch(common.RemoteKey(dstHost, dstPort), data, false)
-	if len(requests) == 0 {
-		return nil
-	}
-
-	w.mux.RLock()
-	for _, r := range requests {
-		err := w.histogram.Current.RecordValue(w.f(r))
-		if err != nil {
-			log.Errorf("stat req size fail, err:%s", err.Error())
-		}
-	}
-	w.mux.RUnlock()
-
-	oldTime := atomic.LoadInt64(&w.mtime)
-	if time.Now().UnixMicro()-oldTime < statTime {
-		return nil
-	}
-
-	ok := atomic.CompareAndSwapInt64(&w.mtime, oldTime, time.Now().UnixMicro())
-	if !ok {
-		return nil
-	}
-
-	w.mux.RLock()
-	results := w.histogram.Merge().ValueAtPercentiles([]float64{90, 95, 99})
-	w.mux.RUnlock()
-
-	w.mux.Lock()
-	w.histogram.Rotate()
-	w.mux.Unlock()
-
-	for p, r := range results {
-		fmt.Printf("[%d]rsp.size %.2f%%:%d\n", oldTime, p, r)
-	}
+	w.record(expand(replies))
 	return nil
 }
 
-const bucketNum = 10
+// FlowClose drops the state of the connection, a new connection on its address starts afresh.
+func (w *HistogramWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+const (
+	bucketNum = 10
+	// maxHistogramLabels bounds the clients with their own histogram, the others share one
+	maxHistogramLabels = 1000
+)
 
 func NewHistogramWriter(minValue, maxValue int64, target string) *HistogramWriter {
 	params := strings.Split(target, ".")
@@ -343,78 +229,109 @@ func NewHistogramWriter(minValue, maxValue int64, target string) *HistogramWrite
 		log.Fatalf("histogram target invalid:%s", target)
 	}
 	h := &HistogramWriter{
-		target:    [2]string{params[0], params[1]},
-		histogram: hdrhistogram.NewWindowed(bucketNum, minValue, maxValue, 2),
-		sessions:  NewSessionMgr(),
-		mtime:     time.Now().UnixMicro(),
+		target:     [2]string{params[0], params[1]},
+		histograms: map[string]*hdrhistogram.WindowedHistogram{},
+		minValue:   minValue,
+		maxValue:   maxValue,
+		sessions:   NewSessionMgr(params[0] == "rsp"),
+		mtime:      time.Now().UnixMicro(),
 	}
-	switch params[1] {
-	case "size":
-		h.f = func(rsp Resp) int64 {
-			return int64(rsp.Size())
+	switch target {
+	case "req.size":
+		h.f = func(cmd *Command) int64 {
+			return int64(cmd.Size)
 		}
-	case "len":
-		h.f = func(rsp Resp) int64 {
-			a := rsp.Value()
-			switch b := a.(type) {
-			case nil:
-				return 0
-			case []byte:
-				return 1
-			case []interface{}:
-				return int64(len(b))
-			default:
-				log.Fatalf("unknown respond:(%T)%+v", a, a)
-			}
-			return 0
+	case "req.len":
+		h.f = func(cmd *Command) int64 {
+			return int64(len(cmd.Args))
 		}
+	case "rsp.size":
+		h.f = func(cmd *Command) int64 {
+			return int64(cmd.Reply.Size())
+		}
+	case "rsp.len":
+		h.f = replyLen
 	default:
 		log.Fatalf("histogram target invalid:%s", target)
 	}
 	return h
 }
 
-func (w *HistogramWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
-	const statTime = 300000000
-
-	if w.target[0] != "req" {
-		return nil
+// replyLen is the number of elements of a reply: 0 for nil, 1 for a single value.
+func replyLen(cmd *Command) int64 {
+	switch {
+	case cmd.Reply.Null():
+		return 0
+	case cmd.Reply.IsArray():
+		return int64(cmd.Reply.Len())
 	}
+	return 1
+}
 
-	requests := w.sessions.AppendAndFetch(common.RemoteKey(srcHost, srcPort), data, true)
-	if len(requests) == 0 {
+func (w *HistogramWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	requests := w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
+	if w.target[0] != "req" || len(requests) == 0 {
 		return nil
 	}
+	w.record(expand(requests))
+	return nil
+}
 
-	w.mux.RLock()
-	for _, r := range requests {
-		err := w.histogram.Current.RecordValue(w.f(r))
+func (w *HistogramWriter) record(cmds []*Command) {
+	const statTime = 300000000
+
+	w.mux.Lock()
+	for _, r := range cmds {
+		label := ""
+		if groupByName {
+			label = r.Client.Label()
+		}
+		histogram, ok := w.histograms[label]
+		if !ok && len(w.histograms) >= maxHistogramLabels {
+			label = otherPattern
+			histogram, ok = w.histograms[label]
+		}
+		if !ok {
+			histogram = hdrhistogram.NewWindowed(bucketNum, w.minValue, w.maxValue, 2)
+			w.histograms[label] = histogram
+		}
+		err := histogram.Current.RecordValue(w.f(r))
 		if err != nil {
-			log.Errorf("stat req size fail, err:%s", err.Error())
+			log.Errorf("stat %s fail, err:%s", strings.Join(w.target[:], "."), err.Error())
 		}
 	}
-	w.mux.RUnlock()
+	w.mux.Unlock()
 
 	oldTime := atomic.LoadInt64(&w.mtime)
 	if time.Now().UnixMicro()-oldTime < statTime {
-		return nil
+		return
 	}
 
 	ok := atomic.CompareAndSwapInt64(&w.mtime, oldTime, time.Now().UnixMicro())
 	if !ok {
-		return nil
+		return
 	}
 
-	w.mux.RLock()
-	results := w.histogram.Merge().ValueAtPercentiles([]float64{90, 95, 99})
-	w.mux.RUnlock()
-
+	results := map[string]map[float64]int64{}
 	w.mux.Lock()
-	w.histogram.Rotate()
+	for label, histogram := range w.histograms {
+		merged := histogram.Merge()
+		if merged.TotalCount() == 0 {
+			// idle for all the windows, like the clients of closed connections
+			delete(w.histograms, label)
+			continue
+		}
+		results[label] = merged.ValueAtPercentiles([]float64{90, 95, 99})
+		histogram.Rotate()
+	}
 	w.mux.Unlock()
 
-	for p, r := range results {
-		fmt.Printf("[%d]req.size %.2f%%:%d\n", oldTime, p, r)
+	for label, result := range results {
+		if label != "" {
+			label = "client:" + label + ", "
+		}
+		for p, r := range result {
+			fmt.Printf("[%d]%s%s.%s %.2f%%:%d\n", oldTime, label, w.target[0], w.target[1], p, r)
+		}
 	}
-	return nil
 }
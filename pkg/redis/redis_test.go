@@ -0,0 +1,27 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/require"
+	"strconv"
+	"testing"
+)
+
+func TestHistogramWriter_Labels(t *testing.T) {
+	SetGroupByName(true)
+	defer SetGroupByName(false)
+	w := NewHistogramWriter(1, 1<<20, "req.len")
+	var cmds []*Command
+	for i := 0; i < maxHistogramLabels+10; i++ {
+		cmds = append(cmds, &Command{Args: []interface{}{"ping"}, Client: ClientInfo{Addr: "10.0.0.1:1", Name: "app" + strconv.Itoa(i)}})
+	}
+	w.record(cmds)
+	require.Len(t, w.histograms, maxHistogramLabels+1)
+	require.Equal(t, int64(10), w.histograms[otherPattern].Current.TotalCount())
+
+	// labels without commands in any window are dropped
+	for i := 0; i <= bucketNum; i++ {
+		w.mtime = 0
+		w.record(nil)
+	}
+	require.Len(t, w.histograms, 0)
+}
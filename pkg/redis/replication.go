@@ -0,0 +1,368 @@
+package redis
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// states of a connection seen from the master
+const (
+	replHandshake = iota // PING, AUTH and REPLCONF before PSYNC
+	replSync             // PSYNC/SYNC sent, waiting for +FULLRESYNC or +CONTINUE
+	replRDB              // waiting for the header of the rdb bulk
+	replRDBBody          // rdb transfer
+	replStream           // propagated commands
+	replClient           // not a replica, ignored
+)
+
+const (
+	maxReplLine = 1024
+	replTimeout = time.Minute * 30
+)
+
+type replica struct {
+	state    int
+	in       *Decoder
+	out      *Decoder
+	line     []byte // line of the sync phase, may span packets
+	replID   string
+	psync    int64 // offset requested by PSYNC
+	rdbLeft  int   // -1 for a diskless transfer, which ends with mark
+	mark     []byte
+	tail     []byte // last bytes of a diskless transfer, the mark may span packets
+	rdbSize  int
+	rdbStart time.Time
+	offset   int64 // replication offset after the last propagated command
+	ack      int64 // offset of the last REPLCONF ACK
+	ackTime  time.Time
+	lastTime time.Time
+}
+
+// ReplicationWriter follows the connections between a master and its replicas: the sync
+// handshake, the rdb transfer, the propagated commands and the offsets acknowledged by
+// the replicas. The monitored address is the master.
+type ReplicationWriter struct {
+	period   *common.Period
+	mux      sync.Mutex
+	replicas map[string]*replica
+	offset   int64 // highest offset propagated, so that the stream is counted once for all replicas
+	commands map[string]*sizeStat
+	resyncs  int64
+	partials int64
+}
+
+func NewReplicationWriter(interval time.Duration) *ReplicationWriter {
+	return &ReplicationWriter{
+		period:   common.NewPeriod(interval),
+		replicas: map[string]*replica{},
+		commands: map[string]*sizeStat{},
+	}
+}
+
+func (w *ReplicationWriter) replica(address string) *replica {
+	r, ok := w.replicas[address]
+	if !ok {
+		r = &replica{in: NewDecoder(true)}
+		w.replicas[address] = r
+	}
+	r.lastTime = time.Now()
+	return r
+}
+
+func argInt(v interface{}) int64 {
+	n, _ := strconv.ParseInt(v.(string), 10, 64)
+	return n
+}
+
+// FlowIn decodes the replica side: the handshake and REPLCONF ACK.
+func (w *ReplicationWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	address := common.RemoteKey(srcHost, srcPort)
+
+	w.mux.Lock()
+	r := w.replica(address)
+	if r.state == replClient {
+		w.mux.Unlock()
+		return nil
+	}
+	r.in.Append(data)
+	for {
+		v := r.in.TryDecode()
+		if !v.Valid() {
+			break
+		}
+		cmd := newCommand(&v, r.lastTime, false)
+		switch cmd.Name() {
+		case "psync":
+			if len(cmd.Args) >= 3 {
+				r.psync = argInt(cmd.Args[2])
+			}
+			r.state = replSync
+		case "sync":
+			r.state = replSync
+		case "replconf":
+			if len(cmd.Args) >= 3 && strings.EqualFold(cmd.Args[1].(string), "ack") {
+				r.ack = argInt(cmd.Args[2])
+				r.ackTime = r.lastTime
+			}
+		case "ping", "auth", "hello":
+		default:
+			if r.state == replHandshake {
+				// a normal client
+				r.state = replClient
+				r.in, r.out = nil, nil
+				w.mux.Unlock()
+				return nil
+			}
+		}
+	}
+	if err := r.in.Err(); err != nil {
+		err.Addr = address
+		recordDecodeError(err)
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+// FlowOut decodes the master side: +FULLRESYNC or +CONTINUE, the rdb and the command stream.
+func (w *ReplicationWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	address := common.RemoteKey(dstHost, dstPort)
+
+	w.mux.Lock()
+	r := w.replica(address)
+	for len(data) > 0 && r.state != replHandshake && r.state != replClient {
+		switch r.state {
+		case replSync, replRDB:
+			var line []byte
+			line, data = r.readLine(data)
+			if line != nil {
+				w.syncLine(address, r, line)
+			}
+		case replRDBBody:
+			data = r.skipRDB(data)
+			if r.state == replStream {
+				w.synced(address, r)
+			}
+		case replStream:
+			w.propagated(address, r, data)
+			data = nil
+		}
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+// FlowClose forgets the replica or client of the connection.
+func (w *ReplicationWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.mux.Lock()
+	delete(w.replicas, common.RemoteKey(host, port))
+	w.mux.Unlock()
+}
+
+// readLine returns a complete line without \r\n and the data after it.
+func (r *replica) readLine(data []byte) (line []byte, rest []byte) {
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		r.line = append(r.line, data...)
+		if len(r.line) > maxReplLine {
+			r.state = replClient
+		}
+		return nil, nil
+	}
+	line = append(r.line, data[:i]...)
+	r.line = nil
+	return bytes.TrimSuffix(line, []byte("\r")), data[i+1:]
+}
+
+func (w *ReplicationWriter) syncLine(address string, r *replica, line []byte) {
+	fields := strings.Fields(string(line))
+	switch {
+	case len(fields) == 0:
+		// newlines are sent as keepalive while the rdb is generated
+	case line[0] == '$':
+		r.rdbHeader(line)
+	case r.state == replSync && fields[0] == "+FULLRESYNC" && len(fields) == 3:
+		w.resyncs++
+		r.replID = fields[1]
+		r.offset, _ = strconv.ParseInt(fields[2], 10, 64)
+		r.state = replRDB
+	case r.state == replSync && fields[0] == "+CONTINUE":
+		w.partials++
+		if len(fields) > 1 {
+			r.replID = fields[1]
+		}
+		// PSYNC asks for the first byte it misses
+		r.offset = r.psync - 1
+		r.state = replStream
+		log.Infof("[%s]partial resync replid:%s offset:%d", address, r.replID, r.offset)
+	case line[0] == '-':
+		log.Warnf("[%s]replication sync fail:%s", address, line)
+		r.state = replHandshake
+	default:
+		// late replies to the handshake, such as +PONG or +OK
+	}
+}
+
+// rdbHeader parses $<size>, or $EOF:<40 bytes mark> of a diskless transfer.
+func (r *replica) rdbHeader(line []byte) {
+	r.rdbSize, r.rdbStart, r.tail = 0, time.Now(), nil
+	if bytes.HasPrefix(line, []byte("$EOF:")) {
+		r.mark = append([]byte(nil), line[5:]...)
+		r.rdbLeft = -1
+	} else {
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil || n < 0 {
+			r.state = replHandshake
+			return
+		}
+		r.rdbLeft = n
+	}
+	r.state = replRDBBody
+	if r.rdbLeft == 0 {
+		r.state = replStream
+	}
+}
+
+// skipRDB consumes rdb data and returns the data after the rdb.
+func (r *replica) skipRDB(data []byte) []byte {
+	if r.rdbLeft >= 0 {
+		n := len(data)
+		if n > r.rdbLeft {
+			n = r.rdbLeft
+		}
+		r.rdbLeft -= n
+		r.rdbSize += n
+		if r.rdbLeft == 0 {
+			r.state = replStream
+		}
+		return data[n:]
+	}
+
+	buf := append(r.tail, data...)
+	if i := bytes.Index(buf, r.mark); i >= 0 {
+		n := i + len(r.mark) - len(r.tail)
+		r.rdbSize += n
+		r.tail = nil
+		r.state = replStream
+		return data[n:]
+	}
+	r.rdbSize += len(data)
+	if keep := len(r.mark) - 1; len(buf) > keep {
+		buf = buf[len(buf)-keep:]
+	}
+	r.tail = append([]byte(nil), buf...)
+	return nil
+}
+
+func (w *ReplicationWriter) synced(address string, r *replica) {
+	log.Infof("[%s]full resync replid:%s offset:%d rdb:%d bytes in %s",
+		address, r.replID, r.offset, r.rdbSize, time.Since(r.rdbStart).Round(time.Millisecond))
+}
+
+// propagated decodes the command stream and advances the replication offset.
+func (w *ReplicationWriter) propagated(address string, r *replica, data []byte) {
+	if r.out == nil {
+		r.out = NewDecoder(true)
+	}
+	r.out.Append(data)
+	for {
+		v := r.out.TryDecode()
+		if !v.Valid() {
+			break
+		}
+		r.offset += int64(v.Size())
+		if r.offset <= w.offset {
+			// already counted from another replica
+			continue
+		}
+		w.offset = r.offset
+		first := v.Item(0)
+		name := strings.ToLower(common.BytesToString(first.Bytes()))
+		stat, ok := w.commands[name]
+		if !ok {
+			stat = &sizeStat{}
+			w.commands[common.CloneString(name)] = stat
+		}
+		stat.add(v.Size())
+	}
+	if err := r.out.Err(); err != nil {
+		// the offset is lost with the bytes skipped
+		err.Addr = address
+		recordDecodeError(err)
+	}
+}
+
+func (w *ReplicationWriter) report() {
+	oldTime, ok := w.period.Elapsed()
+	if !ok {
+		return
+	}
+
+	w.mux.Lock()
+	commands, resyncs, partials := w.commands, w.resyncs, w.partials
+	w.commands = map[string]*sizeStat{}
+	w.resyncs, w.partials = 0, 0
+	type replicaStat struct {
+		address string
+		state   int
+		offset  int64
+		ack     int64
+		ackTime time.Time
+	}
+	var replicas []replicaStat
+	for address, r := range w.replicas {
+		if time.Since(r.lastTime) > replTimeout {
+			delete(w.replicas, address)
+			continue
+		}
+		if r.state != replHandshake && r.state != replClient {
+			replicas = append(replicas, replicaStat{address, r.state, r.offset, r.ack, r.ackTime})
+		}
+	}
+	offset := w.offset
+	w.mux.Unlock()
+
+	fmt.Printf("[%d]replication offset:%d, full resync:%d, partial resync:%d\n", oldTime, offset, resyncs, partials)
+
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i].address < replicas[j].address
+	})
+	for _, r := range replicas {
+		switch r.state {
+		case replSync, replRDB, replRDBBody:
+			fmt.Printf("[%d]replica:%s, syncing\n", oldTime, r.address)
+		default:
+			ackAge := "none"
+			if !r.ackTime.IsZero() {
+				ackAge = time.Since(r.ackTime).Round(time.Millisecond).String()
+			}
+			fmt.Printf("[%d]replica:%s, offset:%d, ack:%d, lag:%d bytes, last ack:%s\n",
+				oldTime, r.address, r.offset, r.ack, r.offset-r.ack, ackAge)
+		}
+	}
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return commands[names[i]].count > commands[names[j]].count
+	})
+	for _, name := range names {
+		stat := commands[name]
+		fmt.Printf("[%d]propagated cmd:%s, count:%d, qps:%.1f, bytes:%d\n",
+			oldTime, name, stat.count, float64(stat.count)/w.period.Seconds(), stat.bytes)
+	}
+}
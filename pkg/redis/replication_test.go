@@ -0,0 +1,45 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReplicationWriter(t *testing.T) {
+	host := net.ParseIP("127.0.0.1")
+	t.Run("full", func(t *testing.T) {
+		w := NewReplicationWriter(time.Hour)
+		require.NoError(t, w.FlowIn(host, 1000, []byte("*1\r\n$4\r\nping\r\n*3\r\n$5\r\npsync\r\n$1\r\n?\r\n$2\r\n-1\r\n")))
+		require.NoError(t, w.FlowOut(host, 1000, []byte("+PONG\r\n+FULLRESYNC 8de1787ba490483314a4d30f1c628bc5025eb761 100\r\n\n$5\r\nRE")))
+		require.NoError(t, w.FlowOut(host, 1000, []byte("DIS*1\r\n$4\r\nping\r\n*2\r\n$3\r\ndel\r\n$1\r\na\r\n")))
+		r := w.replicas["127.0.0.1:1000"]
+		require.Equal(t, replStream, r.state)
+		require.Equal(t, 5, r.rdbSize)
+		require.Equal(t, int64(100+14+20), r.offset)
+		require.Equal(t, int64(1), w.commands["del"].count)
+
+		require.NoError(t, w.FlowIn(host, 1000, []byte("*3\r\n$8\r\nREPLCONF\r\n$3\r\nACK\r\n$3\r\n120\r\n")))
+		require.Equal(t, int64(120), r.ack)
+	})
+
+	t.Run("diskless", func(t *testing.T) {
+		w := NewReplicationWriter(time.Hour)
+		mark := "0123456789012345678901234567890123456789"
+		require.NoError(t, w.FlowIn(host, 1000, []byte("*1\r\n$4\r\nsync\r\n")))
+		require.NoError(t, w.FlowOut(host, 1000, []byte("$EOF:"+mark+"\r\nrdb"+mark[:10])))
+		require.NoError(t, w.FlowOut(host, 1000, []byte(mark[10:]+"*1\r\n$4\r\nping\r\n")))
+		r := w.replicas["127.0.0.1:1000"]
+		require.Equal(t, replStream, r.state)
+		require.Equal(t, 43, r.rdbSize)
+		require.Equal(t, int64(14), r.offset)
+	})
+
+	t.Run("client", func(t *testing.T) {
+		w := NewReplicationWriter(time.Hour)
+		require.NoError(t, w.FlowIn(host, 1000, []byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n")))
+		require.Equal(t, replClient, w.replicas["127.0.0.1:1000"].state)
+		require.NoError(t, w.FlowOut(host, 1000, []byte("$1\r\n1\r\n")))
+	})
+}
@@ -1,81 +1,109 @@
 package redis
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"github.com/morningli/packet_monitor/pkg/common"
 	log "github.com/sirupsen/logrus"
-	"io"
+	"strconv"
 	"sync/atomic"
 )
 
-type stat int
-
 const (
-	stateType = iota
-	stateBulkSize
-	stateBulkLenPre
-	stateBulkLen
-	stateBulkData
-	stateSimpleString
-	stateDone
+	maxBulkLen  = 512 << 20 // proto-max-bulk-len of redis
+	maxArrayLen = 1 << 24
+	maxDepth    = 32
+	maxScratch  = 1 << 20 // larger stream buffers are released once drained
+)
+
+var (
+	errIncomplete = errors.New("incomplete")
+	errProtocol   = errors.New("protocol error")
 )
 
-type NoCopyBuffer struct {
-	buf []byte
-	off int // read at &buf[off], write at &buf[len(buf)]
+var id int32
+
+const maxSample = 64
+
+// DecodeError describes a malformed value, the decoder skipped its bytes.
+type DecodeError struct {
+	Addr   string
+	In     bool
+	Sample string // first bytes of the malformed value, quoted
 }
 
-func (b *NoCopyBuffer) Write(p []byte) (n int, err error) {
-	if !b.empty() {
-		log.Fatalf("write to not empty buffer, buf len:%d, off:%d, left:%s", len(b.buf), b.off, common.BytesToString(b.buf[b.off:]))
+func (e *DecodeError) Error() string {
+	dir := "reply"
+	if e.In {
+		dir = "request"
 	}
-	b.buf = p
-	b.off = 0
-	return len(p), nil
+	return fmt.Sprintf("%s %s parse fail at %s", e.Addr, dir, e.Sample)
 }
 
-func (b *NoCopyBuffer) empty() bool { return len(b.buf) <= b.off }
-
-func (b *NoCopyBuffer) ReadByte() (byte, error) {
-	if b.empty() {
-		return 0, io.EOF
-	}
-	c := b.buf[b.off]
-	b.off++
-	return c, nil
+// Resp is a decoded value. Payloads and elements are views into the stream buffer of the
+// decoder: they are only valid until the next Append on the decoder, Clone returns a copy
+// that owns its memory for writers that keep values longer.
+type Resp struct {
+	t       byte
+	null    bool
+	request bool // array of arguments decoded from a client
+	data    []byte
+	items   []Resp
+	total   int //raw data len
 }
 
-func (b *NoCopyBuffer) Read(p []byte) (n int, err error) {
-	if b.empty() {
-		if len(p) == 0 {
-			return 0, nil
+// Value returns nil, the payload as []byte, or for aggregates a new []interface{} of the
+// elements: strings for requests, Resp for replies. Bytes, Len and Item do not allocate.
+func (r *Resp) Value() interface{} {
+	if r.null {
+		return nil
+	} else if r.IsArray() {
+		ret := make([]interface{}, len(r.items))
+		for i := range r.items {
+			if r.request {
+				ret[i] = common.BytesToString(r.items[i].data)
+			} else {
+				ret[i] = r.items[i]
+			}
 		}
-		return 0, io.EOF
+		return ret
 	}
-	n = copy(p, b.buf[b.off:])
-	b.off += n
-	return n, nil
+	return r.data
 }
 
-var id int32
+func (r *Resp) Bytes() []byte {
+	return r.data
+}
 
-type Resp struct {
-	t     byte
-	state stat
-	size  int
-	len   int
-	token []byte
-	array []interface{}
-	total int //raw data len
-	null  bool
+func (r *Resp) Len() int {
+	return len(r.items)
 }
 
-func (r *Resp) Value() interface{} {
-	if r.t == '*' {
-		return r.array
-	} else if r.null {
-		return nil
+func (r *Resp) Item(i int) Resp {
+	return r.items[i]
+}
+
+func (r *Resp) Type() byte {
+	return r.t
+}
+
+// IsArray reports whether the reply is an aggregate: array, or resp3 push, set, map or attribute.
+func (r *Resp) IsArray() bool {
+	switch r.t {
+	case '*', '>', '~', '%', '|':
+		return true
 	}
-	return r.token[:len(r.token)-2]
+	return false
+}
+
+// IsError reports whether the reply is an error or a resp3 blob error.
+func (r *Resp) IsError() bool {
+	return r.t == '-' || r.t == '!'
+}
+
+func (r *Resp) Null() bool {
+	return r.null
 }
 
 func (r *Resp) Size() int {
@@ -83,316 +111,393 @@ func (r *Resp) Size() int {
 }
 
 func (r *Resp) Valid() bool {
-	return r.t != 0 && r.state == stateDone
+	return r.t != 0
+}
+
+func (r *Resp) payloadSize() int {
+	n := len(r.data)
+	for i := range r.items {
+		n += r.items[i].payloadSize()
+	}
+	return n
+}
+
+// Clone returns a deep copy of the value which does not point into the decoder buffer.
+func (r Resp) Clone() Resp {
+	buf := make([]byte, 0, r.payloadSize())
+	return r.clone(&buf)
+}
+
+func (r Resp) clone(buf *[]byte) Resp {
+	if r.data != nil {
+		start := len(*buf)
+		*buf = append(*buf, r.data...)
+		r.data = (*buf)[start:len(*buf):len(*buf)]
+	}
+	if r.items != nil {
+		items := make([]Resp, len(r.items))
+		for i := range r.items {
+			items[i] = r.items[i].clone(buf)
+		}
+		r.items = items
+	}
+	return r
 }
 
+// Decoder reassembles a stream and decodes resp values from it. Values are decoded in
+// place: from the appended data itself when no value was left incomplete, otherwise from
+// a scratch buffer reused across calls. Elements of aggregates are stored in frames,
+// which are reused as well, so that decoding does not allocate once buffers are warm.
+// An incomplete value keeps its parse state, the next data resumes it where it stopped.
 type Decoder struct {
-	id   int32
-	in   bool
-	data NoCopyBuffer
+	id      int32
+	in      bool
+	buf     []byte // stream data, read from off
+	off     int
+	owned   bool   // buf is scratch
+	scratch []byte // owned buffer for values spanning several appends
+	frames  []Resp
+	err     *DecodeError
+	skipped int // values skipped since the last call of Skipped
+
+	// parse state of the value at off
+	pos      int     // next element to parse
+	need     int     // stream length the element at pos needs at least
+	lineFrom int     // where the search for the end of the line at pos resumes
+	stack    []level // aggregates being parsed, the first depth are in use
+	depth    int
+}
 
-	cur   Resp
-	stack *common.Stack
+// level is an aggregate whose elements are being parsed.
+type level struct {
+	r     Resp
+	start int
+	size  int
+	items []Resp // reused, copied to frames once complete
 }
 
 func NewDecoder(in bool) *Decoder {
-	return &Decoder{id: atomic.AddInt32(&id, 1), in: in, stack: common.NewStack()}
+	return &Decoder{id: atomic.AddInt32(&id, 1), in: in}
 }
 
+// Append adds stream data, values decoded before become invalid.
 func (b *Decoder) Append(data []byte) {
-	_, err := b.data.Write(data)
-	if err != nil {
-		log.Fatalf("[%d]feed data fail:%s", b.id, err)
+	if log.IsLevelEnabled(log.DebugLevel) {
+		log.Debugf("[%d]append %s", b.id, common.BytesToString(data))
 	}
-	log.Debugf("[%d]append %s", b.id, common.BytesToString(data))
-}
-
-func (b *Decoder) readLine(line []byte) (n int, err error) {
-	for i := 0; i < len(line); i++ {
-		d, err := b.data.ReadByte()
-		if err != nil {
-			return i, err
-		}
-		line[i] = d
-		if d == '\n' {
-			return i + 1, nil
+	if b.off >= len(b.buf) {
+		// nothing pending, decode in place
+		if cap(b.scratch) > maxScratch {
+			b.scratch = nil
 		}
+		b.buf, b.off, b.owned = data[:len(data):len(data)], 0, false
+		b.frames = b.frames[:0]
+		b.restart()
+		return
+	}
+	if !b.owned || b.off >= len(b.buf)-b.off {
+		// the pending bytes move to the start of scratch and their parse restarts: once
+		// when they leave the appended data, then only when more bytes were consumed
+		// before them than they are, so that each byte is copied a bounded number of times
+		b.scratch = append(b.scratch[:0], b.buf[b.off:]...)
+		b.off = 0
+		b.restart()
+	}
+	if b.depth == 0 {
+		// the frames of an incomplete value are kept
+		b.frames = b.frames[:0]
 	}
-	return len(line), io.ErrShortBuffer
+	// the elements parsed keep their views if scratch grows, the old array is not modified
+	b.scratch = append(b.scratch, data...)
+	b.buf, b.owned = b.scratch, true
 }
 
-func (b *Decoder) ResetCurrent() {
-	b.cur = Resp{}
-	b.cur.state = stateType
+// restart drops the parse state, the value at off is parsed again from its start.
+func (b *Decoder) restart() {
+	b.pos, b.need, b.lineFrom, b.depth = b.off, 0, 0, 0
 }
 
-func (b *Decoder) ArrayItemDone() bool {
-	v := b.stack.Pop()
-	last := v.(Resp)
-	last.array = append(last.array, b.cur)
-	last.size--
-	last.total += b.cur.total
-	if last.size == 0 {
-		b.cur = last
-		b.cur.state = stateDone
-		return true
-	}
-	b.stack.Push(last)
-	b.ResetCurrent()
-	return false
+// Reset drops the buffered data, decoding restarts with the next Append.
+func (b *Decoder) Reset() {
+	b.buf, b.off, b.owned = nil, 0, false
+	b.scratch = nil
+	b.frames = b.frames[:0]
+	b.restart()
+	b.err = nil
+	b.skipped = 0
 }
 
-func (b *Decoder) TryDecodeRespond() (ret Resp) {
-	bytesInt := make([]byte, 13)
-	bytesString := make([]byte, 128)
-	for {
-		switch b.cur.state {
-		case stateType:
-			t, err := b.data.ReadByte()
-			if err == io.EOF {
-				return Resp{}
-			}
-			switch t {
-			case '*':
-				b.cur.state = stateBulkSize
-				b.cur.token = bytesInt
-				b.cur.array = make([]interface{}, 0, 4)
-			case '+':
-				b.cur.state = stateSimpleString
-			case '-':
-				b.cur.state = stateSimpleString
-			case ':':
-				b.cur.state = stateSimpleString
-			case '$':
-				b.cur.state = stateBulkLen
-				b.cur.token = bytesInt
-			default:
-				break
-			}
-			b.cur.t = t
-			b.cur.total++
-		case stateSimpleString:
-			n, err := b.readLine(bytesString)
-			b.cur.token = append(b.cur.token, bytesString[:n]...)
-			b.cur.total += n
-			if err == io.ErrShortBuffer {
-				break
-			}
-			if err != nil {
-				return Resp{}
-			}
-			if len(b.cur.token) < 2 || b.cur.token[len(b.cur.token)-2] != '\r' || b.cur.token[len(b.cur.token)-1] != '\n' {
-				log.Errorf("[%d]parse simple string fail:%s", b.id, common.BytesToString(b.cur.token))
-				b.ResetCurrent()
-				break
-			}
-			b.cur.state = stateDone
-		case stateBulkSize:
-			n, err := b.readLine(b.cur.token[b.cur.len:])
-			b.cur.len += n
-			b.cur.total += n
-			if err == io.ErrShortBuffer {
-				log.Errorf("[%d]parse bulk size fail:%s", b.id, common.BytesToString(b.cur.token))
-				b.ResetCurrent()
-				break
-			}
-			if err != nil {
-				return Resp{}
-			}
-
-			size, err := common.Btoi(b.cur.token[:b.cur.len-2])
-			if err != nil {
-				log.Errorf("[%d]parse bulk size fail:%s", b.id, common.BytesToString(b.cur.token))
-				b.ResetCurrent()
-				break
-			}
-			b.cur.size = size
-			b.stack.Push(b.cur)
-			b.ResetCurrent()
-		case stateBulkLen:
-			n, err := b.readLine(b.cur.token[b.cur.len:])
-			b.cur.len += n
-			b.cur.total += n
-			if err == io.ErrShortBuffer {
-				log.Errorf("[%d]parse bulk size fail:%s", b.id, common.BytesToString(b.cur.token))
-				b.ResetCurrent()
-				break
-			}
-			if err != nil {
-				return Resp{}
-			}
+// Err returns the first malformed value since the last call.
+func (b *Decoder) Err() *DecodeError {
+	err := b.err
+	b.err = nil
+	return err
+}
 
-			if b.cur.len < 2 || b.cur.token[b.cur.len-2] != '\r' || b.cur.token[b.cur.len-1] != '\n' {
-				log.Errorf("[%d]parse bulk len fail:%s", b.id, common.BytesToString(b.cur.token))
-				b.ResetCurrent()
-				break
-			}
+// Skipped returns the number of values skipped since the last call, malformed values and
+// inline commands, which the other end still answers.
+func (b *Decoder) Skipped() int {
+	n := b.skipped
+	b.skipped = 0
+	return n
+}
 
-			size, err := common.Btoi(b.cur.token[:b.cur.len-2])
-			if err != nil {
-				log.Errorf("[%d]parse bulk len fail:%s", b.id, common.BytesToString(b.cur.token))
-				b.ResetCurrent()
-				break
-			}
+// Buffered returns the number of bytes waiting for the rest of their value.
+func (b *Decoder) Buffered() int {
+	return len(b.buf) - b.off
+}
 
-			//check null
-			if size == -1 {
-				b.cur.state = stateDone
-				b.cur.null = true
-				break
-			}
+// parseInt parses a resp length or integer without allocating.
+func parseInt(line []byte) (int, error) {
+	if len(line) == 0 {
+		return 0, errProtocol
+	}
+	neg := line[0] == '-'
+	if neg {
+		line = line[1:]
+		if len(line) == 0 {
+			return 0, errProtocol
+		}
+	}
+	n := 0
+	for _, c := range line {
+		if c < '0' || c > '9' || n > maxBulkLen {
+			return 0, errProtocol
+		}
+		n = n*10 + int(c-'0')
+	}
+	if neg {
+		return -n, nil
+	}
+	return n, nil
+}
 
-			b.cur.len = size + 2
-			b.cur.token = make([]byte, size+2)
-			b.cur.state = stateBulkData
-		case stateBulkData:
-			n, err := b.data.Read(b.cur.token[len(b.cur.token)-b.cur.len:])
-			b.cur.len -= n
-			b.cur.total += n
-			if err != nil {
-				return Resp{}
-			}
+// line returns the content of the line at pos without \r\n, and the position after it.
+func (b *Decoder) line(pos int) ([]byte, int, error) {
+	from := pos
+	if b.lineFrom > from {
+		from = b.lineFrom
+	}
+	i := bytes.IndexByte(b.buf[from:], '\n')
+	if i < 0 {
+		if len(b.buf)-pos > maxBulkLen {
+			return nil, 0, errProtocol
+		}
+		b.lineFrom = len(b.buf)
+		return nil, len(b.buf) + 1, errIncomplete
+	}
+	b.lineFrom = 0
+	i += from - pos
+	if i == 0 || b.buf[pos+i-1] != '\r' {
+		return nil, 0, errProtocol
+	}
+	return b.buf[pos : pos+i-1 : pos+i-1], pos + i + 1, nil
+}
 
-			if b.cur.len != 0 {
-				break
-			}
+// element decodes the header of the element at pos, and the whole element unless it is
+// a non empty aggregate, whose size is then returned. The position returned is after the
+// element or its header, or when it is incomplete, the stream length it needs at least.
+func (b *Decoder) element(pos int) (r Resp, next int, size int, err error) {
+	if pos >= len(b.buf) {
+		return r, pos + 1, 0, errIncomplete
+	}
+	r.t = b.buf[pos]
+	switch r.t {
+	case '+', '-', ':', '_', '#', ',', '(', '$', '=', '!', '*', '>', '~', '%', '|':
+	default:
+		return r, 0, 0, errProtocol
+	}
+	line, next, err := b.line(pos + 1)
+	if err != nil {
+		return r, next, 0, err
+	}
 
-			if len(b.cur.token) < 2 || b.cur.token[len(b.cur.token)-2] != '\r' || b.cur.token[len(b.cur.token)-1] != '\n' {
-				log.Errorf("[%d]parse bulk data fail:%s", b.id, common.BytesToString(b.cur.token))
-				b.ResetCurrent()
-				break
-			}
-			b.cur.state = stateDone
-		case stateDone:
-			if b.stack.Size() != 0 {
-				b.ArrayItemDone()
-				break
-			}
-			ret = b.cur
-			b.ResetCurrent()
-			return
+	switch r.t {
+	case '+', '-', ':', '_', '#', ',', '(':
+		// simple string, error, integer, and resp3 null, boolean, double and big number
+		r.data = line
+		r.null = r.t == '_'
+	case '$', '=', '!':
+		// bulk string, and resp3 verbatim string and blob error
+		size, err := parseInt(line)
+		if err != nil || size < -1 || size > maxBulkLen {
+			return r, 0, 0, errProtocol
+		}
+		if size == -1 {
+			r.null = true
+			break
+		}
+		end := next + size + 2
+		if end > len(b.buf) {
+			return r, end, 0, errIncomplete
+		}
+		if b.buf[end-2] != '\r' || b.buf[end-1] != '\n' {
+			return r, 0, 0, errProtocol
+		}
+		r.data = b.buf[next : next+size : next+size]
+		next = end
+	default:
+		// array, and resp3 push, set, map and attribute
+		size, err := parseInt(line)
+		if err != nil || size < -1 || size > maxArrayLen {
+			return r, 0, 0, errProtocol
 		}
+		if size == -1 {
+			r.null = true
+			break
+		}
+		if r.t == '%' || r.t == '|' {
+			// key value pairs
+			size *= 2
+		}
+		return r, next, size, nil
 	}
+	return r, next, 0, nil
 }
 
-func (b *Decoder) TryDecodeRequest() (ret Resp) {
-	bytesInt := make([]byte, 13)
+// parse resumes the value at off and returns it once complete. Elements are only stored
+// once parsed, so that a large aggregate arriving slowly costs its elements received.
+func (b *Decoder) parse() (Resp, error) {
 	for {
-		switch b.cur.state {
-		case stateType:
-			b.cur = Resp{}
-			t, err := b.data.ReadByte()
-			if err == io.EOF {
-				return Resp{}
-			}
-			if t != '*' {
-				break
-			}
-			b.cur.t = t
-			b.cur.state = stateBulkSize
-			b.cur.token = bytesInt
-			b.cur.array = make([]interface{}, 0, 4)
-			b.cur.total++
-		case stateBulkSize:
-			n, err := b.readLine(b.cur.token[b.cur.len:])
-			b.cur.len += n
-			b.cur.total += n
-			if err == io.ErrShortBuffer {
-				log.Errorf("[%d]parse bulk size fail:%s", b.id, common.BytesToString(b.cur.token))
-				b.ResetCurrent()
-				break
-			}
-			if err != nil {
-				return Resp{}
-			}
-
-			size, err := common.Btoi(b.cur.token[:b.cur.len-2])
-			if err != nil {
-				log.Errorf("[%d]parse bulk size fail:%s", b.id, common.BytesToString(b.cur.token))
-				b.ResetCurrent()
-				break
-			}
-			b.cur.size = size
-			b.cur.state = stateBulkLenPre
-		case stateBulkLenPre:
-			t, err := b.data.ReadByte()
-			if err != nil {
-				return Resp{}
-			}
-			if t != '$' {
-				log.Errorf("[%d]parse bulk len pre fail:%s", b.id, string(t))
-				b.ResetCurrent()
-				break
-			}
-			b.cur.state = stateBulkLen
-			b.cur.token = bytesInt
-			b.cur.len = 0
-			b.cur.total++
-		case stateBulkLen:
-			n, err := b.readLine(b.cur.token[b.cur.len:])
-			b.cur.len += n
-			b.cur.total += n
-			if err == io.ErrShortBuffer {
-				log.Errorf("[%d]parse bulk size fail:%s", b.id, common.BytesToString(b.cur.token))
-				b.ResetCurrent()
-				break
-			}
-			if err != nil {
-				return Resp{}
-			}
-
-			if b.cur.len < 2 || b.cur.token[b.cur.len-2] != '\r' || b.cur.token[b.cur.len-1] != '\n' {
-				log.Errorf("[%d]parse bulk len fail:%s", b.id, common.BytesToString(b.cur.token))
-				b.ResetCurrent()
-				break
+		r, next, size, err := b.element(b.pos)
+		if err != nil {
+			if err == errIncomplete {
+				b.need = next
 			}
+			return r, err
+		}
+		b.need = 0
+		if size > 0 {
+			if b.depth > maxDepth {
+				return r, errProtocol
+			}
+			if b.depth == len(b.stack) {
+				b.stack = append(b.stack, level{})
+			}
+			l := &b.stack[b.depth]
+			l.r, l.start, l.size, l.items = r, b.pos, size, l.items[:0]
+			b.depth++
+			b.pos = next
+			continue
+		}
+		r.total = next - b.pos
+		b.pos = next
 
-			size, err := common.Btoi(b.cur.token[:b.cur.len-2])
-			if err != nil {
-				log.Errorf("[%d]parse bulk len fail:%s", b.id, common.BytesToString(b.cur.token))
-				b.ResetCurrent()
+		for b.depth > 0 {
+			l := &b.stack[b.depth-1]
+			l.items = append(l.items, r)
+			if len(l.items) < l.size {
 				break
 			}
-			b.cur.len = size + 2
-			b.cur.token = make([]byte, int(size)+2)
-			b.cur.state = stateBulkData
-		case stateBulkData:
-			n, err := b.data.Read(b.cur.token[len(b.cur.token)-b.cur.len:])
-			b.cur.len -= n
-			b.cur.total += n
-			if err != nil {
-				return Resp{}
-			}
+			start := len(b.frames)
+			b.frames = append(b.frames, l.items...)
+			r = l.r
+			r.items = b.frames[start:len(b.frames):len(b.frames)]
+			r.total = b.pos - l.start
+			b.depth--
+		}
+		if b.depth == 0 {
+			return r, nil
+		}
+	}
+}
 
-			if b.cur.len != 0 {
-				break
-			}
+// resync skips the bytes of a malformed value: to the next array for requests,
+// to the next line for replies.
+func (b *Decoder) resync() {
+	sep := byte('\n')
+	if b.in {
+		sep = '*'
+	}
+	i := bytes.IndexByte(b.buf[b.off+1:], sep)
+	if i < 0 {
+		b.off = len(b.buf)
+		return
+	}
+	b.off += i + 1
+	if !b.in {
+		b.off++
+	}
+}
 
-			if len(b.cur.token) < 2 || b.cur.token[len(b.cur.token)-2] != '\r' || b.cur.token[len(b.cur.token)-1] != '\n' {
-				log.Errorf("[%d]parse bulk data fail:%s", b.id, common.BytesToString(b.cur.token))
-				b.ResetCurrent()
-				break
-			}
+// validRequest checks that a request is an array of bulk strings.
+func validRequest(r *Resp) bool {
+	if r.t != '*' || r.null || len(r.items) == 0 {
+		return false
+	}
+	for i := range r.items {
+		if r.items[i].t != '$' || r.items[i].null {
+			return false
+		}
+	}
+	return true
+}
 
-			b.cur.size--
-			b.cur.array = append(b.cur.array, common.BytesToString(b.cur.token[:len(b.cur.token)-2])) //must string
-			b.cur.token = nil
+// TryDecode returns the next complete value, or an invalid Resp when more data is needed.
+func (b *Decoder) TryDecode() Resp {
+	for b.off < len(b.buf) {
+		if b.need > len(b.buf) {
+			return Resp{}
+		}
+		if b.in && b.pos == b.off && b.buf[b.off] != '*' {
+			// inline commands are not supported, skip to the next array
+			b.skipped++
+			b.resync()
+			b.restart()
+			continue
+		}
 
-			if b.cur.size != 0 {
-				b.cur.state = stateBulkLenPre
-			} else {
-				b.cur.state = stateDone
-				ret = b.cur
-				b.ResetCurrent()
-				return
-			}
+		r, err := b.parse()
+		if err == errIncomplete {
+			return Resp{}
 		}
+		if err == nil && b.in && !validRequest(&r) {
+			err = errProtocol
+		}
+		if err != nil {
+			if b.err == nil {
+				sample := b.buf[b.off:]
+				if len(sample) > maxSample {
+					sample = sample[:maxSample]
+				}
+				b.err = &DecodeError{In: b.in, Sample: strconv.Quote(string(sample))}
+			}
+			b.skipped++
+			b.resync()
+			b.restart()
+			continue
+		}
+		b.off = b.pos
+		if r.t == '|' {
+			// attributes only annotate the reply that follows
+			continue
+		}
+		r.request = b.in
+		return r
 	}
+	return Resp{}
 }
 
-func (b *Decoder) TryDecode() Resp {
-	if b.in {
-		return b.TryDecodeRequest()
+func (b *Decoder) TryDecodeRequest() Resp {
+	return b.TryDecode()
+}
+
+func (b *Decoder) TryDecodeRespond() Resp {
+	return b.TryDecode()
+}
+
+// AppendRequest encodes a command as a resp array of bulk strings.
+func AppendRequest(dst []byte, args []interface{}) []byte {
+	dst = append(dst, '*')
+	dst = strconv.AppendInt(dst, int64(len(args)), 10)
+	dst = append(dst, '\r', '\n')
+	for _, v := range args {
+		arg := v.(string)
+		dst = append(dst, '$')
+		dst = strconv.AppendInt(dst, int64(len(arg)), 10)
+		dst = append(dst, '\r', '\n')
+		dst = append(dst, arg...)
+		dst = append(dst, '\r', '\n')
 	}
-	return b.TryDecodeRespond()
+	return dst
 }
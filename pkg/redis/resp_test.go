@@ -3,6 +3,7 @@ package redis
 import (
 	"github.com/stretchr/testify/require"
 	"runtime/debug"
+	"strings"
 	"testing"
 )
 
@@ -94,6 +95,30 @@ func TestRespBuffer_Feed2(t *testing.T) {
 		require.Equal(t, 5, args.Size())
 	})
 
+	t.Run("null array", func(t *testing.T) {
+		data := []byte("*-1\r\n+OK\r\n")
+		b := NewDecoder(false)
+		b.Append(data)
+		args := b.TryDecode()
+		require.True(t, args.Valid())
+		require.True(t, args.Null())
+		require.Nil(t, args.Value())
+		require.Equal(t, 5, args.Size())
+		args = b.TryDecode()
+		require.True(t, args.Valid())
+		require.Equal(t, []byte("OK"), args.Value())
+	})
+
+	t.Run("empty array", func(t *testing.T) {
+		data := []byte("*0\r\n")
+		b := NewDecoder(false)
+		b.Append(data)
+		args := b.TryDecode()
+		require.True(t, args.Valid())
+		require.False(t, args.Null())
+		require.Len(t, args.Value(), 0)
+	})
+
 	t.Run("string", func(t *testing.T) {
 		data := []byte("+OK\r\n")
 		b := NewDecoder(false)
@@ -135,8 +160,159 @@ func BenchmarkRespBuffer_TryFetch(b *testing.B) {
 	debug.SetGCPercent(400)
 	data := []byte("*2\r\n$3\r\nget\r\n$2\r\naa\r\n")
 	buff := NewDecoder(true)
+	b.ReportAllocs()
 	for i := 0; i < b.N; i++ {
 		buff.Append(data)
 		_ = buff.TryDecode()
 	}
 }
+
+func BenchmarkDecoder_Reply(b *testing.B) {
+	data := []byte("*3\r\n$3\r\nabc\r\n:10\r\n$-1\r\n")
+	buff := NewDecoder(false)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buff.Append(data)
+		_ = buff.TryDecode()
+	}
+}
+
+func BenchmarkDecoder_Split(b *testing.B) {
+	value := strings.Repeat("v", 4096)
+	data := []byte("*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$4096\r\n" + value + "\r\n")
+	buff := NewDecoder(true)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < len(data); j += 1460 {
+			end := j + 1460
+			if end > len(data) {
+				end = len(data)
+			}
+			buff.Append(data[j:end])
+			_ = buff.TryDecode()
+		}
+	}
+}
+
+func BenchmarkSession_FetchRequests(b *testing.B) {
+	data := []byte("*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$5\r\nvalue\r\n*2\r\n$3\r\nget\r\n$3\r\nkey\r\n")
+	s := NewSession("127.0.0.1:1234", false)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		_ = s.FetchRequests(data)
+	}
+}
+
+func TestDecoder_Split(t *testing.T) {
+	buff := NewDecoder(false)
+	buff.Append([]byte("*2\r\n$5\r\nhel"))
+	r := buff.TryDecode()
+	require.False(t, r.Valid())
+	buff.Append([]byte("lo\r\n:1"))
+	r = buff.TryDecode()
+	require.False(t, r.Valid())
+	buff.Append([]byte("\r\n+OK\r\n"))
+	r = buff.TryDecode()
+	require.True(t, r.Valid())
+	require.Equal(t, 2, r.Len())
+	require.Equal(t, []byte("hello"), r.Item(0).data)
+	require.Equal(t, 19, r.Size())
+
+	// a clone stays valid once the buffer is reused
+	clone := r.Clone()
+	buff.Append([]byte("$5\r\nworld\r\n"))
+	ok := buff.TryDecode()
+	require.Equal(t, []byte("OK"), ok.data)
+	require.Equal(t, "world", string(buff.TryDecode().data))
+	require.Equal(t, []byte("hello"), clone.Item(0).data)
+	require.Equal(t, []byte("1"), clone.Item(1).data)
+}
+
+func TestDecoder_Resume(t *testing.T) {
+	t.Run("nested", func(t *testing.T) {
+		data := []byte("*3\r\n*2\r\n$3\r\nabc\r\n:1\r\n%1\r\n+k\r\n*1\r\n$-1\r\n$2\r\nxy\r\n+OK\r\n")
+		whole := NewDecoder(false)
+		whole.Append(data)
+		expected := whole.TryDecode()
+
+		// the same value fed byte by byte, and after a complete value in the same data
+		b := NewDecoder(false)
+		var got []Resp
+		for i := range data {
+			b.Append(data[i : i+1])
+			for r := b.TryDecode(); r.Valid(); r = b.TryDecode() {
+				got = append(got, r.Clone())
+			}
+		}
+		require.Len(t, got, 2)
+		require.Equal(t, expected.Clone(), got[0])
+		require.Equal(t, []byte("OK"), got[1].data)
+		require.Equal(t, 0, b.Buffered())
+	})
+
+	t.Run("large array", func(t *testing.T) {
+		// elements are stored once received, not when the header announces them
+		b := NewDecoder(false)
+		b.Append([]byte("*16777216\r\n:1\r\n:2\r\n"))
+		r := b.TryDecode()
+		require.False(t, r.Valid())
+		require.Less(t, cap(b.stack[0].items), 1024)
+		b.Append([]byte(":3\r\n"))
+		r = b.TryDecode()
+		require.False(t, r.Valid())
+		require.Len(t, b.stack[0].items, 3)
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		// values ending in the middle of every append keep scratch bounded
+		b := NewDecoder(true)
+		data := []byte("*2\r\n$3\r\nget\r\n$3\r\nkey\r\n")
+		n := 0
+		for i := 0; i < 1000; i++ {
+			b.Append(data[:10])
+			for r := b.TryDecode(); r.Valid(); r = b.TryDecode() {
+				n++
+			}
+			b.Append(append(append([]byte(nil), data[10:]...), data...))
+			for r := b.TryDecode(); r.Valid(); r = b.TryDecode() {
+				n++
+			}
+		}
+		require.Equal(t, 2000, n)
+		require.Less(t, cap(b.scratch), 1024)
+	})
+}
+
+// benchmarkSplit feeds a value in segments of a tcp packet.
+func benchmarkSplit(b *testing.B, data []byte, in bool) {
+	buff := NewDecoder(in)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	for i := 0; i < b.N; i++ {
+		n := 0
+		for j := 0; j < len(data); j += 1460 {
+			end := j + 1460
+			if end > len(data) {
+				end = len(data)
+			}
+			buff.Append(data[j:end])
+			for r := buff.TryDecode(); r.Valid(); r = buff.TryDecode() {
+				n++
+			}
+		}
+		if n != 1 {
+			b.Fatalf("decoded %d values", n)
+		}
+	}
+}
+
+func BenchmarkDecoder_LargeBulk(b *testing.B) {
+	value := strings.Repeat("v", 8<<20)
+	benchmarkSplit(b, []byte("*3\r\n$3\r\nset\r\n$3\r\nkey\r\n$8388608\r\n"+value+"\r\n"), true)
+}
+
+func BenchmarkDecoder_LargeArray(b *testing.B) {
+	data := []byte("*200000\r\n" + strings.Repeat("$5\r\nvalue\r\n", 200000))
+	benchmarkSplit(b, data, false)
+}
@@ -0,0 +1,390 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	RuleKeep = iota
+	RuleDrop
+	RuleAllow
+	RuleAddPrefix
+	RuleRemovePrefix
+	RuleHashTag
+	RuleDB
+)
+
+// dangerous are the admin commands dropped unless allowed by a rule.
+var dangerous = map[string]bool{"flushall": true, "flushdb": true, "config": true, "shutdown": true, "debug": true, "keys": true}
+
+// ReplayRule filters or transforms the replayed commands which match all its selectors.
+type ReplayRule struct {
+	Action int
+	Prefix string          // RuleAddPrefix, RuleRemovePrefix
+	From   int             // RuleDB, the captured db
+	To     int             // RuleDB, the db on the target
+	Cmds   map[string]bool // lower case command names, nil matches all
+	Class  int             // common.FlagRead or common.FlagWrite, 0 matches all
+	Key    *regexp.Regexp  // filters: the first key must match, transforms: the keys changed
+	Client *net.IPNet      // the client ip must be in the network
+	Name   *regexp.Regexp  // the client name must match
+}
+
+// ParseReplayRules parses rules separated by ';', each one is an action followed by selectors:
+//
+//	keep|drop|allow|add-prefix=<p>|remove-prefix=<p>|hashtag|db=<from>:<to>
+//		[cmd=<name>,<name>] [class=read|write] [key=<regexp>] [client=<cidr>] [name=<glob>]
+//
+// eg: "keep class=write;drop key=^tmp:;add-prefix=staging: key=^user:;db=0:1"
+func ParseReplayRules(s string) ([]ReplayRule, error) {
+	var rules []ReplayRule
+	for _, text := range strings.Split(s, ";") {
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		var rule ReplayRule
+		switch action := fields[0]; {
+		case action == "keep":
+			rule.Action = RuleKeep
+		case action == "drop":
+			rule.Action = RuleDrop
+		case action == "allow":
+			rule.Action = RuleAllow
+		case action == "hashtag":
+			rule.Action = RuleHashTag
+		case strings.HasPrefix(action, "add-prefix="):
+			rule.Action = RuleAddPrefix
+			rule.Prefix = action[len("add-prefix="):]
+		case strings.HasPrefix(action, "remove-prefix="):
+			rule.Action = RuleRemovePrefix
+			rule.Prefix = action[len("remove-prefix="):]
+		case strings.HasPrefix(action, "db="):
+			dbs := strings.SplitN(action[len("db="):], ":", 2)
+			var err1, err2 error
+			if len(dbs) == 2 {
+				rule.From, err1 = strconv.Atoi(dbs[0])
+				rule.To, err2 = strconv.Atoi(dbs[1])
+			}
+			if len(dbs) != 2 || err1 != nil || err2 != nil || rule.From < 0 || rule.To < 0 {
+				return nil, fmt.Errorf("invalid replay action:%s", action)
+			}
+			rule.Action = RuleDB
+		default:
+			return nil, fmt.Errorf("invalid replay action:%s", action)
+		}
+		for _, f := range fields[1:] {
+			kv := strings.SplitN(f, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("invalid replay selector:%s", f)
+			}
+			switch kv[0] {
+			case "cmd":
+				rule.Cmds = map[string]bool{}
+				for _, name := range strings.Split(strings.ToLower(kv[1]), ",") {
+					rule.Cmds[name] = true
+				}
+			case "class":
+				switch kv[1] {
+				case "read":
+					rule.Class = common.FlagRead
+				case "write":
+					rule.Class = common.FlagWrite
+				default:
+					return nil, fmt.Errorf("invalid replay class:%s", kv[1])
+				}
+			case "key":
+				re, err := regexp.Compile(kv[1])
+				if err != nil {
+					return nil, fmt.Errorf("invalid replay key:%s", err)
+				}
+				rule.Key = re
+			case "client":
+				cidr := kv[1]
+				if !strings.Contains(cidr, "/") {
+					cidr += "/32"
+					if strings.Contains(kv[1], ":") {
+						cidr = kv[1] + "/128"
+					}
+				}
+				_, network, err := net.ParseCIDR(cidr)
+				if err != nil {
+					return nil, fmt.Errorf("invalid replay client:%s", kv[1])
+				}
+				rule.Client = network
+			case "name":
+				rule.Name = GlobToRegexp(kv[1])
+			default:
+				return nil, fmt.Errorf("invalid replay selector:%s", f)
+			}
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// replayClient is what the rules know about a client connection, from its commands.
+type replayClient struct {
+	ip       net.IP
+	name     string
+	db       int // db selected on the source
+	targetDB int // db selected on the target
+}
+
+// control reports whether a command only changes the state of the connection. They are
+// kept with the commands they apply to, unless a drop rule names them or drops the client.
+func control(cmd string) bool {
+	info := common.LookupCommand(cmd)
+	return info != nil && (info.Is(common.FlagConn) || info.Is(common.FlagTx))
+}
+
+func (r *ReplayRule) matchClient(c *replayClient) bool {
+	if r.Client != nil && (c.ip == nil || !r.Client.Contains(c.ip)) {
+		return false
+	}
+	return r.Name == nil || r.Name.MatchString(c.name)
+}
+
+// onlyClient reports whether the rule only selects clients.
+func (r *ReplayRule) onlyClient() bool {
+	return r.Cmds == nil && r.Class == 0 && r.Key == nil
+}
+
+func (r *ReplayRule) match(c *replayClient, cmd string, firstKey string, hasKeys bool) bool {
+	if !r.matchClient(c) {
+		return false
+	}
+	if r.Cmds != nil && !r.Cmds[cmd] {
+		return false
+	}
+	if r.Class != 0 {
+		info := common.LookupCommand(cmd)
+		if info == nil || !info.Is(r.Class) {
+			return false
+		}
+	}
+	return r.Key == nil || (hasKeys && r.Key.MatchString(firstKey))
+}
+
+// RulesTarget applies replay rules in front of a target. It follows SELECT and CLIENT
+// SETNAME on each client connection to know its db and name, and selects the remapped db
+// on the target before the first command which needs it.
+type RulesTarget struct {
+	target  *Target
+	rules   []ReplayRule
+	allowed map[string]bool
+	mux     sync.Mutex
+	clients map[string]*replayClient
+}
+
+func NewRulesTarget(target *Target, rules []ReplayRule) *RulesTarget {
+	t := &RulesTarget{target: target, rules: rules, allowed: map[string]bool{}, clients: map[string]*replayClient{}}
+	for _, rule := range rules {
+		if rule.Action == RuleAllow {
+			for name := range rule.Cmds {
+				t.allowed[name] = true
+			}
+			if rule.Cmds == nil {
+				for name := range dangerous {
+					t.allowed[name] = true
+				}
+			}
+		}
+	}
+	return t
+}
+
+func (t *RulesTarget) mapDB(db int) int {
+	for i := range t.rules {
+		if t.rules[i].Action == RuleDB && t.rules[i].From == db {
+			return t.rules[i].To
+		}
+	}
+	return db
+}
+
+// keep applies the filters.
+func (t *RulesTarget) keep(c *replayClient, cmd string, args []interface{}) bool {
+	if dangerous[cmd] && !t.allowed[cmd] {
+		return false
+	}
+	keys := common.GetKeys(cmd, args)
+	firstKey := ""
+	if len(keys) > 0 {
+		firstKey = keys[0]
+	}
+	isControl := control(cmd)
+	keeps, kept := 0, false
+	for i := range t.rules {
+		rule := &t.rules[i]
+		switch rule.Action {
+		case RuleDrop:
+			if isControl && !rule.onlyClient() && !rule.Cmds[cmd] {
+				continue
+			}
+			if rule.match(c, cmd, firstKey, len(keys) > 0) {
+				return false
+			}
+		case RuleKeep:
+			keeps++
+			if isControl && !rule.onlyClient() {
+				kept = kept || rule.matchClient(c)
+				continue
+			}
+			kept = kept || rule.match(c, cmd, firstKey, len(keys) > 0)
+		}
+	}
+	return keeps == 0 || kept
+}
+
+// transform applies the key transformations to a copy of the arguments.
+func (t *RulesTarget) transform(c *replayClient, cmd string, args []interface{}) []interface{} {
+	idx := common.KeyPositions(cmd, args)
+	if len(idx) == 0 {
+		return args
+	}
+	ret := args
+	for i := range t.rules {
+		rule := &t.rules[i]
+		switch rule.Action {
+		case RuleAddPrefix, RuleRemovePrefix, RuleHashTag:
+		default:
+			continue
+		}
+		if !rule.matchClient(c) || (rule.Cmds != nil && !rule.Cmds[cmd]) {
+			continue
+		}
+		if rule.Class != 0 {
+			if info := common.LookupCommand(cmd); info == nil || !info.Is(rule.Class) {
+				continue
+			}
+		}
+		for _, j := range idx {
+			key := ret[j].(string)
+			if rule.Key != nil && !rule.Key.MatchString(key) {
+				continue
+			}
+			switch rule.Action {
+			case RuleAddPrefix:
+				key = rule.Prefix + key
+			case RuleRemovePrefix:
+				key = strings.TrimPrefix(key, rule.Prefix)
+			case RuleHashTag:
+				if !hasHashTag(key) {
+					key = "{" + key + "}"
+				}
+			}
+			if &ret[0] == &args[0] {
+				ret = append([]interface{}(nil), args...)
+			}
+			ret[j] = key
+		}
+	}
+	return ret
+}
+
+// hasHashTag reports whether the slot of a key is computed from a part of it.
+func hasHashTag(key string) bool {
+	start := strings.IndexByte(key, '{')
+	if start == -1 {
+		return false
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	return end > 0
+}
+
+// identify follows the commands which change the db or the name of a connection.
+func identify(c *replayClient, cmd string, args []interface{}) {
+	arg := func(i int) string {
+		return args[i].(string)
+	}
+	switch cmd {
+	case "select":
+		if len(args) > 1 {
+			if db, err := strconv.Atoi(arg(1)); err == nil {
+				c.db = db
+			}
+		}
+	case "client":
+		if len(args) > 2 && strings.ToLower(arg(1)) == "setname" {
+			c.name = arg(2)
+		}
+	case "hello":
+		for i := 2; i+1 < len(args); i++ {
+			if strings.ToLower(arg(i)) == "setname" {
+				c.name = arg(i + 1)
+			}
+		}
+	case "reset":
+		c.db, c.name = 0, ""
+	}
+}
+
+func (t *RulesTarget) Send(client string, args []interface{}) {
+	if len(args) == 0 {
+		return
+	}
+	cmd := strings.ToLower(args[0].(string))
+
+	t.mux.Lock()
+	c, ok := t.clients[client]
+	if !ok {
+		c = &replayClient{}
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			c.ip = net.ParseIP(host)
+		}
+		t.clients[client] = c
+	}
+	identify(c, cmd, args)
+	if !t.keep(c, cmd, args) {
+		t.mux.Unlock()
+		atomic.AddUint64(&filtered, 1)
+		return
+	}
+
+	var selectDB []interface{}
+	switch {
+	case cmd == "select":
+		db := t.mapDB(c.db)
+		args = []interface{}{args[0], strconv.Itoa(db)}
+		c.targetDB = db
+	case cmd == "reset":
+		c.targetDB = 0
+	case !control(cmd) && t.mapDB(c.db) != c.targetDB:
+		// the connection never selected a db, or its SELECT was dropped
+		c.targetDB = t.mapDB(c.db)
+		selectDB = []interface{}{"select", strconv.Itoa(c.targetDB)}
+	}
+	args = t.transform(c, cmd, args)
+	t.mux.Unlock()
+
+	if selectDB != nil {
+		t.target.Send(client, selectDB)
+	}
+	t.target.Send(client, args)
+}
+
+func (t *RulesTarget) CloseClient(client string) {
+	t.mux.Lock()
+	delete(t.clients, client)
+	t.mux.Unlock()
+	t.target.CloseClient(client)
+}
+
+func (t *RulesTarget) Wait() {
+	t.mux.Lock()
+	t.clients = map[string]*replayClient{}
+	t.mux.Unlock()
+	t.target.Wait()
+}
+
+func (t *RulesTarget) Close() error {
+	return t.target.Close()
+}
@@ -0,0 +1,67 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseReplayRules(t *testing.T) {
+	rules, err := ParseReplayRules("keep class=write client=10.0.0.0/8; drop key=^tmp: ;db=0:1;add-prefix=s: name=app-*")
+	require.Nil(t, err)
+	require.Len(t, rules, 4)
+	require.Equal(t, RuleDB, rules[2].Action)
+	require.Equal(t, 1, rules[2].To)
+	require.Equal(t, "s:", rules[3].Prefix)
+
+	for _, s := range []string{"move", "db=1", "keep class=admin", "drop key=(", "drop client=x", "drop pos=1"} {
+		_, err = ParseReplayRules(s)
+		require.NotNil(t, err, s)
+	}
+}
+
+func TestRulesTarget(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.ln.Close()
+
+	rules, err := ParseReplayRules("keep class=write;drop key=^tmp:;drop client=10.0.0.2;" +
+		"add-prefix=staging: key=^user:;hashtag cmd=mset;db=0:1;allow cmd=flushdb")
+	require.Nil(t, err)
+	target := NewRulesTarget(NewTarget(s.ln.Addr().String(), false), rules)
+
+	c1 := "10.0.0.1:5000"
+	for _, args := range [][]interface{}{
+		{"get", "user:1"},
+		{"set", "user:1", "a"},
+		{"set", "tmp:1", "a"},
+		{"mset", "a", "1", "{b}c", "2"},
+		{"flushall"},
+		{"flushdb"},
+		{"select", "2"},
+		{"del", "user:2"},
+	} {
+		target.Send(c1, args)
+	}
+	target.Send("10.0.0.2:5000", []interface{}{"set", "a", "1"})
+	require.Nil(t, target.Close())
+	require.Eventually(t, func() bool {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		return s.closed == len(s.conns)
+	}, time.Second, time.Millisecond*10)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var commands []string
+	for _, cmds := range s.conns {
+		commands = append(commands, cmds...)
+	}
+	require.Equal(t, []string{
+		"[select 1]",
+		"[set staging:user:1 a]",
+		"[mset {a} 1 {b}c 2]",
+		"[flushdb]",
+		"[select 2]",
+		"[del staging:user:2]",
+	}, commands)
+}
@@ -0,0 +1,261 @@
+package redis
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"net"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxScripts    = 10000
+	maxScriptKeys = 1000 // distinct keys remembered per script and interval
+	scriptNameLen = 60
+)
+
+var (
+	libraryName      = regexp.MustCompile(`^#!\w+\s+name=(\S+)`)
+	registerFunction = regexp.MustCompile(`register_function\s*\(?\s*\{?\s*(?:function_name\s*=\s*)?['"]([^'"]+)['"]`)
+)
+
+type scriptStat struct {
+	calls    int64
+	keys     int64
+	distinct map[string]struct{}
+	noscript int64
+	errors   int64
+	latency  *hdrhistogram.Histogram // microseconds
+}
+
+// ScriptWriter attributes EVAL/EVALSHA and FCALL calls to their script or function, with the
+// sources learned from EVAL, SCRIPT LOAD and FUNCTION LOAD on the wire.
+type ScriptWriter struct {
+	sessions *SessionMgr
+	period   *common.Period
+	source   bool
+	mux      sync.Mutex
+	scripts  map[string]string // sha1 -> source
+	funcs    map[string]string // function name -> library name
+	printed  map[string]struct{}
+	stats    map[string]*scriptStat
+}
+
+func NewScriptWriter(interval time.Duration, source bool) *ScriptWriter {
+	return &ScriptWriter{
+		sessions: NewSessionMgr(true),
+		period:   common.NewPeriod(interval),
+		source:   source,
+		scripts:  map[string]string{},
+		funcs:    map[string]string{},
+		printed:  map[string]struct{}{},
+		stats:    map[string]*scriptStat{},
+	}
+}
+
+func scriptSHA(body string) string {
+	sum := sha1.Sum(common.StringsToBytes(body))
+	return hex.EncodeToString(sum[:])
+}
+
+func (w *ScriptWriter) learn(body string) {
+	sha := scriptSHA(body)
+	if _, ok := w.scripts[sha]; ok || len(w.scripts) >= maxScripts {
+		return
+	}
+	w.scripts[sha] = string(append([]byte(nil), body...))
+}
+
+func (w *ScriptWriter) learnLibrary(code string) {
+	library := ""
+	if m := libraryName.FindStringSubmatch(code); m != nil {
+		library = m[1]
+	}
+	for _, m := range registerFunction.FindAllStringSubmatch(code, -1) {
+		if len(w.funcs) < maxScripts {
+			w.funcs[m[1]] = library
+		}
+	}
+	// the source of a library is printed under its name
+	if len(w.scripts) < maxScripts {
+		w.scripts["library:"+library] = string(append([]byte(nil), code...))
+	}
+}
+
+func (w *ScriptWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	requests := w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
+
+	w.mux.Lock()
+	for _, r := range expand(requests) {
+		switch r.Name() {
+		case "eval", "eval_ro":
+			if len(r.Args) > 1 {
+				w.learn(r.Args[1].(string))
+			}
+		case "script":
+			if len(r.Args) == 3 && strings.EqualFold(r.Args[1].(string), "load") {
+				w.learn(r.Args[2].(string))
+			}
+		case "function":
+			if len(r.Args) >= 3 && strings.EqualFold(r.Args[1].(string), "load") {
+				w.learnLibrary(r.Args[len(r.Args)-1].(string))
+			}
+		}
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+// target returns the script or function a call is attributed to.
+func (w *ScriptWriter) target(r *Command) string {
+	if len(r.Args) < 2 {
+		return ""
+	}
+	arg := r.Args[1].(string)
+	switch r.Name() {
+	case "eval", "eval_ro":
+		return "sha:" + scriptSHA(arg)
+	case "evalsha", "evalsha_ro":
+		return "sha:" + strings.ToLower(arg)
+	case "fcall", "fcall_ro":
+		return "function:" + arg
+	}
+	return ""
+}
+
+func (w *ScriptWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	replies, _ := w.sessions.FetchReplies(common.RemoteKey(dstHost, dstPort), data)
+
+	var sources []string
+	w.mux.Lock()
+	for _, r := range expand(replies) {
+		target := w.target(r)
+		if target == "" {
+			continue
+		}
+		w.record(target, r)
+		// the source is printed next to the first call captured
+		if source := w.firstSource(target); source != "" {
+			sources = append(sources, fmt.Sprintf("[%d]script %s, source:\n%s\n", r.Time.UnixMicro(), target, source))
+		}
+	}
+	w.mux.Unlock()
+	for _, source := range sources {
+		fmt.Print(source)
+	}
+
+	w.report()
+	return nil
+}
+
+// FlowClose drops the state of the connection, a new connection on its address starts afresh.
+func (w *ScriptWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+func (w *ScriptWriter) record(target string, r *Command) {
+	stat, ok := w.stats[target]
+	if !ok {
+		stat = &scriptStat{distinct: map[string]struct{}{}, latency: hdrhistogram.New(1, maxLatency, 2)}
+		w.stats[target] = stat
+	}
+	stat.calls++
+	keys := r.Keys()
+	stat.keys += int64(len(keys))
+	for _, key := range keys {
+		if len(stat.distinct) < maxScriptKeys {
+			stat.distinct[key] = struct{}{}
+		}
+	}
+	if r.Reply.IsError() {
+		if errorPrefix(r.Reply) == "NOSCRIPT" {
+			stat.noscript++
+		} else {
+			stat.errors++
+		}
+	}
+	latency := r.ReplyTime.Sub(r.Time).Microseconds()
+	if latency < 1 {
+		latency = 1
+	}
+	_ = stat.latency.RecordValue(latency)
+}
+
+// firstSource returns the source of a script the first time it is known, if sources are printed.
+func (w *ScriptWriter) firstSource(target string) string {
+	if !w.source {
+		return ""
+	}
+	if _, ok := w.printed[target]; ok {
+		return ""
+	}
+	_, source := w.describe(target)
+	if source == "" {
+		return ""
+	}
+	w.printed[target] = struct{}{}
+	return source
+}
+
+// describe returns a short name of a script: its first non empty line, or the library of a function.
+func (w *ScriptWriter) describe(target string) (name string, source string) {
+	if strings.HasPrefix(target, "function:") {
+		library, ok := w.funcs[target[len("function:"):]]
+		if !ok {
+			return "unknown", ""
+		}
+		return "library:" + library, w.scripts["library:"+library]
+	}
+	source, ok := w.scripts[target[len("sha:"):]]
+	if !ok {
+		return "unknown", ""
+	}
+	for _, line := range strings.Split(source, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			name = line
+			break
+		}
+	}
+	if len(name) > scriptNameLen {
+		name = name[:scriptNameLen] + "..."
+	}
+	return name, source
+}
+
+func (w *ScriptWriter) report() {
+	oldTime, ok := w.period.Elapsed()
+	if !ok {
+		return
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	stats := w.stats
+	w.stats = map[string]*scriptStat{}
+
+	targets := make([]string, 0, len(stats))
+	for target := range stats {
+		targets = append(targets, target)
+	}
+	sort.Slice(targets, func(i, j int) bool { return stats[targets[i]].calls > stats[targets[j]].calls })
+	for _, target := range targets {
+		stat := stats[target]
+		name, _ := w.describe(target)
+		fmt.Printf("[%d]script %s, name:%q, calls:%d, keys:%d, distinct keys:%d, noscript:%d, errors:%d, latency avg:%dus p99:%dus max:%dus\n",
+			oldTime, target, name, stat.calls, stat.keys, len(stat.distinct), stat.noscript, stat.errors,
+			int64(stat.latency.Mean()), stat.latency.ValueAtQuantile(99), stat.latency.Max())
+		// a source learned after the first call is printed with the next report
+		if source := w.firstSource(target); source != "" {
+			fmt.Printf("[%d]script %s, source:\n%s\n", oldTime, target, source)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/require"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestScriptWriter(t *testing.T) {
+	w := NewScriptWriter(time.Hour, true)
+	host := net.ParseIP("127.0.0.1")
+	script := "return redis.call('get', KEYS[1])"
+	sha := "sha:" + scriptSHA(script)
+
+	// calls queued in a transaction count at EXEC
+	require.NoError(t, w.FlowIn(host, 1000, []byte("*1\r\n$5\r\nmulti\r\n"+
+		"*4\r\n$4\r\neval\r\n$"+strconv.Itoa(len(script))+"\r\n"+script+"\r\n$1\r\n1\r\n$1\r\na\r\n"+
+		"*4\r\n$7\r\nevalsha\r\n$40\r\n"+sha[4:]+"\r\n$1\r\n1\r\n$1\r\nb\r\n"+
+		"*1\r\n$4\r\nexec\r\n")))
+	require.NoError(t, w.FlowOut(host, 1000, []byte("+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n$1\r\n1\r\n-ERR boom\r\n")))
+	require.Equal(t, int64(2), w.stats[sha].calls)
+	require.Equal(t, int64(2), w.stats[sha].keys)
+	require.Equal(t, int64(1), w.stats[sha].errors)
+	// the source was printed with the first call
+	require.Contains(t, w.printed, sha)
+
+	// a function is attributed to its library
+	require.NoError(t, w.FlowIn(host, 1000, []byte("*3\r\n$5\r\nfcall\r\n$2\r\nf1\r\n$1\r\n0\r\n")))
+	require.NoError(t, w.FlowOut(host, 1000, []byte(":1\r\n")))
+	require.Equal(t, int64(1), w.stats["function:f1"].calls)
+	require.NotContains(t, w.printed, "function:f1")
+	name, _ := w.describe("function:f1")
+	require.Equal(t, "unknown", name)
+}
@@ -1,52 +1,478 @@
 package redis
 
 import (
+	"github.com/morningli/packet_monitor/pkg/common"
+	log "github.com/sirupsen/logrus"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	unmatchedReplies    uint64
+	skippedRequests     uint64
+	decodeErrors        uint64
+	quarantinedSessions uint64
+
+	decodeMux       sync.Mutex
+	decodeSamples   []string
+	decodeStatsOnce sync.Once
+)
+
+const (
+	// maxPending bounds the requests waiting for a reply, in case the replies are never captured.
+	maxPending = 10000
+	// maxDecodeErrors quarantines a connection which likely does not speak resp at all, such as TLS.
+	maxDecodeErrors  = 10
+	maxDecodeSamples = 5
+	// invalidateChannel is where CLIENT TRACKING REDIRECT sends the invalidations.
+	invalidateChannel = "__redis__:invalidate"
+)
+
+func recordDecodeError(err *DecodeError) {
+	atomic.AddUint64(&decodeErrors, 1)
+	decodeMux.Lock()
+	if len(decodeSamples) < maxDecodeSamples {
+		decodeSamples = append(decodeSamples, err.Error())
+	}
+	decodeMux.Unlock()
+}
+
+func reportDecodeErrors() {
+	for {
+		time.Sleep(time.Second * 300)
+		decodeMux.Lock()
+		samples := decodeSamples
+		decodeSamples = nil
+		decodeMux.Unlock()
+
+		log.Infof("[Stats]decode error:%d,quarantined session:%d,unmatched reply:%d,skipped request:%d",
+			atomic.LoadUint64(&decodeErrors),
+			atomic.LoadUint64(&quarantinedSessions),
+			atomic.LoadUint64(&unmatchedReplies),
+			atomic.LoadUint64(&skippedRequests))
+		for _, sample := range samples {
+			log.Infof("[Stats]decode error sample:%s", sample)
+		}
+	}
+}
+
+// Mode is the state of a connection which decides how server messages are classified.
+type Mode int
+
+const (
+	ModeNormal     Mode = iota
+	ModeSubscribed      // SUBSCRIBE/PSUBSCRIBE/SSUBSCRIBE, server sends messages as pushes
+	ModeMonitor         // MONITOR, every server line is a push
+)
+
 type Session struct {
 	address  string
 	in       *Decoder
 	out      *Decoder
 	lastTime time.Time
 	mux      sync.Mutex
-}
 
-func NewSession(address string) *Session {
-	return &Session{address: address, in: NewDecoder(true), out: NewDecoder(false), lastTime: time.Now()}
+	pair    bool
+	pending []*Command // requests waiting for their reply, in send order
+	tx      *Transaction
+	watch   []string
+
+	mode     Mode
+	tracking bool // subscribed to the invalidations redirected by CLIENT TRACKING in resp2
+	client   ClientInfo
+	db       int
+
+	batch       []Resp // reused by decode
+	skips       []int  // requests skipped before each request of batch, and after the last
+	errors      int
+	quarantined bool
+
+	unreplied func(cmds []*Command) // see SessionMgr.OnUnreplied
+	closed    func(address string)  // see SessionMgr.OnClose
 }
 
-func (s *Session) AppendAndFetch(data []byte, in bool) (ret []Resp) {
-	s.mux.Lock()
-	defer s.mux.Unlock()
+func NewSession(address string, pair bool) *Session {
+	return &Session{address: address, in: NewDecoder(true), out: NewDecoder(false), lastTime: time.Now(), pair: pair,
+		client: ClientInfo{Addr: address}}
+}
 
+// decode returns the values completed by data, they are views valid until the next call.
+func (s *Session) decode(data []byte, in bool) []Resp {
 	d := s.in
 	if !in {
 		d = s.out
 	}
 	s.lastTime = time.Now()
+	s.skips = s.skips[:0]
+	if s.quarantined {
+		return nil
+	}
 
 	d.Append(data)
+	ret := s.batch[:0]
 	for {
 		args := d.TryDecode()
+		if in {
+			s.skips = append(s.skips, d.Skipped())
+		}
 		if !args.Valid() {
 			break
 		}
 		ret = append(ret, args)
 	}
+	s.batch = ret
+	if err := d.Err(); err != nil {
+		s.fail(err)
+	}
+	return ret
+}
+
+// fail records a malformed value. A malformed request still gets its reply, it keeps its
+// place among the pending requests, see skip. After a malformed reply, the next replies
+// can no longer be paired with the pending requests, the connection state is reset.
+// A connection failing repeatedly is quarantined: its data is ignored until the session
+// expires.
+func (s *Session) fail(err *DecodeError) {
+	err.Addr = s.address
+	recordDecodeError(err)
+
+	if !err.In {
+		s.discard(s.pending, s.tx)
+		for i := range s.pending {
+			s.pending[i] = nil
+		}
+		s.pending = s.pending[:0]
+		s.tx, s.watch = nil, nil
+	}
+
+	s.errors++
+	if s.errors >= maxDecodeErrors {
+		s.quarantined = true
+		s.in.Reset()
+		s.out.Reset()
+		atomic.AddUint64(&quarantinedSessions, 1)
+		log.Warnf("[%s]quarantined after %d decode errors", s.address, s.errors)
+		if s.closed != nil {
+			s.closed(s.address)
+		}
+		return
+	}
+	log.Warn(err)
+}
+
+// discard hands the requests which will never get their reply to the unreplied callback,
+// with the commands of an open transaction.
+func (s *Session) discard(cmds []*Command, tx *Transaction) {
+	if s.unreplied == nil {
+		return
+	}
+	var ret []*Command
+	for _, c := range cmds {
+		// queued commands are handed with their EXEC or their open transaction
+		if !c.queued && !c.skipped && c.Client.match() {
+			ret = append(ret, c)
+		}
+	}
+	if tx != nil && tx.Multi.Client.match() {
+		ret = append(ret, tx.Multi)
+		ret = append(ret, tx.Commands...)
+	}
+	if len(ret) > 0 {
+		s.unreplied(ret)
+	}
+}
+
+// close discards the requests still waiting for their reply.
+func (s *Session) close() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.discard(s.pending, s.tx)
+	s.pending, s.tx = nil, nil
+}
+
+// AppendAndFetch returns the values completed by data. They are views into the decoder
+// buffer, valid until the next data of the same direction, use Resp.Clone to keep them.
+func (s *Session) AppendAndFetch(data []byte, in bool) []Resp {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	return append([]Resp(nil), s.decode(data, in)...)
+}
+
+// FetchRequests decodes client data into commands. Commands queued inside MULTI are
+// held back and returned as one unit through the Tx of the closing EXEC/DISCARD.
+func (s *Session) FetchRequests(data []byte) (ret []*Command) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	reqs := s.decode(data, true)
+	for i := range reqs {
+		s.skip(i)
+		// pending requests outlive the data, keep a copy of their arguments
+		cmd := newCommand(&reqs[i], s.lastTime, s.pair)
+		args := cmd.Args
+		s.push(cmd)
+		s.client.identify(cmd.Name(), args)
+		cmd.Client = s.client
+		cmd.DB = s.db
+		if s.track(cmd) && cmd.Client.match() {
+			ret = append(ret, cmd)
+		}
+	}
+	s.skip(len(reqs))
+	return
+}
+
+// push adds a request waiting for its reply.
+func (s *Session) push(cmd *Command) {
+	if !s.pair {
+		return
+	}
+	if len(s.pending) >= maxPending {
+		s.discard(s.pending[:1], nil)
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+	}
+	s.pending = append(s.pending, cmd)
+}
+
+// skip adds a placeholder for each request skipped before the request i of the batch,
+// so that the reply of a malformed request is not paired with the next one.
+func (s *Session) skip(i int) {
+	if i >= len(s.skips) {
+		return
+	}
+	for n := 0; n < s.skips[i]; n++ {
+		atomic.AddUint64(&skippedRequests, 1)
+		s.push(&Command{Time: s.lastTime, skipped: true})
+	}
+}
+
+// track updates the transaction state and reports whether the command should be returned by itself.
+func (s *Session) track(cmd *Command) bool {
+	switch cmd.Name() {
+	case "multi":
+		if s.tx != nil {
+			// nested MULTI is rejected by the server
+			return false
+		}
+		cmd.Retain()
+		s.tx = &Transaction{Watch: s.watch, Multi: cmd}
+		s.watch = nil
+		cmd.queued = true
+		return false
+	case "exec", "discard":
+		if s.tx == nil {
+			return true
+		}
+		s.tx.End = cmd
+		cmd.Tx = s.tx
+		s.tx = nil
+		if !s.pair && cmd.Name() == "exec" {
+			// without replies, the commands of a transaction are assumed to succeed at EXEC
+			db := s.db
+			for _, c := range cmd.Tx.Commands {
+				c.DB = db
+				db = selected(c, db)
+			}
+			s.db = db
+		}
+		return true
+	case "watch":
+		if s.tx == nil {
+			for _, key := range cmd.Args[1:] {
+				s.watch = append(s.watch, common.CloneString(key.(string)))
+			}
+		}
+		return true
+	case "unwatch":
+		s.watch = nil
+		return true
+	case "subscribe", "psubscribe", "ssubscribe":
+		s.mode = ModeSubscribed
+		cmd.expect = len(cmd.Args) - 1
+		if cmd.Name() == "subscribe" && hasArg(cmd, invalidateChannel) {
+			s.tracking = true
+		}
+	case "unsubscribe", "punsubscribe", "sunsubscribe":
+		cmd.expect = len(cmd.Args) - 1
+		if cmd.Name() == "unsubscribe" && (len(cmd.Args) == 1 || hasArg(cmd, invalidateChannel)) {
+			s.tracking = false
+		}
+	case "monitor":
+		s.mode = ModeMonitor
+	case "select":
+		// with replies the db changes once SELECT succeeds, see FetchReplies
+		if !s.pair && s.tx == nil {
+			s.db = selected(cmd, s.db)
+		}
+	case "reset":
+		s.mode = ModeNormal
+		s.tracking = false
+		if !s.pair {
+			s.db = 0
+		}
+	}
+	if s.tx != nil {
+		cmd.Retain()
+		cmd.queued = true
+		s.tx.Commands = append(s.tx.Commands, cmd)
+		return false
+	}
+	return true
+}
+
+// selected returns the db after a command, which is db unless it is a SELECT or a RESET
+// that succeeded, or was not answered yet.
+func selected(cmd *Command, db int) int {
+	if cmd.Replied() && cmd.Reply.IsError() {
+		return db
+	}
+	switch cmd.Name() {
+	case "select":
+		if len(cmd.Args) == 2 {
+			if n, err := strconv.Atoi(cmd.Args[1].(string)); err == nil {
+				return n
+			}
+		}
+	case "reset":
+		return 0
+	}
+	return db
+}
+
+// FetchReplies decodes server data, separates pushes from replies and pairs each reply
+// with the oldest pending request. It returns the commands that got their reply, with the
+// same grouping as FetchRequests, and the pushes.
+func (s *Session) FetchReplies(data []byte) (ret []*Command, pushes []*Push) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, r := range s.decode(data, false) {
+		if p := s.classify(r); p != nil {
+			if s.client.match() {
+				pushes = append(pushes, p)
+			}
+			continue
+		}
+		if len(s.pending) == 0 {
+			atomic.AddUint64(&unmatchedReplies, 1)
+			continue
+		}
+		cmd := s.pending[0]
+		if cmd.skipped {
+			s.pending[0] = nil
+			s.pending = s.pending[1:]
+			continue
+		}
+		cmd.setReply(r, s.lastTime)
+		if !s.confirmed(cmd, r) {
+			// wait for the confirmation of the next channel
+			continue
+		}
+		s.pending[0] = nil
+		s.pending = s.pending[1:]
+		if cmd.queued {
+			// QUEUED is kept until EXEC, in case the transaction is aborted
+			cmd.Retain()
+			continue
+		}
+		// commands run in the db selected when the server answers them
+		cmd.DB = s.db
+		if cmd.Tx != nil {
+			cmd.Tx.done()
+			cmd.Tx.Multi.DB = s.db
+			if cmd.Name() == "exec" && !cmd.Tx.Aborted() {
+				for _, c := range cmd.Tx.Commands {
+					c.DB = s.db
+					s.db = selected(c, s.db)
+				}
+			}
+		} else {
+			s.db = selected(cmd, s.db)
+		}
+		if cmd.Client.match() {
+			ret = append(ret, cmd)
+		}
+	}
 	return
 }
 
+// classify returns the reply as a push if it is not an answer to a request.
+func (s *Session) classify(r Resp) *Push {
+	kind := pushKind(&r)
+	if s.tracking && (r.Type() == '*' || r.Type() == '>') && kind == "message" && r.Len() == 3 {
+		// redirected invalidations are messages of their channel, they are reported like
+		// the resp3 pushes of a connection tracking its own keys
+		if channel := r.Item(1); common.BytesToString(channel.Bytes()) == invalidateChannel {
+			keys := r.Item(2)
+			return &Push{Kind: "invalidate", Args: []interface{}{[]byte("invalidate"), keys.Value()},
+				Size: r.Size(), Time: s.lastTime}
+		}
+	}
+	switch {
+	case r.Type() == '>' && !isSubscribeKind(kind):
+	case s.mode == ModeSubscribed && r.Type() == '*' && isMessageKind(kind):
+	case s.mode == ModeMonitor && len(s.pending) == 0 && r.Type() == '+':
+		kind = "monitor"
+	default:
+		return nil
+	}
+	return &Push{Kind: kind, Args: pushArgs(&r), Size: r.Size(), Time: s.lastTime}
+}
+
+// hasArg reports whether one of the arguments of a command is arg.
+func hasArg(cmd *Command, arg string) bool {
+	for _, v := range cmd.Args[1:] {
+		if v.(string) == arg {
+			return true
+		}
+	}
+	return false
+}
+
+// confirmed consumes a subscribe family confirmation and reports whether the command got all of them.
+func (s *Session) confirmed(cmd *Command, r Resp) bool {
+	kind := pushKind(&r)
+	if !isSubscribeKind(kind) || kind != cmd.Name() {
+		return true
+	}
+	count := -1
+	if r.Len() == 3 {
+		last := r.Item(2)
+		if n, err := common.Btoi(last.Bytes()); err == nil {
+			count = n
+		}
+	}
+	if count == 0 {
+		s.mode = ModeNormal
+	}
+	cmd.expect--
+	if cmd.expect > 0 {
+		return false
+	}
+	// unsubscribe without arguments is confirmed once per channel until none is left
+	return cmd.expect == 0 || count <= 0
+}
+
 type SessionMgr struct {
-	mux      sync.RWMutex
-	sessions map[string]*Session
+	mux       sync.RWMutex
+	sessions  map[string]*Session
+	pair      bool
+	unreplied func(cmds []*Command)
+	closed    func(address string)
 }
 
 const sessionTimeout = time.Minute * 30
 
-func NewSessionMgr() *SessionMgr {
-	mgr := &SessionMgr{sessions: map[string]*Session{}}
+// NewSessionMgr creates a session manager, pair means requests are kept until their replies arrive.
+func NewSessionMgr(pair bool) *SessionMgr {
+	mgr := &SessionMgr{sessions: map[string]*Session{}, pair: pair}
+	decodeStatsOnce.Do(func() {
+		go reportDecodeErrors()
+	})
 	go func() {
 		tick := time.NewTicker(time.Minute * 5)
 		defer tick.Stop()
@@ -71,11 +497,9 @@ func NewSessionMgr() *SessionMgr {
 			}
 			mgr.mux.RUnlock()
 
-			mgr.mux.Lock()
 			for _, addr := range expireSessions {
-				delete(mgr.sessions, addr)
+				mgr.Close(addr)
 			}
-			mgr.mux.Unlock()
 		}
 	}()
 	return mgr
@@ -97,7 +521,9 @@ func (s *SessionMgr) session(address string) *Session {
 	if ok {
 		return session
 	}
-	session = NewSession(address)
+	session = NewSession(address, s.pair)
+	session.unreplied = s.unreplied
+	session.closed = s.closed
 	s.sessions[address] = session
 	return session
 }
@@ -106,3 +532,43 @@ func (s *SessionMgr) AppendAndFetch(address string, data []byte, in bool) []Resp
 	session := s.session(address)
 	return session.AppendAndFetch(data, in)
 }
+
+func (s *SessionMgr) FetchRequests(address string, data []byte) []*Command {
+	session := s.session(address)
+	return session.FetchRequests(data)
+}
+
+func (s *SessionMgr) FetchReplies(address string, data []byte) ([]*Command, []*Push) {
+	session := s.session(address)
+	return session.FetchReplies(data)
+}
+
+// Close forgets the session of a connection which has been closed, so that a new connection
+// reusing the address starts with fresh state.
+func (s *SessionMgr) Close(address string) {
+	s.mux.Lock()
+	session, ok := s.sessions[address]
+	delete(s.sessions, address)
+	s.mux.Unlock()
+	if ok {
+		session.close()
+		if s.closed != nil {
+			s.closed(address)
+		}
+	}
+}
+
+// OnUnreplied sets a callback for the requests which will never get their reply: evicted
+// when too many are pending, or pending when the connection fails, closes or expires.
+// The commands are in request order, transactions not expanded. It must be set before
+// the first data.
+func (s *SessionMgr) OnUnreplied(f func(cmds []*Command)) {
+	s.unreplied = f
+}
+
+// OnClose sets a callback for the connections whose state is dropped: closed, expired or
+// quarantined, it may be called more than once for a connection. It must be set before
+// the first data.
+func (s *SessionMgr) OnClose(f func(address string)) {
+	s.closed = f
+}
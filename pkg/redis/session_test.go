@@ -0,0 +1,220 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestSession_Transaction(t *testing.T) {
+	t.Run("exec", func(t *testing.T) {
+		s := NewSession("127.0.0.1:1000", true)
+		cmds := s.FetchRequests([]byte("*2\r\n$5\r\nwatch\r\n$1\r\na\r\n*1\r\n$5\r\nmulti\r\n*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n" +
+			"*2\r\n$4\r\nincr\r\n$1\r\nb\r\n*1\r\n$4\r\nexec\r\n*2\r\n$3\r\nget\r\n$1\r\na\r\n"))
+		require.Len(t, cmds, 3)
+		require.Equal(t, "watch", cmds[0].Name())
+		require.Equal(t, "exec", cmds[1].Name())
+		require.Equal(t, "get", cmds[2].Name())
+
+		tx := cmds[1].Tx
+		require.NotNil(t, tx)
+		require.Equal(t, []string{"a"}, tx.Watch)
+		require.Equal(t, "multi", tx.Multi.Name())
+		require.Len(t, tx.Commands, 2)
+
+		replies, _ := s.FetchReplies([]byte("+OK\r\n+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n+OK\r\n:2\r\n$1\r\n1\r\n"))
+		require.Len(t, replies, 3)
+		require.False(t, tx.Aborted())
+		require.Equal(t, []byte("OK"), tx.Commands[0].Reply.Value())
+		require.Equal(t, []byte("2"), tx.Commands[1].Reply.Value())
+		require.Equal(t, []byte("1"), cmds[2].Reply.Value())
+	})
+
+	t.Run("aborted", func(t *testing.T) {
+		s := NewSession("127.0.0.1:1000", true)
+		cmds := s.FetchRequests([]byte("*1\r\n$5\r\nmulti\r\n*2\r\n$4\r\nincr\r\n$1\r\nb\r\n*1\r\n$4\r\nexec\r\n"))
+		require.Len(t, cmds, 1)
+		replies, _ := s.FetchReplies([]byte("+OK\r\n+QUEUED\r\n*-1\r\n"))
+		require.Len(t, replies, 1)
+		require.True(t, cmds[0].Tx.Aborted())
+		require.Equal(t, []byte("QUEUED"), cmds[0].Tx.Commands[0].Reply.Value())
+	})
+
+	t.Run("discard", func(t *testing.T) {
+		s := NewSession("127.0.0.1:1000", false)
+		cmds := s.FetchRequests([]byte("*1\r\n$5\r\nmulti\r\n*2\r\n$4\r\nincr\r\n$1\r\nb\r\n*1\r\n$7\r\ndiscard\r\n"))
+		require.Len(t, cmds, 1)
+		require.True(t, cmds[0].Tx.Discarded())
+		require.Len(t, cmds[0].Tx.Commands, 1)
+	})
+}
+
+func TestSession_Select(t *testing.T) {
+	req := func(args ...string) string {
+		return string(AppendRequest(nil, func() []interface{} {
+			ret := make([]interface{}, len(args))
+			for i, v := range args {
+				ret[i] = v
+			}
+			return ret
+		}()))
+	}
+
+	t.Run("replies", func(t *testing.T) {
+		s := NewSession("127.0.0.1:1000", true)
+		cmds := s.FetchRequests([]byte(req("select", "99") + req("get", "a") +
+			req("multi") + req("select", "1") + req("discard") + req("get", "a") +
+			req("select", "3") + req("get", "a") +
+			req("multi") + req("select", "2") + req("set", "a", "1") + req("exec") + req("get", "a")))
+		require.Len(t, cmds, 8)
+		replies, _ := s.FetchReplies([]byte("-ERR DB index is out of range\r\n$-1\r\n" +
+			"+OK\r\n+QUEUED\r\n+OK\r\n$-1\r\n" +
+			"+OK\r\n$-1\r\n" +
+			"+OK\r\n+QUEUED\r\n+QUEUED\r\n*2\r\n+OK\r\n+OK\r\n$1\r\n1\r\n"))
+		require.Len(t, replies, 8)
+		var dbs []int
+		for _, c := range expand(replies) {
+			dbs = append(dbs, c.DB)
+		}
+		// select 99, get, multi, select 1, discard, get, select 3, get, multi, select 2, set, exec, get
+		require.Equal(t, []int{0, 0, 0, 0, 0, 0, 0, 3, 3, 3, 2, 3, 2}, dbs)
+	})
+
+	t.Run("requests", func(t *testing.T) {
+		s := NewSession("127.0.0.1:1000", false)
+		cmds := s.FetchRequests([]byte(req("multi") + req("select", "1") + req("discard") + req("get", "a") +
+			req("multi") + req("select", "2") + req("set", "a", "1") + req("exec") + req("get", "a")))
+		require.Len(t, cmds, 4)
+		require.Equal(t, 0, cmds[1].DB)
+		require.Equal(t, 2, cmds[2].Tx.Commands[1].DB)
+		require.Equal(t, 2, cmds[3].DB)
+	})
+}
+
+func TestSession_Push(t *testing.T) {
+	t.Run("subscribe", func(t *testing.T) {
+		s := NewSession("127.0.0.1:1000", true)
+		cmds := s.FetchRequests([]byte("*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n$1\r\nb\r\n"))
+		require.Len(t, cmds, 1)
+		require.Equal(t, ModeSubscribed, s.mode)
+
+		replies, pushes := s.FetchReplies([]byte("*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n"))
+		require.Len(t, replies, 0)
+		require.Len(t, pushes, 0)
+		replies, pushes = s.FetchReplies([]byte("*3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$5\r\nhello\r\n"))
+		require.Len(t, replies, 1)
+		require.Len(t, pushes, 1)
+		require.Equal(t, "message", pushes[0].Kind)
+		require.Equal(t, []byte("hello"), pushes[0].Args[2])
+
+		cmds = s.FetchRequests([]byte("*1\r\n$11\r\nunsubscribe\r\n"))
+		require.Len(t, cmds, 1)
+		replies, _ = s.FetchReplies([]byte("*3\r\n$11\r\nunsubscribe\r\n$1\r\na\r\n:1\r\n"))
+		require.Len(t, replies, 0)
+		replies, _ = s.FetchReplies([]byte("*3\r\n$11\r\nunsubscribe\r\n$1\r\nb\r\n:0\r\n"))
+		require.Len(t, replies, 1)
+		require.Equal(t, ModeNormal, s.mode)
+	})
+
+	t.Run("resp3", func(t *testing.T) {
+		s := NewSession("127.0.0.1:1000", true)
+		s.FetchRequests([]byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n"))
+		replies, pushes := s.FetchReplies([]byte(">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\na\r\n$1\r\n1\r\n"))
+		require.Len(t, replies, 1)
+		require.Equal(t, []byte("1"), replies[0].Reply.Value())
+		require.Len(t, pushes, 1)
+		require.Equal(t, "invalidate", pushes[0].Kind)
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		// the connection receiving the invalidations of CLIENT TRACKING ON REDIRECT in resp2
+		s := NewSession("127.0.0.1:1000", true)
+		s.FetchRequests([]byte("*3\r\n$9\r\nsubscribe\r\n$20\r\n__redis__:invalidate\r\n$1\r\na\r\n"))
+		replies, pushes := s.FetchReplies([]byte("*3\r\n$9\r\nsubscribe\r\n$20\r\n__redis__:invalidate\r\n:1\r\n" +
+			"*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:2\r\n" +
+			"*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$1\r\nk\r\n" +
+			"*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$5\r\nhello\r\n"))
+		require.Len(t, replies, 1)
+		require.Len(t, pushes, 2)
+		require.Equal(t, "invalidate", pushes[0].Kind)
+		require.Len(t, pushes[0].Args[1], 1)
+		require.Equal(t, "message", pushes[1].Kind)
+
+		s.FetchRequests([]byte("*2\r\n$11\r\nunsubscribe\r\n$20\r\n__redis__:invalidate\r\n"))
+		_, pushes = s.FetchReplies([]byte("*3\r\n$11\r\nunsubscribe\r\n$20\r\n__redis__:invalidate\r\n:1\r\n" +
+			"*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n*1\r\n$1\r\nk\r\n"))
+		require.Len(t, pushes, 1)
+		require.Equal(t, "message", pushes[0].Kind)
+	})
+
+	t.Run("monitor", func(t *testing.T) {
+		s := NewSession("127.0.0.1:1000", true)
+		s.FetchRequests([]byte("*1\r\n$7\r\nmonitor\r\n"))
+		replies, pushes := s.FetchReplies([]byte("+OK\r\n+1700000000.000000 [0 127.0.0.1:1001] \"get\" \"a\"\r\n"))
+		require.Len(t, replies, 1)
+		require.Len(t, pushes, 1)
+		require.Equal(t, "monitor", pushes[0].Kind)
+	})
+}
+
+func TestSession_Client(t *testing.T) {
+	s := NewSession("127.0.0.1:1000", false)
+	cmds := s.FetchRequests([]byte("*4\r\n$5\r\nhello\r\n$1\r\n3\r\n$7\r\nsetname\r\n$3\r\napp\r\n" +
+		"*4\r\n$6\r\nclient\r\n$7\r\nsetinfo\r\n$8\r\nlib-name\r\n$8\r\ngo-redis\r\n*2\r\n$3\r\nget\r\n$1\r\na\r\n"))
+	require.Len(t, cmds, 3)
+	require.Equal(t, ClientInfo{Addr: "127.0.0.1:1000", Name: "app", Lib: "go-redis"}, cmds[2].Client)
+	require.Equal(t, "127.0.0.1:1000", cmds[2].Client.Label())
+
+	SetGroupByName(true)
+	SetClientFilter("other-*")
+	defer SetGroupByName(false)
+	defer SetClientFilter("")
+	require.Equal(t, "app", cmds[2].Client.Label())
+	// the text output keeps the address where MONITOR has it
+	require.Contains(t, string(appendCommand(nil, cmds[2], "")), ` [0 127.0.0.1:1000 name=app] "get" "a"`)
+	require.Equal(t, "127.0.0.1", (&ClientInfo{Addr: "127.0.0.1:1000"}).Label())
+	cmds = s.FetchRequests([]byte("*2\r\n$3\r\nget\r\n$1\r\na\r\n"))
+	require.Len(t, cmds, 0)
+}
+
+func TestSession_DecodeError(t *testing.T) {
+	t.Run("request", func(t *testing.T) {
+		s := NewSession("127.0.0.1:1000", true)
+		cmds := s.FetchRequests([]byte("*1\r\n$4\r\nping\r\n"))
+		require.Len(t, cmds, 1)
+		require.Len(t, s.pending, 1)
+
+		// the malformed request is skipped, but keeps its place for its reply
+		cmds = s.FetchRequests([]byte("*2\r\n$x\r\n*2\r\n$3\r\nget\r\n$1\r\na\r\n"))
+		require.Len(t, cmds, 1)
+		require.Equal(t, "get", cmds[0].Name())
+		require.Len(t, s.pending, 3)
+		require.Equal(t, 1, s.errors)
+
+		replies, _ := s.FetchReplies([]byte("+PONG\r\n-ERR Protocol error\r\n$1\r\n1\r\n"))
+		require.Len(t, replies, 2)
+		require.Equal(t, "ping", replies[0].Name())
+		require.Equal(t, []byte("PONG"), replies[0].Reply.Bytes())
+		require.Equal(t, "get", replies[1].Name())
+		require.Equal(t, []byte("1"), replies[1].Reply.Bytes())
+		require.Len(t, s.pending, 0)
+	})
+
+	t.Run("reply", func(t *testing.T) {
+		s := NewSession("127.0.0.1:1000", true)
+		s.FetchRequests([]byte("*1\r\n$4\r\nping\r\n*2\r\n$3\r\nget\r\n$1\r\na\r\n"))
+
+		// the replies after a malformed one cannot be paired anymore
+		replies, _ := s.FetchReplies([]byte("$x\r\n"))
+		require.Len(t, replies, 0)
+		require.Len(t, s.pending, 0)
+	})
+
+	t.Run("quarantine", func(t *testing.T) {
+		s := NewSession("127.0.0.1:1000", false)
+		for i := 0; i < maxDecodeErrors; i++ {
+			require.Len(t, s.FetchRequests([]byte("*1\r\n$x\r\n")), 0)
+		}
+		require.True(t, s.quarantined)
+		require.Len(t, s.FetchRequests([]byte("*1\r\n$4\r\nping\r\n")), 0)
+	})
+}
@@ -0,0 +1,192 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const topSlots = 10
+
+type slotStat struct {
+	ops   int64
+	bytes int64
+}
+
+type redirect struct {
+	client string
+	kind   string // MOVED or ASK
+	node   string
+}
+
+type redirectStat struct {
+	count int64
+	slots map[int]struct{}
+}
+
+// SlotWriter reports traffic per cluster hash slot and the MOVED/ASK redirections of each client.
+type SlotWriter struct {
+	sessions  *SessionMgr
+	period    *common.Period
+	rangeSize int
+	mux       sync.Mutex
+	slots     []slotStat
+	redirects map[redirect]*redirectStat
+}
+
+func NewSlotWriter(interval time.Duration, rangeSize int) *SlotWriter {
+	if rangeSize <= 0 || rangeSize > common.SlotNum {
+		rangeSize = 1024
+	}
+	return &SlotWriter{
+		sessions:  NewSessionMgr(true),
+		period:    common.NewPeriod(interval),
+		rangeSize: rangeSize,
+		slots:     make([]slotStat, common.SlotNum),
+		redirects: map[redirect]*redirectStat{},
+	}
+}
+
+func (w *SlotWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	requests := w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
+	if len(requests) == 0 {
+		return nil
+	}
+
+	w.mux.Lock()
+	for _, r := range expand(requests) {
+		last := -1
+		for _, key := range r.Keys() {
+			// multi key commands are counted once, their keys must share a slot anyway
+			slot := common.Slot(key)
+			if slot == last {
+				continue
+			}
+			last = slot
+			w.slots[slot].ops++
+			w.slots[slot].bytes += int64(r.Size)
+		}
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+// parseRedirect parses -MOVED 3999 127.0.0.1:6381 and -ASK 3999 127.0.0.1:6381.
+func parseRedirect(reply Resp) (kind string, slot int, node string, ok bool) {
+	if reply.Type() != '-' {
+		return
+	}
+	fields := strings.Fields(common.BytesToString(reply.Bytes()))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return
+	}
+	slot, err := common.Btoi([]byte(fields[1]))
+	if err != nil {
+		return
+	}
+	return fields[0], slot, common.CloneString(fields[2]), true
+}
+
+func (w *SlotWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	replies, _ := w.sessions.FetchReplies(common.RemoteKey(dstHost, dstPort), data)
+
+	w.mux.Lock()
+	for _, r := range replies {
+		kind, slot, node, ok := parseRedirect(r.Reply)
+		if !ok {
+			continue
+		}
+		k := redirect{client: r.Client.Label(), kind: kind, node: node}
+		stat, ok := w.redirects[k]
+		if !ok {
+			stat = &redirectStat{slots: map[int]struct{}{}}
+			w.redirects[k] = stat
+		}
+		stat.count++
+		stat.slots[slot] = struct{}{}
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+// FlowClose drops the state of the connection, a new connection on its address starts afresh.
+func (w *SlotWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+func (w *SlotWriter) report() {
+	oldTime, ok := w.period.Elapsed()
+	if !ok {
+		return
+	}
+
+	w.mux.Lock()
+	slots := w.slots
+	w.slots = make([]slotStat, common.SlotNum)
+	redirects := w.redirects
+	w.redirects = map[redirect]*redirectStat{}
+	w.mux.Unlock()
+
+	seconds := w.period.Seconds()
+	top := make([]int, 0, topSlots+1)
+	for slot := range slots {
+		if slots[slot].ops == 0 {
+			continue
+		}
+		i := sort.Search(len(top), func(i int) bool { return slots[top[i]].ops < slots[slot].ops })
+		if i >= topSlots {
+			continue
+		}
+		top = append(top, 0)
+		copy(top[i+1:], top[i:])
+		top[i] = slot
+		if len(top) > topSlots {
+			top = top[:topSlots]
+		}
+	}
+	for _, slot := range top {
+		fmt.Printf("[%d]slot:%d, ops:%d(%.2f/s), bytes:%d\n",
+			oldTime, slot, slots[slot].ops, float64(slots[slot].ops)/seconds, slots[slot].bytes)
+	}
+
+	for start := 0; start < common.SlotNum; start += w.rangeSize {
+		end := start + w.rangeSize
+		if end > common.SlotNum {
+			end = common.SlotNum
+		}
+		var total slotStat
+		for _, s := range slots[start:end] {
+			total.ops += s.ops
+			total.bytes += s.bytes
+		}
+		if total.ops == 0 {
+			continue
+		}
+		fmt.Printf("[%d]slots:%d-%d, ops:%d(%.2f/s), bytes:%d\n",
+			oldTime, start, end-1, total.ops, float64(total.ops)/seconds, total.bytes)
+	}
+
+	keys := make([]redirect, 0, len(redirects))
+	for k := range redirects {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return redirects[keys[i]].count > redirects[keys[j]].count })
+	for _, k := range keys {
+		stat := redirects[k]
+		hint := ""
+		if k.kind == "MOVED" {
+			hint = ", stale slot map"
+		}
+		fmt.Printf("[%d]redirect client:%s, type:%s, node:%s, count:%d, slots:%d%s\n",
+			oldTime, k.client, k.kind, k.node, stat.count, len(stat.slots), hint)
+	}
+}
@@ -0,0 +1,327 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"github.com/redis/go-redis/v9"
+	log "github.com/sirupsen/logrus"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	runningWrite int64
+	success      uint64
+	fail         uint64
+	dropped      uint64
+	filtered     uint64 // by the replay rules
+)
+
+const (
+	maxTargetConns = 10000
+	maxQueued      = 10000
+)
+
+// LogTargetStats logs the progress of the commands replayed on targets.
+func LogTargetStats() {
+	log.Infof("[Stats]running write:%d,success request:%d,fail:%d,dropped:%d,filtered:%d",
+		atomic.LoadInt64(&runningWrite),
+		atomic.LoadUint64(&success),
+		atomic.LoadUint64(&fail),
+		atomic.LoadUint64(&dropped),
+		atomic.LoadUint64(&filtered))
+}
+
+// Target replays the commands of captured client connections on a single instance or a
+// cluster. Each client connection is mapped to its own queue, which sends its commands in
+// order. On a single instance the queue owns a dedicated connection, so that SELECT,
+// CLIENT SETNAME, WATCH and MULTI apply as they did on the source. On a cluster commands
+// are routed by key through a pool, transactions are sent at EXEC with MULTI/EXEC and
+// the commands which only change the state of a connection are skipped.
+type Target struct {
+	client  redis.UniversalClient
+	cluster bool
+	mux     sync.Mutex
+	conns   map[string]*targetConn
+	wg      sync.WaitGroup
+	done    chan struct{}
+}
+
+// targetConn is the queue of one client connection.
+type targetConn struct {
+	client   string
+	mux      sync.Mutex
+	pending  [][]interface{}
+	closed   bool
+	signal   chan struct{}
+	lastTime time.Time
+
+	conn  *redis.Conn              // single instance
+	state map[string][]interface{} // SELECT and CLIENT SETNAME, sent again on a new connection
+	multi bool                     // cluster
+	tx    [][]interface{}          // cluster, commands queued since MULTI
+}
+
+// NewTarget connects to address, a list of nodes separated by ',' for a cluster.
+func NewTarget(address string, cluster bool) *Target {
+	t := &Target{cluster: cluster, conns: map[string]*targetConn{}, done: make(chan struct{})}
+	if cluster {
+		t.client = redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:          strings.Split(address, ","),
+			PoolSize:       400,
+			MaxActiveConns: 400,
+			MaxRetries:     -1,
+			MinIdleConns:   10,
+			MaxIdleConns:   10,
+		})
+	} else {
+		t.client = redis.NewClient(&redis.Options{
+			Addr:           address,
+			PoolSize:       maxTargetConns,
+			MaxActiveConns: maxTargetConns,
+			MaxRetries:     -1,
+			MinIdleConns:   10,
+			MaxIdleConns:   10,
+		})
+	}
+	go t.expire()
+	return t
+}
+
+// expire closes the mappings of clients which sent nothing for a while, in case their close was not seen.
+func (t *Target) expire() {
+	tick := time.NewTicker(time.Minute)
+	defer tick.Stop()
+	for {
+		select {
+		case <-tick.C:
+		case <-t.done:
+			return
+		}
+		t.mux.Lock()
+		for client, c := range t.conns {
+			c.mux.Lock()
+			idle := time.Since(c.lastTime) > sessionTimeout
+			c.mux.Unlock()
+			if idle {
+				t.closeLocked(client, c)
+			}
+		}
+		t.mux.Unlock()
+	}
+}
+
+// Send queues a command of a client connection.
+func (t *Target) Send(client string, args []interface{}) {
+	if len(args) == 0 {
+		return
+	}
+	t.mux.Lock()
+	c, ok := t.conns[client]
+	if !ok {
+		c = &targetConn{client: client, signal: make(chan struct{}, 1)}
+		t.conns[client] = c
+		t.wg.Add(1)
+		go t.run(c)
+	}
+	c.mux.Lock()
+	c.lastTime = time.Now()
+	full := len(c.pending) >= maxQueued
+	if !full {
+		c.pending = append(c.pending, args)
+	}
+	c.mux.Unlock()
+	t.mux.Unlock()
+
+	if full {
+		if atomic.AddUint64(&dropped, 1)%10000 == 1 {
+			log.Warnf("[%s]too many queued commands, dropped", client)
+		}
+		return
+	}
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+// CloseClient closes the mapping of a client connection once its queued commands are sent.
+func (t *Target) CloseClient(client string) {
+	t.mux.Lock()
+	if c, ok := t.conns[client]; ok {
+		t.closeLocked(client, c)
+	}
+	t.mux.Unlock()
+}
+
+func (t *Target) closeLocked(client string, c *targetConn) {
+	delete(t.conns, client)
+	c.mux.Lock()
+	c.closed = true
+	c.mux.Unlock()
+	select {
+	case c.signal <- struct{}{}:
+	default:
+	}
+}
+
+// Wait closes every mapping and waits until their queued commands are sent.
+func (t *Target) Wait() {
+	t.mux.Lock()
+	for client, c := range t.conns {
+		t.closeLocked(client, c)
+	}
+	t.mux.Unlock()
+	t.wg.Wait()
+}
+
+func (t *Target) Close() error {
+	t.Wait()
+	close(t.done)
+	return t.client.Close()
+}
+
+func (t *Target) run(c *targetConn) {
+	defer t.wg.Done()
+	for range c.signal {
+		c.mux.Lock()
+		pending, closed := c.pending, c.closed
+		c.pending = nil
+		c.mux.Unlock()
+
+		for _, args := range pending {
+			if t.cluster {
+				t.sendCluster(c, args)
+			} else {
+				t.sendSingle(c, args)
+			}
+		}
+		if closed {
+			if c.conn != nil {
+				_ = c.conn.Close()
+			}
+			return
+		}
+	}
+}
+
+func command(args []interface{}) string {
+	name := strings.ToLower(args[0].(string))
+	if name == "client" && len(args) > 1 {
+		name += " " + strings.ToLower(args[1].(string))
+	}
+	return name
+}
+
+func count(args []interface{}, err error) {
+	if err != nil && err != redis.Nil {
+		log.Errorf("execute command fail.args:%+v,err:%s", args, err)
+		atomic.AddUint64(&fail, 1)
+	} else {
+		atomic.AddUint64(&success, 1)
+	}
+}
+
+// skipped are the commands which would take over the connection, or end it.
+func skipped(name string) bool {
+	switch name {
+	case "subscribe", "psubscribe", "ssubscribe", "unsubscribe", "punsubscribe", "sunsubscribe",
+		"monitor", "sync", "psync", "quit":
+		return true
+	}
+	return false
+}
+
+func (t *Target) sendSingle(c *targetConn, args []interface{}) {
+	name := command(args)
+	if skipped(name) {
+		return
+	}
+	ctx := context.Background()
+	if c.conn == nil {
+		c.conn = t.client.(*redis.Client).Conn()
+		for _, state := range c.state {
+			if err := c.conn.Process(ctx, redis.NewCmd(ctx, state...)); err != nil {
+				log.Warnf("[%s]restore connection state fail.args:%+v,err:%s", c.client, state, err)
+			}
+		}
+	}
+	switch name {
+	case "select", "client setname":
+		if c.state == nil {
+			c.state = map[string][]interface{}{}
+		}
+		c.state[name] = args
+	}
+
+	atomic.AddInt64(&runningWrite, 1)
+	cmd := redis.NewCmd(ctx, args...)
+	err := c.conn.Process(ctx, cmd)
+	atomic.AddInt64(&runningWrite, -1)
+	count(args, err)
+
+	var redisErr redis.Error
+	if err != nil && err != redis.Nil && !errors.As(err, &redisErr) {
+		// the connection is broken, the next command opens a new one
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (t *Target) sendCluster(c *targetConn, args []interface{}) {
+	name := command(args)
+	if skipped(name) {
+		return
+	}
+	switch name {
+	case "multi":
+		c.multi, c.tx = true, nil
+		return
+	case "exec":
+		if c.multi {
+			t.execTx(c.tx)
+		}
+		c.multi, c.tx = false, nil
+		return
+	case "discard":
+		c.multi, c.tx = false, nil
+		return
+	case "watch", "unwatch", "select", "hello", "client setname", "readonly", "readwrite":
+		// connection state, meaningless on a pooled connection
+		return
+	}
+	if c.multi {
+		c.tx = append(c.tx, args)
+		return
+	}
+
+	atomic.AddInt64(&runningWrite, 1)
+	err := t.client.Do(context.Background(), args...).Err()
+	atomic.AddInt64(&runningWrite, -1)
+	count(args, err)
+}
+
+// execTx executes commands atomically with MULTI/EXEC on a single connection.
+func (t *Target) execTx(cmds [][]interface{}) {
+	if len(cmds) == 0 {
+		return
+	}
+	atomic.AddInt64(&runningWrite, 1)
+	defer atomic.AddInt64(&runningWrite, -1)
+	replies, err := t.client.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		for _, args := range cmds {
+			pipe.Do(context.Background(), args...)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil && len(replies) == 0 {
+		log.Errorf("execute transaction fail.commands:%d,err:%s", len(cmds), err)
+		atomic.AddUint64(&fail, uint64(len(cmds)))
+		return
+	}
+	for _, c := range replies {
+		count(c.Args(), c.Err())
+	}
+}
@@ -0,0 +1,116 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer answers +OK to every command, and records the commands of each connection.
+type fakeServer struct {
+	ln     net.Listener
+	mux    sync.Mutex
+	conns  [][]string
+	closed int
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.Nil(t, err)
+	s := &fakeServer{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mux.Lock()
+			s.conns = append(s.conns, nil)
+			id := len(s.conns) - 1
+			s.mux.Unlock()
+			go s.serve(conn, id)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) serve(conn net.Conn, id int) {
+	defer conn.Close()
+	d := NewDecoder(true)
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			s.mux.Lock()
+			s.closed++
+			s.mux.Unlock()
+			return
+		}
+		d.Append(buf[:n])
+		for r := d.TryDecodeRequest(); r.Valid(); r = d.TryDecodeRequest() {
+			args, _ := r.Value().([]interface{})
+			cmd := strings.ToLower(fmt.Sprint(args))
+			reply := "+OK\r\n"
+			switch {
+			case strings.HasPrefix(cmd, "[hello"), strings.HasPrefix(cmd, "[client setinfo"):
+				// go-redis handshake, falls back to RESP2
+				reply = "-ERR unknown command\r\n"
+			default:
+				s.mux.Lock()
+				s.conns[id] = append(s.conns[id], fmt.Sprint(args))
+				s.mux.Unlock()
+			}
+			_, _ = conn.Write([]byte(reply))
+		}
+	}
+}
+
+func TestTarget(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.ln.Close()
+
+	target := NewTarget(s.ln.Addr().String(), false)
+	for i := 0; i < 100; i++ {
+		target.Send("c1", []interface{}{"incr", fmt.Sprint(i)})
+		if i == 10 {
+			target.Send("c2", []interface{}{"select", "1"})
+			target.Send("c2", []interface{}{"client", "setname", "app"})
+			target.Send("c2", []interface{}{"multi"})
+			target.Send("c2", []interface{}{"set", "a", "1"})
+			target.Send("c2", []interface{}{"exec"})
+			target.Send("c2", []interface{}{"subscribe", "ch"})
+			target.CloseClient("c2")
+		}
+	}
+	require.Nil(t, target.Close())
+	require.Eventually(t, func() bool {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		return s.closed == len(s.conns)
+	}, time.Second, time.Millisecond*10)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var commands []string
+	stateful := false
+	for _, cmds := range s.conns {
+		if len(cmds) == 0 {
+			continue
+		}
+		if strings.HasPrefix(cmds[0], "[select") {
+			require.Equal(t, []string{"[select 1]", "[client setname app]", "[multi]", "[set a 1]", "[exec]"}, cmds)
+			stateful = true
+			continue
+		}
+		commands = cmds
+	}
+	require.True(t, stateful)
+	require.Len(t, commands, 100)
+	for i, cmd := range commands {
+		require.Equal(t, fmt.Sprintf("[incr %d]", i), cmd)
+	}
+}
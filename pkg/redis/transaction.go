@@ -0,0 +1,50 @@
+package redis
+
+import "sync/atomic"
+
+var (
+	txExec    uint64
+	txAborted uint64
+	txDiscard uint64
+)
+
+// Transaction groups the commands queued between MULTI and EXEC/DISCARD on one connection.
+type Transaction struct {
+	Watch    []string // keys watched before MULTI
+	Multi    *Command
+	Commands []*Command
+	End      *Command // EXEC or DISCARD
+}
+
+func (t *Transaction) Discarded() bool {
+	return t.End != nil && t.End.Name() == "discard"
+}
+
+// Aborted reports whether EXEC was answered with a nil reply (a watched key was modified)
+// or with an EXECABORT error.
+func (t *Transaction) Aborted() bool {
+	if t.End == nil || t.Discarded() || !t.End.Replied() {
+		return false
+	}
+	return t.End.Reply.Null() || t.End.Reply.Type() == '-'
+}
+
+// done matches the EXEC reply array back to the queued commands.
+func (t *Transaction) done() {
+	if t.Discarded() {
+		atomic.AddUint64(&txDiscard, 1)
+		return
+	}
+	if t.Aborted() {
+		atomic.AddUint64(&txAborted, 1)
+		return
+	}
+	atomic.AddUint64(&txExec, 1)
+	replies := &t.End.Reply
+	if !replies.IsArray() {
+		return
+	}
+	for i := 0; i < replies.Len() && i < len(t.Commands); i++ {
+		t.Commands[i].setReply(replies.Item(i), t.End.ReplyTime)
+	}
+}
@@ -0,0 +1,332 @@
+package redis
+
+import (
+	"fmt"
+	"github.com/HdrHistogram/hdrhistogram-go"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/common"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxTTL       = int64(10 * 365 * 24 * time.Hour / time.Second)
+	maxTTLKeys   = 100000
+	ttlSamples   = 10
+	minRefreshes = 2
+)
+
+var ttlPercentiles = []float64{50, 90, 99}
+
+// how a write changes the ttl of its keys
+const (
+	ttlNone    = iota // no change: reads, and writes which keep the ttl
+	ttlSet            // EX/PX/EXAT/PXAT, SETEX, EXPIRE family, GETEX with an expiration
+	ttlKeep           // SET KEEPTTL
+	ttlClear          // the value is overwritten without expiration, an existing ttl is dropped
+	ttlPersist        // PERSIST, GETEX PERSIST
+)
+
+// expiration returns how a command changes the ttl of its keys, and the ttl it sets.
+func expiration(cmd string, args []interface{}, now time.Time) (action int, ttl time.Duration) {
+	arg := func(i int) int64 {
+		if i >= len(args) {
+			return 0
+		}
+		n, _ := strconv.ParseInt(args[i].(string), 10, 64)
+		return n
+	}
+	option := func(opt string, v int64) (int, time.Duration) {
+		switch opt {
+		case "ex":
+			return ttlSet, time.Duration(v) * time.Second
+		case "px":
+			return ttlSet, time.Duration(v) * time.Millisecond
+		case "exat":
+			return ttlSet, time.Unix(v, 0).Sub(now)
+		case "pxat":
+			return ttlSet, time.UnixMilli(v).Sub(now)
+		case "keepttl":
+			return ttlKeep, 0
+		case "persist":
+			return ttlPersist, 0
+		}
+		return ttlNone, 0
+	}
+
+	switch cmd {
+	case "set", "getex":
+		first := 2
+		action = ttlClear
+		if cmd == "getex" {
+			first, action = 1, ttlNone
+		}
+		for i := first + 1; i < len(args); i++ {
+			opt := strings.ToLower(args[i].(string))
+			if opt == "nx" {
+				// only creates the key, nothing to drop
+				action = ttlNone
+			}
+			if a, d := option(opt, arg(i+1)); a != ttlNone {
+				return a, d
+			}
+		}
+		return action, 0
+	case "setex":
+		return ttlSet, time.Duration(arg(2)) * time.Second
+	case "psetex":
+		return ttlSet, time.Duration(arg(2)) * time.Millisecond
+	case "expire":
+		return option("ex", arg(2))
+	case "pexpire":
+		return option("px", arg(2))
+	case "expireat":
+		return option("exat", arg(2))
+	case "pexpireat":
+		return option("pxat", arg(2))
+	case "getset", "mset":
+		return ttlClear, 0
+	case "persist":
+		return ttlPersist, 0
+	}
+	return ttlNone, 0
+}
+
+type ttlStat struct {
+	ttl     *hdrhistogram.Histogram // seconds
+	keep    int64
+	noTTL   int64 // keys written during the interval which never got a ttl
+	dropped int64 // overwrites of keys with a ttl
+	persist int64
+}
+
+func newTTLStat() *ttlStat {
+	return &ttlStat{ttl: hdrhistogram.New(1, maxTTL, 2)}
+}
+
+// ttlKey is what the capture knows about the ttl of a key.
+type ttlKey struct {
+	ttl       bool // has a ttl
+	written   bool // written during the interval without a ttl
+	read      bool // read since the ttl was last set
+	reads     int
+	refreshes int // ttl set again on a key with a ttl which was read in between
+	seen      bool
+	client    string
+}
+
+// TTLWriter reports how applications set expirations: the distribution of ttls per key
+// pattern and client, keys written without ttl, keys whose ttl is refreshed on every read
+// and overwrites which drop a ttl. Only what the capture shows is known, keys written
+// before it started are assumed to have no ttl.
+type TTLWriter struct {
+	sessions  *SessionMgr
+	period    *common.Period
+	mux       sync.Mutex
+	patterns  map[string]*ttlStat
+	clients   map[string]*ttlStat
+	keys      map[string]*ttlKey
+	untracked int64
+	drops     []string
+}
+
+func NewTTLWriter(interval time.Duration) *TTLWriter {
+	w := &TTLWriter{sessions: NewSessionMgr(false), period: common.NewPeriod(interval), keys: map[string]*ttlKey{}}
+	w.patterns, w.clients = map[string]*ttlStat{}, map[string]*ttlStat{}
+	return w
+}
+
+func ttlStatOf(stats map[string]*ttlStat, name string, limit int) *ttlStat {
+	s, ok := stats[name]
+	if !ok {
+		if limit > 0 && len(stats) >= limit {
+			return ttlStatOf(stats, otherPattern, 0)
+		}
+		s = newTTLStat()
+		stats[name] = s
+	}
+	return s
+}
+
+// key returns the state of a key, nil when too many keys are tracked already.
+func (w *TTLWriter) key(key string, create bool) *ttlKey {
+	k, ok := w.keys[key]
+	if !ok {
+		if !create {
+			return nil
+		}
+		if len(w.keys) >= maxTTLKeys {
+			w.untracked++
+			return nil
+		}
+		k = &ttlKey{}
+		w.keys[common.CloneString(key)] = k
+	}
+	k.seen = true
+	return k
+}
+
+func (w *TTLWriter) add(r *Command) {
+	cmd := r.Name()
+	keys := r.Keys()
+	if len(keys) == 0 {
+		return
+	}
+	read, write := common.IsRead(cmd), common.IsWrite(cmd)
+	action, ttl := expiration(cmd, r.Args, r.Time)
+	if !read && !write && action == ttlNone {
+		return
+	}
+	client := r.Client.Label()
+
+	for _, key := range keys {
+		switch cmd {
+		case "del", "unlink":
+			delete(w.keys, key)
+			continue
+		}
+		k := w.key(key, write || action != ttlNone)
+		if read && k != nil {
+			k.reads++
+			k.read = true
+		}
+		if action == ttlNone {
+			if write && k != nil && !k.ttl {
+				k.client, k.written = client, true
+			}
+			continue
+		}
+		pattern := ttlStatOf(w.patterns, KeyPattern(key), maxPatterns)
+		for _, s := range []*ttlStat{pattern, ttlStatOf(w.clients, client, 0)} {
+			switch action {
+			case ttlSet:
+				seconds := int64(ttl / time.Second)
+				if seconds < 1 {
+					seconds = 1
+				}
+				_ = s.ttl.RecordValue(seconds)
+			case ttlKeep:
+				s.keep++
+			case ttlPersist:
+				s.persist++
+			case ttlClear:
+				if k != nil && k.ttl {
+					s.dropped++
+				}
+			}
+		}
+		if k == nil {
+			continue
+		}
+		k.client = client
+		switch action {
+		case ttlSet:
+			if k.ttl && k.read {
+				k.refreshes++
+			}
+			k.ttl, k.written, k.read = true, false, false
+		case ttlClear:
+			if k.ttl && len(w.drops) < ttlSamples {
+				w.drops = append(w.drops, fmt.Sprintf("%s %s %s", client, cmd, key))
+			}
+			k.ttl, k.written = false, true
+		case ttlPersist:
+			k.ttl = false
+		}
+	}
+}
+
+func (w *TTLWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	requests := w.sessions.FetchRequests(common.RemoteKey(srcHost, srcPort), data)
+
+	w.mux.Lock()
+	for _, r := range expand(requests) {
+		if r.Tx != nil && r.Tx.Discarded() {
+			continue
+		}
+		w.add(r)
+	}
+	w.mux.Unlock()
+
+	w.report()
+	return nil
+}
+
+func (w *TTLWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	return nil
+}
+
+// FlowClose drops the state of the connection, a new connection on its address starts afresh.
+func (w *TTLWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.sessions.Close(common.RemoteKey(host, port))
+}
+
+func printTTLStats(oldTime int64, kind string, stats map[string]*ttlStat) {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	writes := func(s *ttlStat) int64 { return s.ttl.TotalCount() + s.keep + s.noTTL + s.persist }
+	sort.Slice(names, func(i, j int) bool { return writes(stats[names[i]]) > writes(stats[names[j]]) })
+	for _, name := range names {
+		s := stats[name]
+		percentiles := ""
+		for _, p := range ttlPercentiles {
+			percentiles += fmt.Sprintf(" p%g:%ds,", p, s.ttl.ValueAtQuantile(p))
+		}
+		fmt.Printf("[%d]ttl %s:%s, set:%d, keepttl:%d, no ttl:%d, dropped:%d, persist:%d, ttl%s max:%ds\n",
+			oldTime, kind, name, s.ttl.TotalCount(), s.keep, s.noTTL, s.dropped, s.persist, percentiles, s.ttl.Max())
+	}
+}
+
+func (w *TTLWriter) report() {
+	oldTime, ok := w.period.Elapsed()
+	if !ok {
+		return
+	}
+
+	w.mux.Lock()
+	patterns, clients, drops, untracked := w.patterns, w.clients, w.drops, w.untracked
+	w.patterns, w.clients, w.drops, w.untracked = map[string]*ttlStat{}, map[string]*ttlStat{}, nil, 0
+	var noTTL, refreshed []string
+	for key, k := range w.keys {
+		if !k.seen {
+			// forget keys idle for a whole interval
+			delete(w.keys, key)
+			continue
+		}
+		if k.written && !k.ttl {
+			ttlStatOf(patterns, KeyPattern(key), maxPatterns).noTTL++
+			ttlStatOf(clients, k.client, 0).noTTL++
+			if len(noTTL) < ttlSamples {
+				noTTL = append(noTTL, fmt.Sprintf("%s %s", k.client, key))
+			}
+		}
+		// every read, or all but the first, is followed by a new expiration
+		if k.refreshes >= minRefreshes && k.refreshes >= k.reads-1 && len(refreshed) < ttlSamples {
+			refreshed = append(refreshed, fmt.Sprintf("%s %s reads:%d refreshes:%d", k.client, key, k.reads, k.refreshes))
+		}
+		k.seen, k.written, k.reads, k.refreshes = false, false, 0, 0
+	}
+	tracked := len(w.keys)
+	w.mux.Unlock()
+
+	fmt.Printf("[%d]ttl tracked keys:%d, untracked:%d\n", oldTime, tracked, untracked)
+	printTTLStats(oldTime, "pattern", patterns)
+	printTTLStats(oldTime, "client", clients)
+	sort.Strings(noTTL)
+	for _, s := range noTTL {
+		fmt.Printf("[%d]ttl no ttl key:%s\n", oldTime, s)
+	}
+	sort.Strings(refreshed)
+	for _, s := range refreshed {
+		fmt.Printf("[%d]ttl refreshed on read key:%s\n", oldTime, s)
+	}
+	for _, s := range drops {
+		fmt.Printf("[%d]ttl dropped by:%s\n", oldTime, s)
+	}
+}
@@ -0,0 +1,48 @@
+package redis
+
+import (
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestExpiration(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cases := []struct {
+		args   []interface{}
+		action int
+		ttl    time.Duration
+	}{
+		{[]interface{}{"set", "a", "1"}, ttlClear, 0},
+		{[]interface{}{"set", "a", "1", "NX"}, ttlNone, 0},
+		{[]interface{}{"set", "a", "1", "EX", "60"}, ttlSet, time.Minute},
+		{[]interface{}{"set", "a", "1", "PXAT", "1700000060000"}, ttlSet, time.Minute},
+		{[]interface{}{"set", "a", "1", "KEEPTTL"}, ttlKeep, 0},
+		{[]interface{}{"setex", "a", "10", "1"}, ttlSet, 10 * time.Second},
+		{[]interface{}{"expireat", "a", "1700000100"}, ttlSet, 100 * time.Second},
+		{[]interface{}{"getex", "a"}, ttlNone, 0},
+		{[]interface{}{"getex", "a", "persist"}, ttlPersist, 0},
+		{[]interface{}{"hset", "a", "f", "v"}, ttlNone, 0},
+	}
+	for _, c := range cases {
+		action, ttl := expiration(c.args[0].(string), c.args, now)
+		require.Equal(t, c.action, action, c.args)
+		require.Equal(t, c.ttl, ttl, c.args)
+	}
+}
+
+func TestTTLWriter(t *testing.T) {
+	w := NewTTLWriter(time.Hour)
+	s := NewSession("127.0.0.1:1000", false)
+	for _, r := range s.FetchRequests([]byte("*5\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n1\r\n$2\r\nex\r\n$2\r\n60\r\n" +
+		"*2\r\n$3\r\nget\r\n$1\r\na\r\n*3\r\n$6\r\nexpire\r\n$1\r\na\r\n$2\r\n60\r\n" +
+		"*2\r\n$3\r\nget\r\n$1\r\na\r\n*3\r\n$6\r\nexpire\r\n$1\r\na\r\n$2\r\n60\r\n" +
+		"*3\r\n$3\r\nset\r\n$1\r\na\r\n$1\r\n2\r\n*4\r\n$4\r\nhset\r\n$1\r\nh\r\n$1\r\nf\r\n$1\r\nv\r\n")) {
+		w.add(r)
+	}
+	require.Equal(t, 2, w.keys["a"].refreshes)
+	require.False(t, w.keys["a"].ttl)
+	require.True(t, w.keys["h"].written)
+	require.Equal(t, int64(1), w.patterns["a"].dropped)
+	require.Len(t, w.drops, 1)
+}
@@ -12,7 +12,10 @@ import (
 	"time"
 )
 
-var sessionNum uint64
+var (
+	sessionNum  uint64
+	writeErrors uint64
+)
 
 type Monitor struct {
 	localHost net.IP
@@ -24,15 +27,19 @@ type Monitor struct {
 
 const SessionTimeout = time.Minute * 30
 
+// closedTimeout is how long a closed connection is remembered, to drop its late packets.
+const closedTimeout = time.Minute
+
 func NewMonitor(localHost net.IP, localPort layers.TCPPort, onlyIn bool) *Monitor {
 	m := &Monitor{localHost: localHost, localPort: localPort, onlyIn: onlyIn}
 	go func() {
 		for {
 			time.Sleep(time.Second * 300)
-			log.Infof("[Stats]session:%d,process:%d,miss:%d",
+			log.Infof("[Stats]session:%d,process:%d,miss:%d,write error:%d",
 				atomic.LoadUint64(&sessionNum),
 				atomic.LoadUint64(&packetsProcess),
-				atomic.LoadUint64(&packetsMiss))
+				atomic.LoadUint64(&packetsMiss),
+				atomic.LoadUint64(&writeErrors))
 		}
 	}()
 	go func() {
@@ -46,9 +53,13 @@ func NewMonitor(localHost net.IP, localPort layers.TCPPort, onlyIn bool) *Monito
 			total := 0
 			m.sessions.Range(func(key, value interface{}) bool {
 				session := value.(*Session)
-				if time.Since(session.lastTime) > SessionTimeout {
+				session.mux.Lock()
+				idle := time.Since(session.lastTime)
+				closed := session.closed
+				session.mux.Unlock()
+				if idle > SessionTimeout || (closed && idle > closedTimeout) {
 					m.sessions.Delete(key)
-				} else {
+				} else if !closed {
 					total++
 				}
 				return true
@@ -80,7 +91,9 @@ func (s *Monitor) processOne(packet gopacket.Packet) {
 		if s.wr != nil {
 			err := s.wr.FlowOut(ip.DstIP, tcp.DstPort, tcpLayer.LayerPayload())
 			if err != nil {
-				log.Fatal(err)
+				// only this connection is affected, keep monitoring the others
+				atomic.AddUint64(&writeErrors, 1)
+				log.Errorf("[%s:%d]write reply fail:%s", ip.DstIP, tcp.DstPort, err)
 			}
 		}
 		return
@@ -90,13 +103,21 @@ func (s *Monitor) processOne(packet gopacket.Packet) {
 		if s.wr != nil {
 			err := s.wr.FlowIn(ip.SrcIP, tcp.SrcPort, tcpLayer.LayerPayload())
 			if err != nil {
-				log.Fatal(err)
+				atomic.AddUint64(&writeErrors, 1)
+				log.Errorf("[%s:%d]write request fail:%s", ip.SrcIP, tcp.SrcPort, err)
 			}
 		}
 		return
 	}
 }
 
+// close tells the writer that a client connection is closed.
+func (s *Monitor) close(remoteHost net.IP, remotePort layers.TCPPort) {
+	if c, ok := s.wr.(common.CloseWriter); ok {
+		c.FlowClose(remoteHost, remotePort)
+	}
+}
+
 func (s *Monitor) Feed(packet gopacket.Packet) {
 	ipLayer := packet.Layer(layers.LayerTypeIPv4)
 	if ipLayer == nil {
@@ -106,7 +127,7 @@ func (s *Monitor) Feed(packet gopacket.Packet) {
 
 	tcpLayer := packet.Layer(layers.LayerTypeTCP)
 	if tcpLayer == nil {
-		log.Fatalf("no tcp\n")
+		return
 	}
 	tcp, _ := tcpLayer.(*layers.TCP)
 
@@ -120,20 +141,12 @@ func (s *Monitor) Feed(packet gopacket.Packet) {
 	if ip.SrcIP.Equal(s.localHost) && tcp.SrcPort == s.localPort {
 		// out
 		key = fmt.Sprintf("%s:%s", ip.DstIP.String(), tcp.DstPort.String())
-		if tcp.RST {
-			s.sessions.Delete(key)
-			return
-		}
 		remoteHost = ip.DstIP
 		remotePort = tcp.DstPort
 		in = false
 	} else if ip.DstIP.Equal(s.localHost) && tcp.DstPort == s.localPort {
 		// in
 		key = fmt.Sprintf("%s:%s", ip.SrcIP.String(), tcp.SrcPort.String())
-		if tcp.FIN {
-			s.sessions.Delete(key)
-			return
-		}
 		remoteHost = ip.SrcIP
 		remotePort = tcp.SrcPort
 		in = true
@@ -141,7 +154,8 @@ func (s *Monitor) Feed(packet gopacket.Packet) {
 		return
 	}
 
-	if s.onlyIn && !in {
+	closing := tcp.RST || (in && tcp.FIN)
+	if s.onlyIn && !in && !closing {
 		return
 	}
 
@@ -151,9 +165,35 @@ func (s *Monitor) Feed(packet gopacket.Packet) {
 		session = tmp.(*Session)
 	}
 
+	// packets of a connection are handled under its lock, whichever worker took them,
+	// so that its close is delivered after all its data
 	session.mux.Lock()
 	defer session.mux.Unlock()
+	if session.closed {
+		if !tcp.SYN {
+			return
+		}
+		session.reset()
+	}
 	session.AddPacket(packet)
+	if closing {
+		// the packets waiting for a missing one are not followed by anything now
+		for _, dir := range []bool{true, false} {
+			if s.onlyIn && !dir {
+				continue
+			}
+			for {
+				packet, ok := session.Flush(dir)
+				if !ok {
+					break
+				}
+				s.processOne(packet)
+			}
+		}
+		session.closed = true
+		s.close(remoteHost, remotePort)
+		return
+	}
 	for {
 		packet, ok := session.TryGetPacket(in)
 		if !ok {
@@ -0,0 +1,99 @@
+package reorder
+
+import (
+	"fmt"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+	"net"
+	"sync"
+	"testing"
+)
+
+// recordWriter records the data and the closes of each connection in the order received.
+type recordWriter struct {
+	mux    sync.Mutex
+	events []string
+}
+
+func (w *recordWriter) FlowIn(srcHost net.IP, srcPort layers.TCPPort, data []byte) error {
+	w.mux.Lock()
+	w.events = append(w.events, fmt.Sprintf("%d:%s", srcPort, data))
+	w.mux.Unlock()
+	return nil
+}
+
+func (w *recordWriter) FlowOut(dstHost net.IP, dstPort layers.TCPPort, data []byte) error {
+	return nil
+}
+
+func (w *recordWriter) FlowClose(host net.IP, port layers.TCPPort) {
+	w.mux.Lock()
+	w.events = append(w.events, fmt.Sprintf("%d:close", port))
+	w.mux.Unlock()
+}
+
+func packet(t *testing.T, port layers.TCPPort, seq uint32, payload string, syn, fin bool) gopacket.Packet {
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolTCP,
+		SrcIP: net.ParseIP("127.0.0.1").To4(), DstIP: net.ParseIP("10.0.0.1").To4()}
+	tcp := &layers.TCP{SrcPort: port, DstPort: 6379, Seq: seq, ACK: true, SYN: syn, FIN: fin}
+	_ = tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	require.Nil(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true},
+		ip, tcp, gopacket.Payload(payload)))
+	return gopacket.NewPacket(buf.Bytes(), layers.LayerTypeIPv4, gopacket.Default)
+}
+
+func TestMonitor_Close(t *testing.T) {
+	t.Run("pending", func(t *testing.T) {
+		w := &recordWriter{}
+		m := NewMonitor(net.ParseIP("10.0.0.1"), 6379, true)
+		m.SetWriter(w)
+
+		m.Feed(packet(t, 1000, 100, "a", false, false))
+		// 101 is missing, 102 waits for it
+		m.Feed(packet(t, 1000, 102, "c", false, false))
+		m.Feed(packet(t, 1000, 103, "d", false, true))
+		// late packets of the closed connection are dropped
+		m.Feed(packet(t, 1000, 101, "b", false, false))
+		// until the address is reused
+		m.Feed(packet(t, 1000, 500, "", true, false))
+		m.Feed(packet(t, 1000, 501, "e", false, false))
+		require.Equal(t, []string{"1000:a", "1000:c", "1000:d", "1000:close", "1000:e"}, w.events)
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		w := &recordWriter{}
+		m := NewMonitor(net.ParseIP("10.0.0.1"), 6379, true)
+		m.SetWriter(w)
+
+		// the packets of a connection are fed by several workers, like in main
+		const n = 200
+		packets := make(chan gopacket.Packet)
+		wg := sync.WaitGroup{}
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for p := range packets {
+					m.Feed(p)
+				}
+			}()
+		}
+		for i := 0; i < n; i++ {
+			packets <- packet(t, 1000, uint32(100+i), "x", false, false)
+			if i == n/2 {
+				packets <- packet(t, 1000, uint32(100+n), "", false, true)
+			}
+		}
+		close(packets)
+		wg.Wait()
+
+		closed := false
+		for _, e := range w.events {
+			require.False(t, closed, "data after close")
+			closed = e == "1000:close"
+		}
+		require.True(t, closed)
+	})
+}
@@ -28,6 +28,7 @@ type Session struct {
 	packetsOut *rbt.Tree
 	mux        sync.Mutex
 	lastTime   time.Time
+	closed     bool // FIN or RST seen, later packets are dropped until a new SYN
 }
 
 func NewSession(localHost net.IP, localPort layers.TCPPort, remoteHost net.IP, remotePort layers.TCPPort) *Session {
@@ -85,7 +86,35 @@ func (s *Session) AddPacket(packet gopacket.Packet) {
 	}
 }
 
+// reset reuses a closed session for a new connection of the same address.
+func (s *Session) reset() {
+	s.nextSeqIn, s.nextSeqOut = 0, 0
+	s.packetsIn = rbt.NewWith(utils.UInt32Comparator)
+	s.packetsOut = rbt.NewWith(utils.UInt32Comparator)
+	s.closed = false
+}
+
 func (s *Session) TryGetPacket(in bool) (packet gopacket.Packet, ok bool) {
+	return s.next(in, false)
+}
+
+// Flush returns the packets left in order, without waiting for the missing ones.
+func (s *Session) Flush(in bool) (packet gopacket.Packet, ok bool) {
+	for {
+		packets := s.packetsIn
+		if !in {
+			packets = s.packetsOut
+		}
+		if packets.Empty() {
+			return nil, false
+		}
+		if packet, ok = s.next(in, true); ok {
+			return
+		}
+	}
+}
+
+func (s *Session) next(in bool, force bool) (packet gopacket.Packet, ok bool) {
 	var (
 		packets = s.packetsIn
 		nextSeq = &s.nextSeqIn
@@ -99,7 +128,7 @@ func (s *Session) TryGetPacket(in bool) (packet gopacket.Packet, ok bool) {
 		ok = false
 		return
 	}
-	if *nextSeq == 0 || packets.Left().Key == *nextSeq || packets.Size() > 200 {
+	if force || *nextSeq == 0 || packets.Left().Key == *nextSeq || packets.Size() > 200 {
 		if *nextSeq > 0 && *nextSeq != packets.Left().Key {
 			log.Debugf("%s:%s->%s:%s expect %d but %d",
 				s.remoteHost.String(), s.remotePort.String(), s.localHost.String(), s.localPort.String(), *nextSeq, packets.Left().Key)
@@ -0,0 +1,254 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"github.com/morningli/packet_monitor/pkg/reader"
+	"github.com/morningli/packet_monitor/pkg/redis"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Target executes the replayed commands in order per client, redis.Target on a single
+// instance or a cluster.
+type Target interface {
+	Send(client string, args []interface{})
+	CloseClient(client string)
+	Wait()
+}
+
+// Bound is one end of the time window replayed: an absolute time, or an offset from the
+// first command of the capture. The zero Bound is unset.
+type Bound struct {
+	Time   time.Time
+	Offset time.Duration
+	set    bool
+}
+
+// ParseBound parses a unix timestamp, eg: 1339518083.5, or an offset, eg: 10m.
+func ParseBound(s string) (Bound, error) {
+	if s == "" {
+		return Bound{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return Bound{Offset: d, set: true}, nil
+	}
+	ts, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return Bound{}, fmt.Errorf("invalid time: %s", s)
+	}
+	return Bound{Time: time.Unix(0, int64(ts*1e9)), set: true}, nil
+}
+
+func (b Bound) resolve(first time.Time) time.Time {
+	if b.Time.IsZero() {
+		return first.Add(b.Offset)
+	}
+	return b.Time
+}
+
+type Options struct {
+	Speed float64 // multiplier of the original timing
+	Rate  float64 // commands per second instead of the original timing
+	Max   bool    // as fast as possible
+	Loop  int     // times the capture is played, 0 forever
+	From  Bound
+	To    Bound
+	Stats time.Duration
+}
+
+// Player replays a capture on a target, every captured client connection is mapped to its
+// own connection or queue of the target, which is closed with the source connection or at
+// the end of each loop. Commands without time, like those of an AOF without annotations,
+// are sent without waiting and are never out of the time window.
+type Player struct {
+	open   func() (*reader.File, error)
+	target Target
+	opts   Options
+
+	loop    int64
+	read    uint64
+	sent    uint64
+	skipped uint64
+}
+
+// NewPlayer creates a player, open is called again for every loop.
+func NewPlayer(open func() (*reader.File, error), target Target, opts Options) *Player {
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+	return &Player{open: open, target: target, opts: opts}
+}
+
+func (p *Player) logStats() {
+	redis.LogTargetStats()
+	log.Infof("[Stats]replay loop:%d,read:%d,sent:%d,skipped:%d",
+		atomic.LoadInt64(&p.loop),
+		atomic.LoadUint64(&p.read),
+		atomic.LoadUint64(&p.sent),
+		atomic.LoadUint64(&p.skipped))
+}
+
+// Run plays the capture the number of loops requested, and returns once every command is done.
+func (p *Player) Run() error {
+	done := make(chan struct{})
+	if p.opts.Stats > 0 {
+		go func() {
+			tick := time.NewTicker(p.opts.Stats)
+			defer tick.Stop()
+			for {
+				select {
+				case <-tick.C:
+					p.logStats()
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	var err error
+	for i := 0; p.opts.Loop == 0 || i < p.opts.Loop; i++ {
+		atomic.StoreInt64(&p.loop, int64(i+1))
+		err = p.play()
+		// the connections of the capture end with it
+		p.target.Wait()
+		if err != nil {
+			break
+		}
+	}
+	close(done)
+	p.logStats()
+	return err
+}
+
+func (p *Player) play() error {
+	f, err := p.open()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var (
+		first, from, to time.Time // capture time
+		start           time.Time // wall time of the first command sent
+		base            time.Time // capture time of the first command sent
+		n               int64
+		skipTx          = map[string]bool{} // clients whose MULTI was before the window
+		dbs             = map[string]int{}  // db selected on the target connection of each client
+	)
+	for {
+		cmd, err := f.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err == io.ErrUnexpectedEOF {
+			log.Warnf("capture truncated")
+			return nil
+		}
+		var syntaxErr *reader.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			log.Warnf("skip invalid command:%s", err)
+			atomic.AddUint64(&p.skipped, 1)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if cmd.Closed {
+			delete(skipTx, cmd.Client)
+			delete(dbs, cmd.Client)
+			p.target.CloseClient(cmd.Client)
+			continue
+		}
+		atomic.AddUint64(&p.read, 1)
+
+		if !cmd.Time.IsZero() {
+			if first.IsZero() {
+				first = cmd.Time
+				from, to = p.opts.From.resolve(first), p.opts.To.resolve(first)
+			}
+			if p.opts.From.set && cmd.Time.Before(from) {
+				if cmd.Name() == "multi" {
+					skipTx[cmd.Client] = true
+				}
+				if !skipTx[cmd.Client] && connectionState(cmd) {
+					// the commands in the window run on the connection as it was
+					p.dispatch(cmd, dbs)
+					continue
+				}
+				atomic.AddUint64(&p.skipped, 1)
+				continue
+			}
+			if p.opts.To.set && cmd.Time.After(to) {
+				// captures are in time order
+				return nil
+			}
+		}
+
+		if skipTx[cmd.Client] {
+			// the rest of a transaction started before the window
+			if name := cmd.Name(); name == "exec" || name == "discard" {
+				delete(skipTx, cmd.Client)
+			}
+			atomic.AddUint64(&p.skipped, 1)
+			continue
+		}
+
+		if start.IsZero() {
+			start = time.Now()
+		}
+		if base.IsZero() {
+			base = cmd.Time
+		}
+		var due time.Time
+		switch {
+		case p.opts.Max:
+		case p.opts.Rate > 0:
+			due = start.Add(time.Duration(float64(n) * float64(time.Second) / p.opts.Rate))
+		case !cmd.Time.IsZero() && !base.IsZero():
+			due = start.Add(time.Duration(float64(cmd.Time.Sub(base)) / p.opts.Speed))
+		}
+		if wait := time.Until(due); wait > 0 {
+			time.Sleep(wait)
+		}
+		n++
+		p.dispatch(cmd, dbs)
+	}
+}
+
+// connectionState reports whether a command only sets up the connection.
+func connectionState(cmd *reader.Command) bool {
+	switch cmd.Name() {
+	case "select", "auth", "hello":
+		return true
+	case "client":
+		return len(cmd.Args) > 1 && strings.EqualFold(cmd.Args[1], "setname")
+	}
+	return false
+}
+
+// dispatch sends a command, after a SELECT when the target connection of its client is
+// not in the db of the command, like when the capture starts after the SELECT.
+func (p *Player) dispatch(cmd *reader.Command, dbs map[string]int) {
+	if cmd.Name() == "select" {
+		if len(cmd.Args) == 2 {
+			if db, err := strconv.Atoi(cmd.Args[1]); err == nil {
+				dbs[cmd.Client] = db
+			}
+		}
+	} else if cmd.DB != dbs[cmd.Client] {
+		dbs[cmd.Client] = cmd.DB
+		p.target.Send(cmd.Client, []interface{}{"select", strconv.Itoa(cmd.DB)})
+	}
+	args := make([]interface{}, len(cmd.Args))
+	for i, v := range cmd.Args {
+		args[i] = v
+	}
+	p.target.Send(cmd.Client, args)
+	atomic.AddUint64(&p.sent, 1)
+}
@@ -0,0 +1,93 @@
+package replay
+
+import (
+	"fmt"
+	"github.com/morningli/packet_monitor/pkg/reader"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type fakeTarget struct {
+	cmds []string
+}
+
+func (t *fakeTarget) Send(client string, args []interface{}) {
+	t.cmds = append(t.cmds, fmt.Sprintf("%s %v", client, args))
+}
+
+func (t *fakeTarget) CloseClient(client string) {
+	t.cmds = append(t.cmds, "close "+client)
+}
+
+func (t *fakeTarget) Wait() {
+	t.cmds = append(t.cmds, "wait")
+}
+
+func TestPlayer(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.txt")
+	require.Nil(t, os.WriteFile(name, []byte(`1339518083.000000 [0 c1] "set" "a" "1"
+1339518083.100000 [0 c1] "multi"
+1339518083.150000 [0 c2] "get" "b"
+1339518083.200000 [0 c1] "incr" "a"
+1339518083.200000 [0 c1] "incr" "b"
+1339518083.300000 [0 c1] "exec"
+1339518083.400000 [0 c1] "multi"
+1339518083.400000 [0 c1] "incr" "c"
+1339518083.400000 [0 c1] "discard"
+1339518084.000000 [0 c1] "get" "a"
+`), 0644))
+	open := func() (*reader.File, error) {
+		return reader.Open(name, "", nil, 0)
+	}
+
+	target := &fakeTarget{}
+	p := NewPlayer(open, target, Options{Max: true, Loop: 2})
+	require.Nil(t, p.Run())
+	loop := []string{"c1 [set a 1]", "c1 [multi]", "c2 [get b]", "c1 [incr a]", "c1 [incr b]", "c1 [exec]",
+		"c1 [multi]", "c1 [incr c]", "c1 [discard]", "c1 [get a]", "wait"}
+	require.Equal(t, append(loop, loop...), target.cmds)
+
+	// the window starts 50ms after the first command, the original timing is twice faster
+	target = &fakeTarget{}
+	from, err := ParseBound("50ms")
+	require.Nil(t, err)
+	to, err := ParseBound("1339518083.5")
+	require.Nil(t, err)
+	start := time.Now()
+	p = NewPlayer(open, target, Options{Speed: 2, Loop: 1, From: from, To: to})
+	require.Nil(t, p.Run())
+	require.Equal(t, loop[1:9], target.cmds[:8])
+	require.GreaterOrEqual(t, time.Since(start), 150*time.Millisecond)
+	require.EqualValues(t, 1, p.skipped)
+
+	// a transaction which started before the window is skipped
+	target = &fakeTarget{}
+	from, _ = ParseBound("150ms")
+	p = NewPlayer(open, target, Options{Max: true, Loop: 1, From: from})
+	require.Nil(t, p.Run())
+	require.Equal(t, []string{"c2 [get b]", "c1 [multi]", "c1 [incr c]", "c1 [discard]", "c1 [get a]", "wait"}, target.cmds)
+}
+
+func TestPlayer_State(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "out.txt")
+	require.Nil(t, os.WriteFile(name, []byte(`1339518083.000000 [0 c1] "auth" "secret"
+1339518083.000000 [0 c1] "select" "2"
+1339518083.000000 [2 c1] "set" "a" "1"
+1339518083.100000 [2 c1] "get" "a"
+1339518083.100000 [3 c2] "get" "b"
+`), 0644))
+	open := func() (*reader.File, error) {
+		return reader.Open(name, "", nil, 0)
+	}
+
+	// the state of c1 is set up before the window, c2 was in db 3 when the capture started
+	target := &fakeTarget{}
+	from, _ := ParseBound("50ms")
+	p := NewPlayer(open, target, Options{Max: true, Loop: 1, From: from})
+	require.Nil(t, p.Run())
+	require.Equal(t, []string{"c1 [auth secret]", "c1 [select 2]", "c1 [get a]", "c2 [select 3]", "c2 [get b]", "wait"}, target.cmds)
+	require.EqualValues(t, 1, p.skipped)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/google/gopacket/layers"
+	"github.com/morningli/packet_monitor/pkg/reader"
+	"github.com/morningli/packet_monitor/pkg/redis"
+	"github.com/morningli/packet_monitor/pkg/replay"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// replayMain runs: packet_monitor replay [options] <capture>
+func replayMain(args []string) {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	var (
+		target   = fs.String("o", "", "replay target, single:<host>:<port> or cluster:<host>:<port>,<host>:<port>")
+		format   = fs.String("format", "", "capture format, text/aof/json/pcap, guessed from the file extension by default")
+		host     = fs.String("h", "", "for pcap captures, the ip of the redis server, any when empty")
+		port     = fs.Int("p", 6379, "for pcap captures, the port of the redis server")
+		speed    = fs.Float64("speed", 1, "replay with the original timing multiplied by speed, eg: 2 is twice faster")
+		rate     = fs.Float64("rate", 0, "replay at a fixed rate of commands per second instead of the original timing")
+		max      = fs.Bool("max", false, "replay as fast as possible")
+		loop     = fs.Int("loop", 1, "times the capture is replayed, 0 forever")
+		from     = fs.String("from", "", "start of the time window, a unix timestamp or an offset from the first command, eg: 10m")
+		to       = fs.String("to", "", "end of the time window, a unix timestamp or an offset from the first command, eg: 1h")
+		rules    = fs.String("rules", "", "filter and transform rules, see -rules of the capture, eg: \"keep class=write;db=0:1\"")
+		stats    = fs.Duration("stats", 10*time.Second, "interval of the [Stats] lines")
+		logLevel = fs.String("log-level", "info", "log level,trace/debug/info/warn/error/fatal/panic")
+	)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [options] <capture>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+
+	lvl, err := log.ParseLevel(*logLevel)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.SetLevel(lvl)
+	log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	name := fs.Arg(0)
+
+	pos := strings.Index(*target, ":")
+	if pos == -1 || pos == len(*target)-1 {
+		log.Fatalf("No address specified")
+	}
+	targetType, address := (*target)[:pos], (*target)[pos+1:]
+	if targetType != "single" && targetType != "cluster" {
+		log.Fatalf("unknown target type:%s", targetType)
+	}
+
+	opts := replay.Options{Speed: *speed, Rate: *rate, Max: *max, Loop: *loop, Stats: *stats}
+	if opts.From, err = replay.ParseBound(*from); err != nil {
+		log.Fatal(err)
+	}
+	if opts.To, err = replay.ParseBound(*to); err != nil {
+		log.Fatal(err)
+	}
+
+	replayRules, err := redis.ParseReplayRules(*rules)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var serverIP net.IP
+	if *host != "" {
+		serverIP = net.ParseIP(*host)
+	}
+	open := func() (*reader.File, error) {
+		return reader.Open(name, *format, serverIP, layers.TCPPort(*port))
+	}
+
+	t := redis.NewRulesTarget(redis.NewTarget(address, targetType == "cluster"), replayRules)
+	defer t.Close()
+	if err = replay.NewPlayer(open, t, opts).Run(); err != nil {
+		log.Fatal(err)
+	}
+}